@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+// purgeHandler serves POST /admin/purge, which deletes every finished job in
+// one go: all terminal statuses, or just ?status=. Like every other request
+// it acts on the caller's namespace (the default one if none is given); jobs
+// in every namespace are purged only with an explicit ?all_namespaces=true.
+// Dead-letter jobs are purged only with ?dead_letter=include or only, as for
+// the job list. ?confirm=true is required so a stray request can't wipe the
+// history.
+func purgeHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	q := r.URL.Query()
+	if q.Get("confirm") != "true" {
+		httpError(w, "Purging deletes jobs for good; add confirm=true to proceed", http.StatusBadRequest)
+		return
+	}
+	status := q.Get("status")
+	if status != "" && !isTerminal(status) {
+		httpError(w, "status must be a terminal status (COMPLETED, FAILED, CANCELED, TIMEOUT or OUTPUT_LIMIT_EXCEEDED)", http.StatusBadRequest)
+		return
+	}
+	deadLetter := q.Get("dead_letter")
+	switch deadLetter {
+	case "", "exclude", "include", "only":
+	default:
+		httpError(w, "dead_letter must be one of exclude, include or only", http.StatusBadRequest)
+		return
+	}
+	ns, err := requestNamespace(r)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	allNamespaces := q.Get("all_namespaces") == "true"
+	if allNamespaces && ns != "" {
+		httpError(w, "all_namespaces can't be combined with a namespace", http.StatusBadRequest)
+		return
+	}
+	metas, _, err := store.List(jobFilter{
+		Namespace:     ns,
+		AllNamespaces: allNamespaces,
+		Status:        status,
+		DeadLetter:    deadLetter,
+	})
+	if err != nil {
+		httpError(w, "Failed to list jobs", http.StatusInternalServerError)
+		return
+	}
+
+	purged := 0
+	for _, meta := range metas {
+		if !isTerminal(meta.Status) {
+			continue
+		}
+		mu.Lock()
+		_, running := runningJobs[meta.ID]
+		mu.Unlock()
+		if running {
+			continue
+		}
+		if err := removeJob(meta.Namespace, meta.ID); err != nil {
+			slog.WarnContext(r.Context(), "Failed to purge job", "event", "purge_error", "job_id", meta.ID, "error", err)
+			continue
+		}
+		purged++
+	}
+	slog.InfoContext(r.Context(), "Jobs purged", "event", "jobs_purged", "status", status, "namespace", ns, "all_namespaces", allNamespaces, "count", purged)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"purged": purged})
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestPurgeIsScopedToNamespace(t *testing.T) {
+	srv := newTestServer(t)
+	purge := func(query, ns string) (int, string) {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/admin/purge?"+query, nil)
+		if ns != "" {
+			req.Header.Set("X-Namespace", ns)
+		}
+		return send(t, req)
+	}
+	submitAll := func() {
+		for _, body := range []string{`{"args": ["true"]}`, `{"args": ["true"], "namespace": "team-a"}`, `{"args": ["true"], "namespace": "team-b"}`} {
+			submit(t, srv.URL, body)
+		}
+		eventually(t, "jobs not finished", func() bool {
+			counts, _ := jobCounts.snapshot()
+			return counts["IN_QUEUE"]+counts["IN_PROGRESS"] == 0
+		})
+	}
+	submitAll()
+
+	if status, _ := purge("", ""); status != http.StatusBadRequest {
+		t.Errorf("purge without confirm: %d", status)
+	}
+	if status, body := purge("confirm=true", ""); status != http.StatusOK || body != "{\"purged\":1}\n" {
+		t.Errorf("purge of the default namespace: %d %s", status, body)
+	}
+	if status, body := purge("confirm=true", "team-a"); status != http.StatusOK || body != "{\"purged\":1}\n" {
+		t.Errorf("purge of team-a: %d %s", status, body)
+	}
+	if status, _ := purge("confirm=true&all_namespaces=true", "team-b"); status != http.StatusBadRequest {
+		t.Errorf("all_namespaces with a namespace: %d", status)
+	}
+	if _, total := jobCounts.snapshot(); total != 1 {
+		t.Errorf("%d jobs left, want team-b's", total)
+	}
+
+	submitAll()
+	if status, body := purge("confirm=true&all_namespaces=true", ""); status != http.StatusOK || body != "{\"purged\":4}\n" {
+		t.Errorf("purge of all namespaces: %d %s", status, body)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const maxOutputFiles = 32
+
+// checkOutputFiles validates the output_files of a job request: relative
+// paths that stay inside the directory the job runs in, each with a distinct
+// file name, which becomes the name of the artifact.
+func checkOutputFiles(paths []string) error {
+	if len(paths) > maxOutputFiles {
+		return badRequest("At most %d output_files are allowed", maxOutputFiles)
+	}
+	seen := make(map[string]bool)
+	for _, p := range paths {
+		clean := filepath.Clean(p)
+		if p == "" || filepath.IsAbs(p) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+			return badRequest("Invalid output file %q: must be a relative path inside the job's directory", p)
+		}
+		name := filepath.Base(clean)
+		if !validFileName(name) {
+			return badRequest("Invalid output file %q: file names may only contain letters, digits, '.', '_' and '-'", p)
+		}
+		if seen[name] {
+			return badRequest("Output files must have distinct names; %q is used twice", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// workDir returns the directory a job with output_files but no cwd runs in,
+// so the files it writes land inside its job directory.
+func workDir(jobDir string) string {
+	return filepath.Join(jobDir, "work")
+}
+
+// collectArtifacts copies the output files a job wrote in dir into its
+// artifacts directory and records which were found. Only regular files
+// inside dir are collected; a symlink could otherwise expose any file the
+// server can read.
+func collectArtifacts(meta *JobMeta, jobDir, dir string) {
+	base, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		slog.Warn("Failed to collect artifacts", "event", "artifact_error", "job_id", meta.ID, "error", err)
+		return
+	}
+	artifactsDir := filepath.Join(jobDir, "artifacts")
+	for _, p := range meta.OutputFiles {
+		src := filepath.Join(base, filepath.Clean(p))
+		parent, err := filepath.EvalSymlinks(filepath.Dir(src))
+		if err == nil && parent != base && !strings.HasPrefix(parent, base+string(filepath.Separator)) {
+			err = fmt.Errorf("%s is outside the job's directory", p)
+		}
+		var info os.FileInfo
+		if err == nil {
+			info, err = os.Lstat(src)
+		}
+		if err == nil && !info.Mode().IsRegular() {
+			err = fmt.Errorf("%s is not a regular file", p)
+		}
+		if err == nil {
+			err = os.MkdirAll(artifactsDir, 0755)
+		}
+		if err == nil {
+			err = copyFile(src, filepath.Join(artifactsDir, filepath.Base(src)))
+		}
+		if err != nil {
+			slog.Warn("Output file not collected", "event", "artifact_missing", "job_id", meta.ID, "file", p, "error", err)
+			continue
+		}
+		meta.Artifacts = append(meta.Artifacts, filepath.Base(src))
+	}
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
+
+// artifactInfo describes an artifact in the GET /jobs/{id}/artifacts listing.
+type artifactInfo struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	URL  string `json:"url"`
+}
+
+// serveArtifacts lists a job's artifacts, or serves the one called name.
+func serveArtifacts(w http.ResponseWriter, r *http.Request, ns, id, name string) {
+	meta, err := loadMeta(ns, id)
+	if err != nil {
+		httpError(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	dir := filepath.Join(getJobDir(ns, id), "artifacts")
+	if name != "" {
+		if !slices.Contains(meta.Artifacts, name) {
+			httpError(w, "Artifact not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+		serveFile(w, r, filepath.Join(dir, name))
+		return
+	}
+	out := []artifactInfo{}
+	for _, a := range meta.Artifacts {
+		info, err := os.Stat(filepath.Join(dir, a))
+		if err != nil {
+			continue
+		}
+		out = append(out, artifactInfo{Name: a, Size: info.Size(), URL: jobURL(ns, id, "artifacts/"+a)})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestArtifacts(t *testing.T) {
+	srv := newTestServer(t)
+	id := submit(t, srv.URL, `{"args": ["sh", "-c", "mkdir out; echo done > out/report.txt; printf 'a,b\n' > summary.csv; ln -s /etc/passwd leak"],
+		"output_files": ["out/report.txt", "summary.csv", "leak", "missing.txt"]}`)
+	meta := waitFinished(t, srv.URL, id)
+	if meta.Status != "COMPLETED" || !slices.Equal(meta.Artifacts, []string{"report.txt", "summary.csv"}) {
+		t.Fatalf("job %s with artifacts %q", meta.Status, meta.Artifacts)
+	}
+
+	status, body := do(t, http.MethodGet, srv.URL+"/jobs/"+id+"/artifacts", "", "")
+	var list []artifactInfo
+	if err := json.Unmarshal([]byte(body), &list); err != nil || status != http.StatusOK {
+		t.Fatalf("artifact listing: %d %s", status, body)
+	}
+	if len(list) != 2 || list[0].Name != "report.txt" || list[0].Size != 5 || list[1].Size != 4 {
+		t.Errorf("artifact listing: %s", body)
+	}
+	if status, body := do(t, http.MethodGet, srv.URL+"/jobs/"+id+"/artifacts/report.txt", "", ""); status != http.StatusOK || body != "done\n" {
+		t.Errorf("report.txt: %d %q", status, body)
+	}
+	for _, name := range []string{"leak", "missing.txt"} {
+		if status, _ := do(t, http.MethodGet, srv.URL+"/jobs/"+id+"/artifacts/"+name, "", ""); status != http.StatusNotFound {
+			t.Errorf("artifact %s: %d", name, status)
+		}
+	}
+
+	for _, files := range []string{`["../escape.txt"]`, `["/etc/passwd"]`, `["a/x.txt", "b/x.txt"]`} {
+		if status, body := do(t, http.MethodPost, srv.URL+"/jobs", "application/json", `{"args": ["true"], "output_files": `+files+`}`); status != http.StatusBadRequest {
+			t.Errorf("output_files %s: %d %s", files, status, body)
+		}
+	}
+}
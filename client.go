@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// clientCommands are the subcommands that make the binary act as a client of
+// a running server instead of starting one.
+var clientCommands = map[string]bool{"submit": true, "status": true, "result": true, "wait": true}
+
+const clientUsage = `usage:
+  processjobqueue [server] [fixed command...]   run the server
+  processjobqueue submit [--] command [args...]  submit a job and print its id
+  processjobqueue status <job-id>                print a job's status as JSON
+  processjobqueue result <job-id>                print a job's stdout
+  processjobqueue wait <job-id>                  wait for a job to finish and print its status
+
+Client commands talk to SERVER_URL (default http://localhost:8080) and send
+API_KEY as a bearer token when it is set.`
+
+// runClient runs a client subcommand and returns the process exit code: 0 on
+// success, 1 if the request failed (or, for wait, the job didn't complete)
+// and 2 for usage errors.
+func runClient(command string, args []string) int {
+	if command == "submit" && len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+	if command == "submit" && len(args) == 0 {
+		return clientUsageError("submit needs a command to run")
+	}
+	if command != "submit" && len(args) != 1 {
+		return clientUsageError(command + " needs exactly one job ID")
+	}
+
+	var err error
+	switch command {
+	case "submit":
+		err = clientSubmit(args)
+	case "status":
+		err = clientCopy("/jobs/" + url.PathEscape(args[0]) + "/status")
+	case "result":
+		err = clientCopy("/jobs/" + url.PathEscape(args[0]) + "/result")
+	case "wait":
+		var meta *JobMeta
+		if meta, err = clientWait(args[0]); err == nil && meta.Status != "COMPLETED" {
+			return 1
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func clientUsageError(msg string) int {
+	fmt.Fprintf(os.Stderr, "%s\n\n%s\n", msg, clientUsage)
+	return 2
+}
+
+// clientRequest sends a request to the server and returns the response if it
+// was successful; otherwise the error carries the server's message.
+func clientRequest(method, path string, body io.Reader) (*http.Response, error) {
+	base := os.Getenv("SERVER_URL")
+	if base == "" {
+		base = "http://localhost:8080"
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(base, "/")+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if key := os.Getenv("API_KEY"); key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		var envelope struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if json.Unmarshal(msg, &envelope) == nil && envelope.Error.Message != "" {
+			msg = []byte(envelope.Error.Message)
+		}
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+func clientSubmit(args []string) error {
+	data, _ := json.Marshal(jobRequest{Args: args})
+	resp, err := clientRequest(http.MethodPost, "/jobs", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var links map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&links); err != nil {
+		return fmt.Errorf("decoding response: %w", err)
+	}
+	fmt.Println(links["id"])
+	return nil
+}
+
+// clientCopy writes the body of a GET request to stdout.
+func clientCopy(path string) error {
+	resp, err := clientRequest(http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(os.Stdout, resp.Body)
+	return err
+}
+
+// clientWait long-polls /jobs/{id}/wait until the job has finished, then
+// prints its metadata.
+func clientWait(id string) (*JobMeta, error) {
+	for {
+		resp, err := clientRequest(http.MethodGet, "/jobs/"+url.PathEscape(id)+"/wait?timeout=300", nil)
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		var meta JobMeta
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return nil, fmt.Errorf("decoding response: %w", err)
+		}
+		if isTerminal(meta.Status) {
+			os.Stdout.Write(data)
+			return &meta, nil
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// client runs a client subcommand against base and returns its exit code and
+// what it printed to stdout and stderr.
+func client(t *testing.T, base, command string, args ...string) (code int, stdout, stderr string) {
+	t.Helper()
+	t.Setenv("SERVER_URL", base+"/")
+	dir := t.TempDir()
+	outFile, err := os.Create(filepath.Join(dir, "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	errFile, err := os.Create(filepath.Join(dir, "stderr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	origOut, origErr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = outFile, errFile
+	code = runClient(command, args)
+	os.Stdout, os.Stderr = origOut, origErr
+	outFile.Close()
+	errFile.Close()
+	out, _ := os.ReadFile(outFile.Name())
+	errOut, _ := os.ReadFile(errFile.Name())
+	return code, string(out), string(errOut)
+}
+
+func TestClientCommands(t *testing.T) {
+	srv := newTestServer(t)
+	code, out, errOut := client(t, srv.URL, "submit", "--", "echo", "-n", "hello")
+	id := strings.TrimSpace(out)
+	if code != 0 || uuid.Validate(id) != nil {
+		t.Fatalf("submit: exit %d, printed %q %q", code, out, errOut)
+	}
+
+	code, out, _ = client(t, srv.URL, "wait", id)
+	var meta JobMeta
+	if err := json.Unmarshal([]byte(out), &meta); err != nil || code != 0 || meta.Status != "COMPLETED" {
+		t.Errorf("wait: exit %d, printed %q", code, out)
+	}
+	if code, out, _ = client(t, srv.URL, "status", id); code != 0 || !strings.Contains(out, `"status":"COMPLETED"`) {
+		t.Errorf("status: exit %d, printed %q", code, out)
+	}
+	if code, out, _ = client(t, srv.URL, "result", id); code != 0 || out != "hello" {
+		t.Errorf("result: exit %d, printed %q", code, out)
+	}
+
+	_, out, _ = client(t, srv.URL, "submit", "false")
+	if code, _, _ = client(t, srv.URL, "wait", strings.TrimSpace(out)); code != 1 {
+		t.Errorf("wait for a failing job: exit %d", code)
+	}
+	if code, _, errOut = client(t, srv.URL, "status", uuid.NewString()); code != 1 || !strings.Contains(errOut, "Job not found") {
+		t.Errorf("status of a missing job: exit %d, %q", code, errOut)
+	}
+	for _, args := range [][]string{{"submit"}, {"status"}, {"result", "a", "b"}} {
+		if code, _, errOut = client(t, srv.URL, args[0], args[1:]...); code != 2 || !strings.Contains(errOut, "usage:") {
+			t.Errorf("%q: exit %d, %q", args, code, errOut)
+		}
+	}
+}
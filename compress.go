@@ -0,0 +1,106 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// serveFile serves a job output file like http.ServeFile, but gzip-compresses
+// the body when the client accepts it. Range requests are served
+// uncompressed, since ranges refer to offsets in the original file.
+//
+// Responses carry Last-Modified and an ETag derived from the file's size and
+// modification time, and conditional requests (If-None-Match,
+// If-Modified-Since) for an unchanged file get 304 Not Modified, so polling a
+// finished job's output is cheap.
+func serveFile(w http.ResponseWriter, r *http.Request, path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		httpError(w, "File not available", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		httpError(w, "File not available", http.StatusNotFound)
+		return
+	}
+	serveContent(w, r, info.Name(), info.Size(), info.ModTime(), f)
+}
+
+// serveContent does the work of serveFile for content of the given size and
+// modification time, which may come from several files.
+func serveContent(w http.ResponseWriter, r *http.Request, name string, size int64, modTime time.Time, content io.ReadSeeker) {
+	w.Header().Add("Vary", "Accept-Encoding")
+	if w.Header().Get("Content-Type") == "" {
+		// Job output files are all .txt, which is what ServeFile would
+		// derive the type from.
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	etag := fmt.Sprintf(`"%x-%x`, size, modTime.UnixNano())
+	if !acceptsGzip(r) || r.Header.Get("Range") != "" {
+		w.Header().Set("ETag", etag+`"`)
+		http.ServeContent(w, r, name, modTime, content)
+		return
+	}
+	// The compressed body is a different representation, so it gets its own
+	// ETag.
+	etag += `-gzip"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	if notModified(r, etag, modTime) {
+		w.Header().Del("Content-Type")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+	gz := gzip.NewWriter(w)
+	io.Copy(gz, content)
+	gz.Close()
+}
+
+// notModified reports whether a GET or HEAD request's conditional headers
+// match a file with the given ETag and modification time. If-Modified-Since
+// is only consulted without If-None-Match, as RFC 9110 requires.
+func notModified(r *http.Request, etag string, modTime time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || tag == etag {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	return !modTime.Truncate(time.Second).After(since)
+}
+
+// acceptsGzip reports whether the request's Accept-Encoding allows gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(enc), ";")
+		if strings.TrimSpace(name) != "gzip" {
+			continue
+		}
+		q := strings.ReplaceAll(params, " ", "")
+		return q != "q=0" && q != "q=0.0" && q != "q=0.00" && q != "q=0.000"
+	}
+	return false
+}
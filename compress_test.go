@@ -0,0 +1,125 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// download gets url with the given Accept-Encoding and returns the response
+// and its undecoded body.
+func download(t *testing.T, url, acceptEncoding string) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Setting the header ourselves stops the transport from decompressing.
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+func TestGzipDownloads(t *testing.T) {
+	srv := newTestServer(t)
+	id := submit(t, srv.URL, `{"args": ["sh", "-c", "seq 1000; seq 500 >&2"]}`)
+	waitFinished(t, srv.URL, id)
+	for endpoint, want := range map[string]string{"result": seq(1000), "log": seq(500)} {
+		url := srv.URL + "/jobs/" + id + "/" + endpoint
+		resp, body := download(t, url, "gzip, deflate")
+		if resp.Header.Get("Content-Encoding") != "gzip" {
+			t.Fatalf("%s: Content-Encoding %q", endpoint, resp.Header.Get("Content-Encoding"))
+		}
+		if len(body) >= len(want) {
+			t.Errorf("%s: compressed body is %d bytes, plain is %d", endpoint, len(body), len(want))
+		}
+		zr, err := gzip.NewReader(strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("%s: %v", endpoint, err)
+		}
+		if got, err := io.ReadAll(zr); err != nil || string(got) != want {
+			t.Errorf("%s: decoded body differs (err %v)", endpoint, err)
+		}
+
+		resp, body = download(t, url, "gzip;q=0")
+		if resp.Header.Get("Content-Encoding") != "" || body != want {
+			t.Errorf("%s with gzip refused: Content-Encoding %q", endpoint, resp.Header.Get("Content-Encoding"))
+		}
+	}
+
+	// Ranges are offsets into the plain output.
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/jobs/"+id+"/result", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("Range", "bytes=0-5")
+	if status, body := send(t, req); status != http.StatusPartialContent || body != "1\n2\n3\n" {
+		t.Errorf("range request: %d %q", status, body)
+	}
+}
+
+// seq returns the output of seq n.
+func seq(n int) string {
+	var b strings.Builder
+	for i := 1; i <= n; i++ {
+		b.WriteString(strconv.Itoa(i) + "\n")
+	}
+	return b.String()
+}
+
+func TestConditionalDownloads(t *testing.T) {
+	srv := newTestServer(t)
+	id := submit(t, srv.URL, `{"args": ["seq", "100"]}`)
+	waitFinished(t, srv.URL, id)
+	url := srv.URL + "/jobs/" + id + "/result"
+	conditional := func(acceptEncoding, header, value string) int {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		req.Header.Set(header, value)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	plain, body := download(t, url, "identity")
+	if plain.Header.Get("Content-Length") != strconv.Itoa(len(body)) {
+		t.Errorf("Content-Length %q for %d bytes", plain.Header.Get("Content-Length"), len(body))
+	}
+	zipped, _ := download(t, url, "gzip")
+	etag, lastModified := plain.Header.Get("ETag"), plain.Header.Get("Last-Modified")
+	if etag == "" || lastModified == "" || zipped.Header.Get("ETag") == etag {
+		t.Fatalf("ETag %q (gzip %q), Last-Modified %q", etag, zipped.Header.Get("ETag"), lastModified)
+	}
+	for _, resp := range []*http.Response{plain, zipped} {
+		enc := resp.Header.Get("Content-Encoding")
+		if enc == "" {
+			enc = "identity"
+		}
+		if status := conditional(enc, "If-None-Match", resp.Header.Get("ETag")); status != http.StatusNotModified {
+			t.Errorf("If-None-Match with a current ETag (%q): %d", enc, status)
+		}
+		if status := conditional(enc, "If-Modified-Since", lastModified); status != http.StatusNotModified {
+			t.Errorf("If-Modified-Since the last change (%q): %d", enc, status)
+		}
+	}
+	// The gzip ETag doesn't validate the plain representation.
+	if status := conditional("identity", "If-None-Match", zipped.Header.Get("ETag")); status != http.StatusOK {
+		t.Errorf("If-None-Match with the other representation's ETag: %d", status)
+	}
+	if status := conditional("gzip", "If-None-Match", `"stale"`); status != http.StatusOK {
+		t.Errorf("If-None-Match with a stale ETag: %d", status)
+	}
+}
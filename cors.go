@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// corsExposedHeaders are the response headers browser scripts may read in
+// addition to the CORS-safelisted ones.
+const corsExposedHeaders = "ETag, Retry-After, X-Job-Status, Content-Disposition, X-Request-ID"
+
+// allowCORS adds CORS headers for requests from the origins listed in
+// ALLOWED_ORIGINS (comma-separated, or "*" for any origin) and answers
+// preflight requests itself, before authentication, since browsers send them
+// without credentials. Without ALLOWED_ORIGINS no CORS headers are sent and
+// browsers refuse cross-origin calls.
+func allowCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !originAllowed(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		h.Set("Access-Control-Allow-Origin", origin)
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+			h.Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, DELETE")
+			if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+				h.Set("Access-Control-Allow-Headers", headers)
+			}
+			h.Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.Set("Access-Control-Expose-Headers", corsExposedHeaders)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func originAllowed(origin string) bool {
+	allowed := os.Getenv("ALLOWED_ORIGINS")
+	if allowed == "" {
+		return false
+	}
+	origins := strings.Split(allowed, ",")
+	for i := range origins {
+		origins[i] = strings.TrimSpace(origins[i])
+	}
+	return slices.Contains(origins, "*") || slices.Contains(origins, origin)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// corsRequest sends a request from origin and returns the response headers.
+func corsRequest(t *testing.T, method, url, origin string, header map[string]string) (int, http.Header) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Origin", origin)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode, resp.Header
+}
+
+func TestCORS(t *testing.T) {
+	t.Setenv("ALLOWED_ORIGINS", "https://app.example, https://other.example")
+	t.Setenv("API_KEY", "secret")
+	srv := newTestServer(t)
+
+	// Preflights go without credentials, so they are answered before the
+	// API key is checked.
+	status, h := corsRequest(t, http.MethodOptions, srv.URL+"/jobs", "https://app.example", map[string]string{
+		"Access-Control-Request-Method":  "POST",
+		"Access-Control-Request-Headers": "authorization, content-type",
+	})
+	if status != http.StatusNoContent || h.Get("Access-Control-Allow-Origin") != "https://app.example" ||
+		h.Get("Access-Control-Allow-Headers") != "authorization, content-type" || h.Get("Access-Control-Allow-Methods") == "" {
+		t.Errorf("preflight: %d %v", status, h)
+	}
+
+	status, h = corsRequest(t, http.MethodGet, srv.URL+"/jobs", "https://other.example", map[string]string{"Authorization": "Bearer secret"})
+	if status != http.StatusOK || h.Get("Access-Control-Allow-Origin") != "https://other.example" || h.Get("Access-Control-Expose-Headers") != corsExposedHeaders {
+		t.Errorf("cross-origin GET: %d %v", status, h)
+	}
+
+	status, h = corsRequest(t, http.MethodGet, srv.URL+"/jobs", "https://evil.example", map[string]string{"Authorization": "Bearer secret"})
+	if h.Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("GET from an origin that isn't allowed: %d %v", status, h)
+	}
+	t.Setenv("ALLOWED_ORIGINS", "")
+	if _, h = corsRequest(t, http.MethodGet, srv.URL+"/jobs", "https://app.example", map[string]string{"Authorization": "Bearer secret"}); h.Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("CORS headers without ALLOWED_ORIGINS: %v", h)
+	}
+}
@@ -0,0 +1,29 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+)
+
+var errRunAsUnsupported = errors.New("run_as_user is not supported on this platform")
+
+// lookupCredential always fails where processes can't be started as another
+// user.
+func lookupCredential(name string) (struct{}, error) {
+	return struct{}{}, errRunAsUnsupported
+}
+
+// setCredential fails unless name is empty.
+func setCredential(cmd *exec.Cmd, name string) error {
+	if name == "" {
+		return nil
+	}
+	return errRunAsUnsupported
+}
+
+// chownToJobUser does nothing, as jobs always run as the server's user.
+func chownToJobUser(cmd *exec.Cmd, paths ...string) error {
+	return nil
+}
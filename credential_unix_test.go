@@ -0,0 +1,69 @@
+//go:build unix
+
+package main
+
+import (
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"testing"
+)
+
+func TestLookupCredential(t *testing.T) {
+	me, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+	for _, name := range []string{me.Username, me.Uid} {
+		cred, err := lookupCredential(name)
+		if err != nil {
+			t.Fatalf("lookupCredential(%q): %v", name, err)
+		}
+		if cred.Uid != uint32(os.Getuid()) {
+			t.Errorf("lookupCredential(%q) uid = %d, want %d", name, cred.Uid, os.Getuid())
+		}
+	}
+	if _, err := lookupCredential("no-such-user-here"); err == nil {
+		t.Error("lookupCredential of an unknown user succeeded")
+	}
+}
+
+func TestRunAsUser(t *testing.T) {
+	srv := newTestServer(t)
+	if status, body := do(t, http.MethodPost, srv.URL+"/jobs", "application/json", `{"args": ["id", "-u"], "run_as_user": "nobody"}`); status != http.StatusForbidden {
+		t.Errorf("run_as_user without ALLOW_RUN_AS: %d %s", status, body)
+	}
+
+	t.Setenv("ALLOW_RUN_AS", "1")
+	if status, body := do(t, http.MethodPost, srv.URL+"/jobs", "application/json", `{"args": ["id", "-u"], "run_as_user": "no-such-user-here"}`); status != http.StatusBadRequest {
+		t.Errorf("run_as_user of an unknown user: %d %s", status, body)
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("running as another user needs root")
+	}
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip(err)
+	}
+	id := submit(t, srv.URL, `{"args": ["id", "-u"], "run_as_user": "nobody"}`)
+	if out := catOutput(t, srv.URL, id); out != nobody.Uid+"\n" {
+		t.Errorf("job ran as uid %q, want %s", out, nobody.Uid)
+	}
+
+	// The job directory belongs to the server, but the job can write its
+	// output files and progress. The user needs to reach it first.
+	for _, dir := range []string{filepath.Dir(getJobsDir()), getJobsDir()} {
+		if err := os.Chmod(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	id = submit(t, srv.URL, `{"args": ["sh", "-c", "echo 50% half way > \"$JOB_PROGRESS_FILE\" && echo done > report.txt"],
+		"run_as_user": "nobody", "output_files": ["report.txt"]}`)
+	if meta := waitFinished(t, srv.URL, id); meta.Status != "COMPLETED" || meta.Progress == nil || meta.Progress.Message != "half way" {
+		t.Errorf("job as nobody: %s %q, progress %+v", meta.Status, meta.Error, meta.Progress)
+	}
+	if status, body := do(t, http.MethodGet, srv.URL+"/jobs/"+id+"/artifacts/report.txt", "", ""); status != http.StatusOK || body != "done\n" {
+		t.Errorf("artifact written as nobody: %d %q", status, body)
+	}
+}
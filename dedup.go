@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// dedup maps the content hashes of unfinished jobs to their IDs, for
+// DEDUPLICATE_JOBS. The mutex is held from looking a hash up until the job
+// created with it has been indexed, so identical submissions racing each
+// other end up with a single job.
+var dedup = struct {
+	sync.Mutex
+	ids map[string]string
+}{ids: make(map[string]string)}
+
+// deduplicateJobs reports whether DEDUPLICATE_JOBS is set, in which case a
+// submission identical to a job that hasn't finished yet is answered with
+// that job instead of running the command again.
+func deduplicateJobs() bool {
+	return os.Getenv("DEDUPLICATE_JOBS") == "1"
+}
+
+// dedupEligible reports whether a request may be coalesced with an identical
+// one. Only plain submissions that are queued straight away qualify: uploaded
+// files aren't hashed, and held, delayed, dependent, batch, rerun and
+// scheduled jobs are meant to run on their own.
+func dedupEligible(req *jobRequest) bool {
+	return len(req.files) == 0 && req.IdempotencyKey == "" && !req.Hold && req.RunAt == nil &&
+		req.Delay == 0 && len(req.DependsOn) == 0 && req.StdinFromJob == "" &&
+		req.batchID == "" && req.rerunOf == "" && req.parentScheduleID == ""
+}
+
+// contentHash identifies a job for deduplication by the request as
+// submitted, the command line it resolved to and the SHA-256 digest of its
+// stdin input (nil without input).
+func contentHash(req *jobRequest, meta *JobMeta, inputDigest []byte) string {
+	h := sha256.New()
+	enc := json.NewEncoder(h)
+	enc.Encode(req)
+	enc.Encode(meta.Args)
+	h.Write(inputDigest)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func dedupIndexKey(ns, hash string) string {
+	return ns + "\x00" + hash
+}
+
+// duplicateJob returns the unfinished job in namespace ns with the given
+// content hash, or nil if there is none. The caller must hold dedup.
+func duplicateJob(ns, hash string) *JobMeta {
+	key := dedupIndexKey(ns, hash)
+	id, ok := dedup.ids[key]
+	if !ok {
+		return nil
+	}
+	meta, err := loadMeta(ns, id)
+	if err != nil || isTerminal(meta.Status) {
+		delete(dedup.ids, key)
+		return nil
+	}
+	return meta
+}
+
+// forgetContentHash drops a finished job from the index, so the next
+// identical submission runs the command again.
+func forgetContentHash(meta *JobMeta) {
+	if meta.ContentHash == "" {
+		return
+	}
+	dedup.Lock()
+	defer dedup.Unlock()
+	key := dedupIndexKey(meta.Namespace, meta.ContentHash)
+	if dedup.ids[key] == meta.ID {
+		delete(dedup.ids, key)
+	}
+}
+
+// loadContentHashes rebuilds the index from the stored unfinished jobs, so
+// deduplication carries on across restarts.
+func loadContentHashes() {
+	metas, _, err := store.List(jobFilter{AllNamespaces: true})
+	if err != nil {
+		slog.Warn("Failed to list jobs", "event", "store_error", "error", err)
+	}
+	dedup.Lock()
+	defer dedup.Unlock()
+	for _, meta := range metas {
+		if meta.ContentHash != "" && !isTerminal(meta.Status) {
+			dedup.ids[dedupIndexKey(meta.Namespace, meta.ContentHash)] = meta.ID
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestDeduplicateJobs(t *testing.T) {
+	t.Setenv("DEDUPLICATE_JOBS", "1")
+	srv := newTestServer(t)
+	// Every run of the command leaves a line in runs.
+	runs := filepath.Join(t.TempDir(), "runs")
+	query := url.Values{"args": {"sh", "-c", "echo run >> " + runs + "; sleep 0.3; cat"}}.Encode()
+
+	const clients = 5
+	ids := make([]string, clients)
+	var wg sync.WaitGroup
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := http.Post(srv.URL+"/jobs?"+query, "application/octet-stream", strings.NewReader("same input"))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			var links map[string]string
+			if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&links) != nil {
+				t.Errorf("submit: %d", resp.StatusCode)
+			}
+			ids[i] = links["id"]
+		}(i)
+	}
+	wg.Wait()
+	for _, id := range ids[1:] {
+		if id != ids[0] {
+			t.Fatalf("identical submissions got jobs %q", ids)
+		}
+	}
+	// Different input makes a different job.
+	other := submitRaw(t, srv.URL, query, "application/octet-stream", "other input")
+	if other == ids[0] {
+		t.Error("submission with different input was coalesced")
+	}
+	if got := catOutput(t, srv.URL, ids[0]); got != "same input" {
+		t.Errorf("output of coalesced job: %q", got)
+	}
+	waitFinished(t, srv.URL, other)
+	if data, _ := os.ReadFile(runs); strings.Count(string(data), "run\n") != 2 {
+		t.Errorf("command ran %d times, want once per distinct input", strings.Count(string(data), "run\n"))
+	}
+
+	// Once the job has finished, an identical submission runs again.
+	if again := submitRaw(t, srv.URL, query, "application/octet-stream", "same input"); again == ids[0] {
+		t.Error("submission identical to a finished job was coalesced")
+	}
+	// Held jobs are never coalesced.
+	held := submit(t, srv.URL, `{"args": ["true"], "hold": true}`)
+	if submit(t, srv.URL, `{"args": ["true"], "hold": true}`) == held {
+		t.Error("held submissions were coalesced")
+	}
+}
+
+func TestDeduplicateJobsOff(t *testing.T) {
+	srv := newTestServer(t)
+	body := `{"args": ["sleep", "0.2"]}`
+	if submit(t, srv.URL, body) == submit(t, srv.URL, body) {
+		t.Error("identical submissions coalesced without DEDUPLICATE_JOBS")
+	}
+}
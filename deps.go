@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// dependents tracks WAITING jobs by the IDs of the jobs they depend on, so a
+// job finishing can release or fail the jobs waiting for it.
+var dependents = struct {
+	sync.Mutex
+	byDep map[string][]jobRef
+}{byDep: make(map[string][]jobRef)}
+
+type jobRef struct {
+	namespace string
+	id        string
+}
+
+// waitForDependencies registers a WAITING job with the jobs it depends on and
+// then checks them, in that order, so a dependency finishing in between
+// isn't missed.
+func waitForDependencies(meta *JobMeta) {
+	dependents.Lock()
+	for _, dep := range meta.DependsOn {
+		dependents.byDep[dep] = append(dependents.byDep[dep], jobRef{meta.Namespace, meta.ID})
+	}
+	dependents.Unlock()
+	checkDependencies(meta.Namespace, meta.ID)
+}
+
+// dependencyFinished re-checks every job waiting for job id, which has just
+// finished or been deleted.
+func dependencyFinished(id string) {
+	dependents.Lock()
+	refs := dependents.byDep[id]
+	delete(dependents.byDep, id)
+	dependents.Unlock()
+	for _, ref := range refs {
+		checkDependencies(ref.namespace, ref.id)
+	}
+}
+
+// checkDependencies queues a WAITING job once all its dependencies have
+// COMPLETED, or fails it as soon as one of them ended any other way (or no
+// longer exists). Otherwise it keeps waiting.
+func checkDependencies(ns, id string) {
+	mu.Lock()
+	meta, err := loadMeta(ns, id)
+	if err != nil || meta.Status != "WAITING" {
+		mu.Unlock()
+		return
+	}
+	failure := ""
+	pending := false
+	for _, dep := range meta.DependsOn {
+		depMeta, err := loadMeta(ns, dep)
+		if err != nil {
+			failure = fmt.Sprintf("dependency %s no longer exists", dep)
+			break
+		}
+		if depMeta.Status == "COMPLETED" {
+			continue
+		}
+		if isTerminal(depMeta.Status) {
+			failure = fmt.Sprintf("dependency %s ended with status %s", dep, depMeta.Status)
+			break
+		}
+		pending = true
+	}
+	switch {
+	case failure != "":
+		meta.Status = "FAILED"
+		meta.Error = failure
+		meta.CompletedAt = time.Now()
+		saveMeta(meta)
+	case !pending && meta.StdinFromJob == "":
+		meta.Status = "IN_QUEUE"
+		saveMeta(meta)
+	}
+	mu.Unlock()
+
+	switch {
+	case failure != "":
+		slog.Info("Dependency failed", "event", "job_dependency_failed", "job_id", id, "error", failure)
+		waitingJobFailed(meta)
+	case !pending && meta.StdinFromJob != "":
+		pipeInput(meta)
+	case !pending:
+		slog.Debug("Dependencies completed", "event", "job_dependencies_met", "job_id", id)
+		notifyTransition(meta)
+		queue.Push(&queuedJob{meta: meta, inputFilePath: stagedInput(id)})
+	}
+}
+
+// waitingJobFailed finishes a WAITING job that has just been marked FAILED.
+func waitingJobFailed(meta *JobMeta) {
+	releaseInput(meta)
+	jobFinished(meta)
+	if webhookWanted(meta) {
+		go sendWebhook(meta)
+	}
+}
+
+// pipeInput queues a WAITING job with stdin_from_job whose dependencies have
+// all completed, after staging the stdout of the source job as its input. The
+// copy is made outside mu, into a file of its own, since another dependency
+// finishing at the same time may be doing the same.
+func pipeInput(meta *JobMeta) {
+	tmp, err := copySourceOutput(meta)
+
+	mu.Lock()
+	meta, lerr := loadMeta(meta.Namespace, meta.ID)
+	if lerr != nil || meta.Status != "WAITING" {
+		mu.Unlock()
+		if tmp != "" {
+			os.Remove(tmp)
+		}
+		return
+	}
+	if err == nil && tmp != "" {
+		err = os.Rename(tmp, inputPath(meta.ID))
+	}
+	if err != nil {
+		if tmp != "" {
+			os.Remove(tmp)
+		}
+		meta.Status = "FAILED"
+		meta.Error = fmt.Sprintf("reading stdout of job %s: %v", meta.StdinFromJob, err)
+		meta.CompletedAt = time.Now()
+		saveMeta(meta)
+		mu.Unlock()
+		slog.Warn("Failed to pipe job output", "event", "job_dependency_failed", "job_id", meta.ID, "error", meta.Error)
+		waitingJobFailed(meta)
+		return
+	}
+	meta.HasInput = tmp != ""
+	meta.Status = "IN_QUEUE"
+	saveMeta(meta)
+	mu.Unlock()
+
+	slog.Debug("Dependencies completed", "event", "job_dependencies_met", "job_id", meta.ID)
+	notifyTransition(meta)
+	queue.Push(&queuedJob{meta: meta, inputFilePath: stagedInput(meta.ID)})
+}
+
+// copySourceOutput copies the stdout of meta's stdin_from_job source to a new
+// file in the input directory and returns its path, or "" if the source
+// printed nothing.
+func copySourceOutput(meta *JobMeta) (string, error) {
+	out, err := openOutput(getJobDir(meta.Namespace, meta.StdinFromJob), "stdout")
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+	if out.Size() == 0 {
+		return "", nil
+	}
+	f, err := os.CreateTemp(getInputDir(), "pipe-"+meta.ID+"-*.tmp")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(f, out)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestDependencyChain(t *testing.T) {
+	srv := newTestServer(t)
+	a := submit(t, srv.URL, `{"args": ["sleep", "0.5"]}`)
+	b := submit(t, srv.URL, `{"args": ["echo", "b"], "depends_on": ["`+a+`"]}`)
+	c := submit(t, srv.URL, `{"args": ["echo", "c"], "depends_on": ["`+a+`", "`+b+`"]}`)
+	for _, id := range []string{b, c} {
+		if meta := getStatus(t, srv.URL, id); meta.Status != "WAITING" {
+			t.Errorf("dependent job %s while its dependency runs", meta.Status)
+		}
+	}
+	if out := catOutput(t, srv.URL, c); out != "c\n" {
+		t.Errorf("output of the last job: %q", out)
+	}
+	metaA, metaB, metaC := getStatus(t, srv.URL, a), getStatus(t, srv.URL, b), getStatus(t, srv.URL, c)
+	if metaB.StartedAt.Before(metaA.CompletedAt) || metaC.StartedAt.Before(metaB.CompletedAt) {
+		t.Error("a job started before its dependencies completed")
+	}
+}
+
+func TestDependencyFailurePropagates(t *testing.T) {
+	srv := newTestServer(t)
+	a := submit(t, srv.URL, `{"args": ["sh", "-c", "sleep 0.2; exit 1"]}`)
+	b := submit(t, srv.URL, `{"args": ["true"], "depends_on": ["`+a+`"]}`)
+	c := submit(t, srv.URL, `{"args": ["true"], "depends_on": ["`+b+`"]}`)
+	for dep, id := range map[string]string{a: b, b: c} {
+		meta := waitFinished(t, srv.URL, id)
+		if meta.Status != "FAILED" || !strings.Contains(meta.Error, "dependency "+dep+" ended with status FAILED") {
+			t.Errorf("job after a failed dependency: %s %q", meta.Status, meta.Error)
+		}
+		if !meta.StartedAt.IsZero() {
+			t.Error("job ran although its dependency failed")
+		}
+	}
+
+	if status, body := do(t, http.MethodPost, srv.URL+"/jobs", "application/json", `{"args": ["true"], "depends_on": ["not-a-job"]}`); status != http.StatusBadRequest {
+		t.Errorf("depends_on an invalid ID: %d %s", status, body)
+	}
+}
+
+func TestStdinFromJob(t *testing.T) {
+	srv := newTestServer(t)
+	source := submit(t, srv.URL, `{"args": ["sh", "-c", "sleep 0.3; printf 'b\\na\\nc\\n'"]}`)
+	sorted := submit(t, srv.URL, `{"args": ["sort"], "stdin_from_job": "`+source+`"}`)
+	if meta := getStatus(t, srv.URL, sorted); meta.Status != "WAITING" || !slices.Equal(meta.DependsOn, []string{source}) {
+		t.Errorf("job reading another's output: %s, depends on %q", meta.Status, meta.DependsOn)
+	}
+	if out := catOutput(t, srv.URL, sorted); out != "a\nb\nc\n" {
+		t.Errorf("output of the piped job: %q", out)
+	}
+
+	failed := submit(t, srv.URL, `{"args": ["sh", "-c", "echo partial; exit 3"]}`)
+	piped := submit(t, srv.URL, `{"args": ["cat"], "stdin_from_job": "`+failed+`"}`)
+	if meta := waitFinished(t, srv.URL, piped); meta.Status != "FAILED" || !meta.StartedAt.IsZero() {
+		t.Errorf("job reading the output of a failed job: %s %q", meta.Status, meta.Error)
+	}
+	if status, body := do(t, http.MethodPost, srv.URL+"/jobs", "application/json", `{"args": ["cat"], "stdin_from_job": "`+uuid.NewString()+`"}`); status != http.StatusBadRequest {
+		t.Errorf("stdin_from_job of a missing job: %d %s", status, body)
+	}
+}
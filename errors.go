@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// Error codes of the JSON error envelope. Clients should branch on these
+// rather than on the message, which is meant for people and may change.
+const (
+	codeBadRequest       = "bad_request"
+	codeInvalidJSON      = "invalid_json"
+	codeUnauthorized     = "unauthorized"
+	codeForbidden        = "forbidden"
+	codeNotFound         = "not_found"
+	codeMethodNotAllowed = "method_not_allowed"
+	codeNotAcceptable    = "not_acceptable"
+	codeConflict         = "conflict"
+	codeGone             = "gone"
+	codeTooLarge         = "payload_too_large"
+	codeUnprocessable    = "unprocessable"
+	codeRateLimited      = "rate_limited"
+	codeInternal         = "internal_error"
+	codeUnavailable      = "unavailable"
+)
+
+// statusCodes maps HTTP statuses to the error code used when nothing more
+// specific applies.
+var statusCodes = map[int]string{
+	http.StatusBadRequest:            codeBadRequest,
+	http.StatusUnauthorized:          codeUnauthorized,
+	http.StatusForbidden:             codeForbidden,
+	http.StatusNotFound:              codeNotFound,
+	http.StatusMethodNotAllowed:      codeMethodNotAllowed,
+	http.StatusNotAcceptable:         codeNotAcceptable,
+	http.StatusConflict:              codeConflict,
+	http.StatusGone:                  codeGone,
+	http.StatusRequestEntityTooLarge: codeTooLarge,
+	http.StatusUnprocessableEntity:   codeUnprocessable,
+	http.StatusTooManyRequests:       codeRateLimited,
+	http.StatusInternalServerError:   codeInternal,
+	http.StatusServiceUnavailable:    codeUnavailable,
+}
+
+// writeError replies with the JSON error envelope
+// {"error": {"code": ..., "message": ...}}. It is the JSON counterpart of
+// http.Error, and likewise leaves other headers to the caller.
+func writeError(w http.ResponseWriter, status int, code, msg string) {
+	h := w.Header()
+	// Drop headers set for a body that is no longer being sent, as
+	// http.Error does.
+	h.Del("Content-Length")
+	h.Del("Content-Encoding")
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	var body struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	body.Error.Code = code
+	body.Error.Message = msg
+	json.NewEncoder(w).Encode(body)
+}
+
+// httpError is a drop-in for http.Error that writes the JSON envelope with the
+// status's default code.
+func httpError(w http.ResponseWriter, msg string, status int) {
+	code, ok := statusCodes[status]
+	if !ok {
+		code = codeInternal
+		if status < 500 {
+			code = codeBadRequest
+		}
+	}
+	writeError(w, status, code, msg)
+}
+
+// writeRequestError reports err, typically from prepareJob or createJob, with
+// the status and code of its requestError, or as an internal error.
+func writeRequestError(w http.ResponseWriter, err error) {
+	var re *requestError
+	if errors.As(err, &re) && re.code != "" {
+		writeError(w, re.status, re.code, err.Error())
+		return
+	}
+	httpError(w, err.Error(), errorStatus(err))
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestErrorEnvelope(t *testing.T) {
+	t.Setenv("MAX_INPUT_BYTES", "100")
+	srv := newTestServer(t)
+	for _, tc := range []struct {
+		method, path, contentType, body string
+		status                          int
+		code                            string
+	}{
+		{http.MethodGet, "/jobs/" + uuid.NewString() + "/status", "", "", http.StatusNotFound, codeNotFound},
+		{http.MethodGet, "/jobs/not-a-uuid/status", "", "", http.StatusBadRequest, codeBadRequest},
+		{http.MethodPost, "/jobs", "application/json", `{"args": [`, http.StatusBadRequest, codeInvalidJSON},
+		{http.MethodPost, "/jobs", "application/json", `{"args": "echo"}`, http.StatusBadRequest, codeInvalidJSON},
+		{http.MethodPost, "/jobs?args=cat", "application/octet-stream", strings.Repeat("x", 200), http.StatusRequestEntityTooLarge, codeTooLarge},
+		{http.MethodGet, "/jobs?limit=-1", "", "", http.StatusBadRequest, codeBadRequest},
+		{http.MethodPatch, "/jobs", "", "", http.StatusMethodNotAllowed, codeMethodNotAllowed},
+	} {
+		req, _ := http.NewRequest(tc.method, srv.URL+tc.path, strings.NewReader(tc.body))
+		if tc.contentType != "" {
+			req.Header.Set("Content-Type", tc.contentType)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		var envelope map[string]map[string]string
+		if err := json.Unmarshal(data, &envelope); err != nil || len(envelope) != 1 {
+			t.Errorf("%s %s: body %q isn't an error envelope", tc.method, tc.path, data)
+			continue
+		}
+		if resp.StatusCode != tc.status || envelope["error"]["code"] != tc.code || envelope["error"]["message"] == "" {
+			t.Errorf("%s %s: %d %s, want %d with code %s", tc.method, tc.path, resp.StatusCode, data, tc.status, tc.code)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s %s: Content-Type %q", tc.method, tc.path, ct)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// jobLimit serializes the MAX_JOBS check with storing the new job, so
+// concurrent submissions can't together overshoot the limit.
+var jobLimit sync.Mutex
+
+// makeRoomForJob enforces MAX_JOBS before a new job is stored: if there are
+// already that many jobs, the ones that finished longest ago are deleted to
+// make room. Jobs that haven't finished, and dead-lettered jobs, are never
+// evicted; if they alone fill the limit, the submission is refused with 503.
+// The caller must hold jobLimit until the new job has been stored.
+func makeRoomForJob(ctx context.Context) error {
+	limit := envInt("MAX_JOBS", 0)
+	if limit <= 0 {
+		return nil
+	}
+	_, total := jobCounts.snapshot()
+	excess := total - limit + 1
+	if excess <= 0 {
+		return nil
+	}
+	var finished []*JobMeta
+	for _, meta := range loadAllMetas() {
+		if isTerminal(meta.Status) {
+			finished = append(finished, meta)
+		}
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i].CompletedAt.Before(finished[j].CompletedAt) })
+	for _, meta := range finished {
+		if excess == 0 {
+			break
+		}
+		if err := removeJob(meta.Namespace, meta.ID); err != nil {
+			slog.WarnContext(ctx, "Failed to evict job", "event", "evict_error", "job_id", meta.ID, "error", err)
+			continue
+		}
+		slog.InfoContext(ctx, "Evicted job to stay within MAX_JOBS", "event", "job_evicted", "job_id", meta.ID)
+		excess--
+	}
+	if excess > 0 {
+		return &requestError{status: http.StatusServiceUnavailable, msg: "Job limit reached (MAX_JOBS) and no finished jobs can be evicted"}
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestMaxJobsEviction(t *testing.T) {
+	t.Setenv("MAX_JOBS", "3")
+	srv := newTestServer(t)
+	exists := func(id string) bool {
+		status, _ := do(t, http.MethodGet, srv.URL+"/jobs/"+id+"/status", "", "")
+		return status == http.StatusOK
+	}
+	oldest := submit(t, srv.URL, `{"args": ["true"]}`)
+	waitFinished(t, srv.URL, oldest)
+	older := submit(t, srv.URL, `{"args": ["true"]}`)
+	waitFinished(t, srv.URL, older)
+	held := submit(t, srv.URL, `{"args": ["true"], "hold": true}`)
+
+	// The limit is reached, so the job that finished first makes room.
+	newest := submit(t, srv.URL, `{"args": ["true"]}`)
+	if exists(oldest) || !exists(older) || !exists(held) {
+		t.Errorf("after the 4th job: oldest kept %v, older kept %v, held kept %v", exists(oldest), exists(older), exists(held))
+	}
+	waitFinished(t, srv.URL, newest)
+	submit(t, srv.URL, `{"args": ["true"], "hold": true}`)
+	if exists(older) || !exists(newest) {
+		t.Errorf("after the 5th job: older kept %v, newest kept %v", exists(older), exists(newest))
+	}
+	submit(t, srv.URL, `{"args": ["true"], "hold": true}`)
+	if exists(newest) {
+		t.Error("the last finished job wasn't evicted")
+	}
+
+	// Only unfinished jobs are left, and those are never evicted.
+	if status, body := do(t, http.MethodPost, srv.URL+"/jobs", "application/json", `{"args": ["true"]}`); status != http.StatusServiceUnavailable {
+		t.Errorf("submit with only unfinished jobs at the limit: %d %s", status, body)
+	}
+	if !exists(held) {
+		t.Error("held job was evicted")
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+// scheduleExpiry arranges for a finished job with expires_after_seconds to be
+// deleted that long after it completed. Expiry is worked out from
+// CompletedAt, so jobs recovered after a restart keep their deadline, and
+// jobs already past it are deleted right away.
+func scheduleExpiry(meta *JobMeta) {
+	if meta.ExpiresAfter <= 0 || meta.CompletedAt.IsZero() {
+		return
+	}
+	ns, id := meta.Namespace, meta.ID
+	at := meta.CompletedAt.Add(time.Duration(meta.ExpiresAfter) * time.Second)
+	time.AfterFunc(time.Until(at), func() { expireJob(ns, id) })
+}
+
+// expireJob deletes a job whose expires_after_seconds has passed, like
+// removeJob. mu is held from the check to the delete, so the job can't change
+// state in between.
+func expireJob(ns, id string) {
+	mu.Lock()
+	meta, err := loadMeta(ns, id)
+	if err != nil || !isTerminal(meta.Status) {
+		mu.Unlock()
+		return
+	}
+	err = deleteStoredJob(ns, id)
+	mu.Unlock()
+	if err != nil {
+		slog.Warn("Failed to delete expired job", "event", "job_expire_error", "job_id", id, "error", err)
+		return
+	}
+	notifyFinished(id)
+	dependencyFinished(id)
+	slog.Info("Expired job deleted", "event", "job_expired", "job_id", id)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestJobExpiry(t *testing.T) {
+	srv := newTestServer(t)
+	expiring := submit(t, srv.URL, `{"args": ["true"], "expires_after_seconds": 1}`)
+	kept := submit(t, srv.URL, `{"args": ["true"]}`)
+	waitFinished(t, srv.URL, expiring)
+	// The metadata goes first, the directory right after it.
+	eventually(t, "job not deleted after it expired", func() bool {
+		status, _ := do(t, http.MethodGet, srv.URL+"/jobs/"+expiring+"/status", "", "")
+		_, err := os.Stat(getJobDir("", expiring))
+		return status == http.StatusNotFound && os.IsNotExist(err)
+	})
+	if meta := getStatus(t, srv.URL, kept); meta.Status != "COMPLETED" {
+		t.Errorf("job without expires_after_seconds: %s", meta.Status)
+	}
+}
+
+func TestJobExpiryAfterRestart(t *testing.T) {
+	srv := newTestServer(t)
+	// A job that expired while the server was down, and one that hasn't yet.
+	expired := &JobMeta{ID: uuid.NewString(), Args: []string{"true"}, Status: "COMPLETED", ExpiresAfter: 60, CompletedAt: time.Now().Add(-time.Hour)}
+	pending := &JobMeta{ID: uuid.NewString(), Args: []string{"true"}, Status: "COMPLETED", ExpiresAfter: 3600, CompletedAt: time.Now()}
+	for _, meta := range []*JobMeta{expired, pending} {
+		os.MkdirAll(getJobDir("", meta.ID), 0755)
+		if err := store.Create(meta); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recoverJobs()
+	eventually(t, "expired job not deleted on recovery", func() bool {
+		status, _ := do(t, http.MethodGet, srv.URL+"/jobs/"+expired.ID+"/status", "", "")
+		return status == http.StatusNotFound
+	})
+	if status, _ := do(t, http.MethodGet, srv.URL+"/jobs/"+pending.ID+"/status", "", ""); status != http.StatusOK {
+		t.Errorf("job that hasn't expired yet: %d", status)
+	}
+}
+
+func TestStaggeredRetention(t *testing.T) {
+	srv := newTestServer(t)
+	finished := func(age time.Duration) string {
+		meta := &JobMeta{ID: uuid.NewString(), Args: []string{"true"}, Status: "COMPLETED", CompletedAt: time.Now().Add(-age)}
+		dir := getJobDir("", meta.ID)
+		os.MkdirAll(dir, 0755)
+		os.WriteFile(filepath.Join(dir, "stdout.txt"), []byte("out\n"), 0644)
+		os.WriteFile(filepath.Join(dir, "stderr.txt"), nil, 0644)
+		if err := store.Create(meta); err != nil {
+			t.Fatal(err)
+		}
+		return meta.ID
+	}
+	old, aged, fresh := finished(3*time.Hour), finished(time.Hour), finished(time.Minute)
+	sweepJobs(2*time.Hour, 30*time.Minute)
+
+	if status, _ := do(t, http.MethodGet, srv.URL+"/jobs/"+old+"/status", "", ""); status != http.StatusNotFound {
+		t.Errorf("job past META_TTL: %d", status)
+	}
+	if meta := getStatus(t, srv.URL, aged); meta.OutputExpiredAt == nil {
+		t.Error("job past RESULT_TTL has no output_expired_at")
+	}
+	for _, name := range []string{"stdout.txt", "stderr.txt"} {
+		if _, err := os.Stat(filepath.Join(getJobDir("", aged), name)); !os.IsNotExist(err) {
+			t.Errorf("%s of job past RESULT_TTL: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(getJobDir("", aged), "meta.json")); err != nil {
+		t.Errorf("meta.json of job past RESULT_TTL: %v", err)
+	}
+	if status, body := do(t, http.MethodGet, srv.URL+"/jobs/"+aged+"/result", "", ""); status != http.StatusGone {
+		t.Errorf("result of job past RESULT_TTL: %d %s", status, body)
+	}
+	if status, body := do(t, http.MethodGet, srv.URL+"/jobs/"+fresh+"/result", "", ""); status != http.StatusOK || body != "out\n" {
+		t.Errorf("result of fresh job: %d %q", status, body)
+	}
+}
+
+func TestExpiryFailsDependents(t *testing.T) {
+	srv := newTestServer(t)
+	expiring := submit(t, srv.URL, `{"args": ["true"], "expires_after_seconds": 1}`)
+	waitFinished(t, srv.URL, expiring)
+	// The held dependency keeps the dependent waiting until the other one
+	// expires.
+	held := submit(t, srv.URL, `{"args": ["true"], "hold": true}`)
+	dependent := submit(t, srv.URL, fmt.Sprintf(`{"args": ["true"], "depends_on": [%q, %q]}`, expiring, held))
+	meta := waitFinished(t, srv.URL, dependent)
+	if meta.Status != "FAILED" || !strings.Contains(meta.Error, expiring) {
+		t.Errorf("dependent of an expired job: %s %q", meta.Status, meta.Error)
+	}
+}
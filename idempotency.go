@@ -0,0 +1,54 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+)
+
+// idempotency maps each namespace's idempotency keys to the job created with
+// them. The mutex is held from the last check of a key until the job created
+// with it is stored, so of several submissions racing with the same key only
+// one creates a job and the others return it. It isn't held while the input
+// is read, so a slow upload doesn't hold up other submissions.
+var idempotency = struct {
+	sync.Mutex
+	ids map[string]string
+}{ids: make(map[string]string)}
+
+const maxIdempotencyKeyLen = 255
+
+func idempotencyIndexKey(ns, key string) string {
+	return ns + "\x00" + key
+}
+
+// idempotentJob returns the job already created with key in namespace ns, or
+// nil if there is none (or it has since been deleted). The caller must hold
+// idempotency.
+func idempotentJob(ns, key string) *JobMeta {
+	id, ok := idempotency.ids[idempotencyIndexKey(ns, key)]
+	if !ok {
+		return nil
+	}
+	meta, err := loadMeta(ns, id)
+	if err != nil {
+		delete(idempotency.ids, idempotencyIndexKey(ns, key))
+		return nil
+	}
+	return meta
+}
+
+// loadIdempotencyKeys rebuilds the idempotency index from the stored jobs, so
+// keys are honored across restarts.
+func loadIdempotencyKeys() {
+	metas, _, err := store.List(jobFilter{AllNamespaces: true, DeadLetter: "include"})
+	if err != nil {
+		slog.Warn("Failed to list jobs", "event", "store_error", "error", err)
+	}
+	idempotency.Lock()
+	defer idempotency.Unlock()
+	for _, meta := range metas {
+		if meta.IdempotencyKey != "" {
+			idempotency.ids[idempotencyIndexKey(meta.Namespace, meta.IdempotencyKey)] = meta.ID
+		}
+	}
+}
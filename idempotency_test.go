@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyKeyDoesNotWaitForSlowUpload(t *testing.T) {
+	srv := newTestServer(t)
+
+	// A submission whose stdin is still being uploaded.
+	body, upload := io.Pipe()
+	defer upload.Close()
+	slow := make(chan string, 1)
+	go func() {
+		resp, err := http.Post(srv.URL+"/jobs", "application/json", body)
+		if err != nil {
+			t.Error(err)
+			slow <- ""
+			return
+		}
+		defer resp.Body.Close()
+		var links map[string]string
+		json.NewDecoder(resp.Body).Decode(&links)
+		slow <- links["id"]
+	}()
+	upload.Write([]byte(`{"args": ["cat"], "idempotency_key": "upload"}` + "\n"))
+	upload.Write([]byte("partial input"))
+
+	done := make(chan string, 1)
+	go func() {
+		resp, err := http.Post(srv.URL+"/jobs", "application/json", strings.NewReader(`{"args": ["true"], "idempotency_key": "other"}`))
+		if err != nil {
+			t.Error(err)
+			done <- ""
+			return
+		}
+		resp.Body.Close()
+		done <- resp.Status
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("submission with another key waited for the upload")
+	}
+
+	// A retry with the same key that gets in first creates the job; the
+	// original submission then returns it instead of creating another.
+	retry := submit(t, srv.URL, `{"args": ["cat"], "idempotency_key": "upload"}`)
+	upload.Close()
+	if id := <-slow; id != retry {
+		t.Errorf("original submission returned job %q, want %q", id, retry)
+	}
+	if _, total := jobCounts.snapshot(); total != 2 {
+		t.Errorf("%d jobs created, want 2", total)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// errIdleTimeout is the cancellation cause of a job that produced no output
+// for its idle_timeout_seconds.
+var errIdleTimeout = errors.New("idle timeout")
+
+// activityWriter records when anything was last written through it.
+type activityWriter struct {
+	w    io.Writer
+	last *atomic.Int64
+}
+
+func (a activityWriter) Write(p []byte) (int, error) {
+	a.last.Store(time.Now().UnixNano())
+	return a.w.Write(p)
+}
+
+// idleWatchdog tracks output activity of a running job and cancels it once
+// nothing has been written to stdout or stderr for idle.
+type idleWatchdog struct {
+	idle time.Duration
+	last atomic.Int64
+}
+
+func newIdleWatchdog(idle time.Duration) *idleWatchdog {
+	d := &idleWatchdog{idle: idle}
+	d.last.Store(time.Now().UnixNano())
+	return d
+}
+
+// Wrap returns a writer that resets the watchdog on every write to w.
+func (d *idleWatchdog) Wrap(w io.Writer) io.Writer {
+	return activityWriter{w: w, last: &d.last}
+}
+
+// Watch cancels the job with errIdleTimeout when it has been silent for too
+// long. It returns when ctx is done.
+func (d *idleWatchdog) Watch(ctx context.Context, cancel context.CancelCauseFunc) {
+	timer := time.NewTimer(d.idle)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			silent := time.Since(time.Unix(0, d.last.Load()))
+			if silent >= d.idle {
+				cancel(errIdleTimeout)
+				return
+			}
+			timer.Reset(d.idle - silent)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestIdleWatchdogResetsOnWrite(t *testing.T) {
+	d := newIdleWatchdog(200 * time.Millisecond)
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	go d.Watch(ctx, cancel)
+	w := d.Wrap(io.Discard)
+	for i := 0; i < 6; i++ {
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte("x"))
+	}
+	if ctx.Err() != nil {
+		t.Fatal("watchdog fired while output was being written")
+	}
+	select {
+	case <-ctx.Done():
+		if context.Cause(ctx) != errIdleTimeout {
+			t.Errorf("cause = %v", context.Cause(ctx))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watchdog didn't fire once output stopped")
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	srv := newTestServer(t)
+	start := time.Now()
+	id := submit(t, srv.URL, `{"args": ["sh", "-c", "echo started; sleep 30"], "idle_timeout_seconds": 1}`)
+	meta := waitFinished(t, srv.URL, id)
+	if meta.Status != "TIMEOUT" || meta.Error != "no output for 1 seconds" {
+		t.Errorf("silent job: %s %q", meta.Status, meta.Error)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("silent job stopped after %v", elapsed)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestInputBase64(t *testing.T) {
+	srv := newTestServer(t)
+	id := submit(t, srv.URL, `{"args": ["cat"], "input_base64": "aGVsbG8gd29ybGQK"}`)
+	waitFinished(t, srv.URL, id)
+	if status, body := do(t, http.MethodGet, srv.URL+"/jobs/"+id+"/result", "", ""); status != http.StatusOK || body != "hello world\n" {
+		t.Errorf("result: %d %q", status, body)
+	}
+	if status, body := do(t, http.MethodPost, srv.URL+"/jobs", "application/json", `{"args": ["cat"], "input_base64": "not base64!"}`); status != http.StatusBadRequest {
+		t.Errorf("invalid base64: %d %s", status, body)
+	}
+}
+
+func TestInputBase64SizeLimit(t *testing.T) {
+	newTestServer(t)
+	t.Setenv("MAX_INPUT_BYTES", "100")
+	encode := func(n int) string { return base64.StdEncoding.EncodeToString([]byte(strings.Repeat("x", n))) }
+
+	if _, err := decodeInputBase64(&jobRequest{InputBase64: encode(100)}); err != nil {
+		t.Errorf("input at the limit: %v", err)
+	}
+	_, err := decodeInputBase64(&jobRequest{InputBase64: encode(101)})
+	if errorStatus(err) != http.StatusRequestEntityTooLarge {
+		t.Errorf("input over the limit: %v", err)
+	}
+
+	// The limit holds while the input is staged as well.
+	path, err := stageInput("over", newBase64Input(encode(5000)))
+	if errorStatus(err) != http.StatusRequestEntityTooLarge || path != "" {
+		t.Errorf("staging input over the limit: %q, %v", path, err)
+	}
+	if _, err := os.Stat(inputPath("over")); !os.IsNotExist(err) {
+		t.Errorf("staged input left behind: %v", err)
+	}
+}
+
+// catOutput returns what job id received on stdin, as echoed by cat to its
+// stdout.
+func catOutput(t *testing.T, base, id string) string {
+	t.Helper()
+	if meta := waitFinished(t, base, id); meta.Status != "COMPLETED" {
+		t.Fatalf("job %s: %s %s", id, meta.Status, meta.Error)
+	}
+	status, body := do(t, http.MethodGet, base+"/jobs/"+id+"/result", "", "")
+	if status != http.StatusOK {
+		t.Fatalf("result of %s: %d %s", id, status, body)
+	}
+	return body
+}
+
+// submitRaw posts body as the raw input of a job described by query and
+// returns the job's ID.
+func submitRaw(t *testing.T, base, query, contentType, body string) string {
+	t.Helper()
+	status, resp := do(t, http.MethodPost, base+"/jobs?"+query, contentType, body)
+	if status != http.StatusOK {
+		t.Fatalf("submit: %d %s", status, resp)
+	}
+	var links map[string]string
+	if err := json.Unmarshal([]byte(resp), &links); err != nil {
+		t.Fatal(err)
+	}
+	return links["id"]
+}
+
+func TestRawBodyIsStdin(t *testing.T) {
+	srv := newTestServer(t)
+	// Bytes that would trip up anything parsing the body, including a JSON
+	// object of its own.
+	binary := "{\"args\": [\"rm\"]}\n\x00\xff\xfe\r\n\x1b"
+	id := submitRaw(t, srv.URL, "args=cat", "application/octet-stream", binary)
+	if got := catOutput(t, srv.URL, id); got != binary {
+		t.Errorf("stdin = %q, want %q", got, binary)
+	}
+	if !getStatus(t, srv.URL, id).HasInput {
+		t.Error("has_input not set")
+	}
+}
+
+func TestEmptyBodyIsNoStdin(t *testing.T) {
+	srv := newTestServer(t)
+	id := submitRaw(t, srv.URL, "args=cat", "application/octet-stream", "")
+	if got := catOutput(t, srv.URL, id); got != "" {
+		t.Errorf("stdin = %q, want none", got)
+	}
+	if getStatus(t, srv.URL, id).HasInput {
+		t.Error("has_input set for an empty body")
+	}
+}
+
+func TestJSONBody(t *testing.T) {
+	srv := newTestServer(t)
+	id := submit(t, srv.URL, `{"args": ["cat"]}`)
+	if got := catOutput(t, srv.URL, id); got != "" {
+		t.Errorf("JSON-only body: stdin = %q, want none", got)
+	}
+	if getStatus(t, srv.URL, id).HasInput {
+		t.Error("has_input set for a JSON-only body")
+	}
+
+	// Input after the JSON object, past what the decoder buffers, is stdin.
+	input := strings.Repeat("0123456789", 10000) + "\x00\xff"
+	id = submit(t, srv.URL, `{"args": ["cat"]}`+"\n"+input)
+	if got := catOutput(t, srv.URL, id); got != input {
+		t.Errorf("stdin after JSON: got %d bytes, want %d", len(got), len(input))
+	}
+}
+
+func TestRequestBodyLimit(t *testing.T) {
+	t.Setenv("MAX_INPUT_BYTES", "100")
+	srv := newTestServer(t)
+	big := strings.Repeat("x", 200)
+	for name, req := range map[string][2]string{
+		"raw body":         {"application/octet-stream", big},
+		"stdin after JSON": {"application/json", `{"args": ["cat"]}` + "\n" + big},
+		"JSON":             {"application/json", `{"args": ["cat", "` + big + `"]}`},
+		"batch":            {"application/json", `[{"args": ["cat", "` + big + `"]}]`},
+	} {
+		url := srv.URL + "/jobs?args=cat"
+		if name == "batch" {
+			url = srv.URL + "/jobs/batch"
+		}
+		if status, body := do(t, http.MethodPost, url, req[0], req[1]); status != http.StatusRequestEntityTooLarge {
+			t.Errorf("%s over the limit: %d %s", name, status, body)
+		}
+	}
+	if entries, _ := os.ReadDir(getInputDir()); len(entries) != 0 {
+		t.Errorf("inputs left behind: %v", entries)
+	}
+	if _, total := jobCounts.snapshot(); total != 0 {
+		t.Errorf("%d jobs created", total)
+	}
+	id := submitRaw(t, srv.URL, "args=cat", "application/octet-stream", strings.Repeat("x", 100))
+	if got := catOutput(t, srv.URL, id); len(got) != 100 {
+		t.Errorf("input at the limit: got %d bytes", len(got))
+	}
+}
+
+func TestKeepInput(t *testing.T) {
+	srv := newTestServer(t)
+	input := "line one\n\x00binary\n"
+	kept := submitRaw(t, srv.URL, "args=wc&args=-l&keep_input=true", "application/octet-stream", input)
+	dropped := submitRaw(t, srv.URL, "args=wc&args=-l", "application/octet-stream", input)
+	for _, id := range []string{kept, dropped} {
+		catOutput(t, srv.URL, id)
+	}
+	status, body := do(t, http.MethodGet, srv.URL+"/jobs/"+kept+"/input", "", "")
+	if status != http.StatusOK || body != input {
+		t.Errorf("kept input: %d %q", status, body)
+	}
+	if _, err := os.Stat(filepath.Join(getJobDir("", kept), "input.dat")); err != nil {
+		t.Errorf("kept input isn't in the job directory: %v", err)
+	}
+	if status, _ := do(t, http.MethodGet, srv.URL+"/jobs/"+dropped+"/input", "", ""); status != http.StatusNotFound {
+		t.Errorf("input of a job without keep_input: %d", status)
+	}
+	if _, err := os.Stat(inputPath(dropped)); !os.IsNotExist(err) {
+		t.Errorf("input of a job without keep_input wasn't deleted: %v", err)
+	}
+}
+
+func TestFormSubmission(t *testing.T) {
+	srv := newTestServer(t)
+	form := url.Values{"args": {"sh", "-c", "echo \"$0\"; cat", "a b&c=d"}, "mime_type": {"text/csv"}}
+	id := submitRaw(t, srv.URL, "priority=5", "application/x-www-form-urlencoded", form.Encode())
+	if out := catOutput(t, srv.URL, id); out != "a b&c=d\n" {
+		t.Errorf("form-encoded job printed %q, want its last arg and no stdin", out)
+	}
+	meta := getStatus(t, srv.URL, id)
+	if meta.MimeType != "text/csv" || meta.Priority != 5 || meta.HasInput {
+		t.Errorf("form-encoded job: mime type %q, priority %d, input %v", meta.MimeType, meta.Priority, meta.HasInput)
+	}
+	if status, body := do(t, http.MethodPost, srv.URL+"/jobs", "application/x-www-form-urlencoded", "mime_type=text/plain"); status != http.StatusBadRequest {
+		t.Errorf("form without args: %d %s", status, body)
+	}
+}
+
+func TestInputTmpDir(t *testing.T) {
+	srv := newTestServer(t)
+	if dir := getInputDir(); dir != filepath.Join(getJobsDir(), ".input") {
+		t.Errorf("default input directory %s", dir)
+	}
+
+	dir := filepath.Join(t.TempDir(), "inputs")
+	t.Setenv("INPUT_TMP_DIR", dir)
+	srv = newTestServer(t)
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		t.Fatalf("INPUT_TMP_DIR not created: %v", err)
+	}
+	held := submitRaw(t, srv.URL, "args=cat&hold=true&keep_input=true", "application/octet-stream", "staged")
+	if staged := inputPath(held); filepath.Dir(staged) != dir {
+		t.Errorf("input staged at %s, want it in %s", staged, dir)
+	} else if data, err := os.ReadFile(staged); err != nil || string(data) != "staged" {
+		t.Errorf("staged input: %q, %v", data, err)
+	}
+	if status, _ := do(t, http.MethodPut, srv.URL+"/jobs/"+held+"/release", "", ""); status != http.StatusOK {
+		t.Fatalf("release: %d", status)
+	}
+	if out := catOutput(t, srv.URL, held); out != "staged" {
+		t.Errorf("output: %q", out)
+	}
+	// The kept input is moved out of INPUT_TMP_DIR into the job directory.
+	if _, err := os.Stat(inputPath(held)); !os.IsNotExist(err) {
+		t.Errorf("staged input left behind: %v", err)
+	}
+	if status, body := do(t, http.MethodGet, srv.URL+"/jobs/"+held+"/input", "", ""); status != http.StatusOK || body != "staged" {
+		t.Errorf("kept input: %d %q", status, body)
+	}
+}
+
+func TestFailedUploadLeavesNoInput(t *testing.T) {
+	srv := newTestServer(t)
+	handler := newHandler(nil)
+	for name, body := range map[string]io.Reader{
+		"raw body":         io.MultiReader(strings.NewReader("partial input"), iotest.ErrReader(errors.New("connection reset"))),
+		"stdin after JSON": io.MultiReader(strings.NewReader(`{"args": ["cat"]}`+"\npartial"), iotest.ErrReader(errors.New("connection reset"))),
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/jobs?args=cat", body)
+		req.Header.Set("Content-Type", "application/octet-stream")
+		if name == "stdin after JSON" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code == http.StatusOK {
+			t.Errorf("%s: upload that failed midway was accepted: %s", name, rec.Body)
+		}
+	}
+	// A job rejected after its input was staged leaves nothing behind either.
+	source := submit(t, srv.URL, `{"args": ["true"]}`)
+	waitFinished(t, srv.URL, source)
+	if status, body := do(t, http.MethodPost, srv.URL+"/jobs?args=cat&stdin_from_job="+source, "application/octet-stream", "input"); status != http.StatusBadRequest {
+		t.Errorf("job with both input and stdin_from_job: %d %s", status, body)
+	}
+	if entries, _ := os.ReadDir(getInputDir()); len(entries) != 0 {
+		t.Errorf("inputs left behind: %v", entries)
+	}
+	if _, total := jobCounts.snapshot(); total != 1 {
+		t.Errorf("%d jobs created, want only the source job", total)
+	}
+}
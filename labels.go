@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// labelKeyPattern is the character set allowed in label keys. Keeping it free
+// of quotes lets keys be used in SQLite JSON paths as they are.
+var labelKeyPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_./-]{0,62}$`)
+
+const (
+	maxLabels        = 32
+	maxLabelValueLen = 255
+)
+
+// checkLabels validates the labels of a job request.
+func checkLabels(labels map[string]string) error {
+	if len(labels) > maxLabels {
+		return badRequest("At most %d labels are allowed", maxLabels)
+	}
+	for k, v := range labels {
+		if !labelKeyPattern.MatchString(k) {
+			return badRequest("Invalid label key %q", k)
+		}
+		if len(v) > maxLabelValueLen {
+			return badRequest("Value of label %q is longer than %d bytes", k, maxLabelValueLen)
+		}
+	}
+	return nil
+}
+
+// parseLabels turns "key=value" pairs, as given in form fields and ?label=
+// filters, into a map.
+func parseLabels(pairs []string) (map[string]string, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	labels := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("Invalid label %q: expected key=value", pair)
+		}
+		labels[k] = v
+	}
+	return labels, nil
+}
+
+// hasLabels reports whether meta carries every label in want.
+func hasLabels(meta *JobMeta, want map[string]string) bool {
+	for k, v := range want {
+		if got, ok := meta.Labels[k]; !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
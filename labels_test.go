@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestLabelFilters(t *testing.T) {
+	forEachStore(t, func(t *testing.T, base string) {
+		names := map[string]string{}
+		for name, labels := range map[string]string{
+			"a": `{"pipeline": "nightly", "team": "data"}`,
+			"b": `{"pipeline": "nightly", "team": "web"}`,
+			"c": `{"pipeline": "hourly", "team": "data"}`,
+			"d": `{}`,
+		} {
+			names[submit(t, base, `{"args": ["true"], "labels": `+labels+`}`)] = name
+		}
+		list := func(filters ...string) string {
+			t.Helper()
+			q := url.Values{"label": filters}
+			status, body := do(t, http.MethodGet, base+"/jobs?"+q.Encode(), "", "")
+			if status != http.StatusOK {
+				t.Fatalf("list with %q: %d %s", filters, status, body)
+			}
+			var resp struct{ Jobs []jobSummary }
+			if err := json.Unmarshal([]byte(body), &resp); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, job := range resp.Jobs {
+				got = append(got, names[job.ID])
+			}
+			sort.Strings(got)
+			return strings.Join(got, " ")
+		}
+		for _, tc := range []struct {
+			filters []string
+			want    string
+		}{
+			{[]string{"pipeline=nightly"}, "a b"},
+			{[]string{"team=data"}, "a c"},
+			{[]string{"pipeline=nightly", "team=data"}, "a"},
+			{[]string{"pipeline=weekly"}, ""},
+			{[]string{"pipeline="}, ""},
+		} {
+			if got := list(tc.filters...); got != tc.want {
+				t.Errorf("jobs with labels %q: %q, want %q", tc.filters, got, tc.want)
+			}
+		}
+		if status, _ := do(t, http.MethodGet, base+"/jobs?label=pipeline", "", ""); status != http.StatusBadRequest {
+			t.Errorf("filter without a value: %d", status)
+		}
+		if status, body := do(t, http.MethodPost, base+"/jobs", "application/json", `{"args": ["true"], "labels": {"bad key": "x"}}`); status != http.StatusBadRequest {
+			t.Errorf("invalid label key: %d %s", status, body)
+		}
+	})
+}
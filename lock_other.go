@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// lockFile always succeeds where flock isn't available; the PID file is still
+// written but doesn't stop a second server from starting.
+func lockFile(f *os.File) (bool, error) { return true, nil }
+
+func unlockFile(f *os.File) error { return nil }
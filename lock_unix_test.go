@@ -0,0 +1,41 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPIDFile(t *testing.T) {
+	t.Setenv("JOBS_DIR", t.TempDir())
+	f, err := acquirePIDFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(getJobsDir(), "server.pid")
+	if data, _ := os.ReadFile(path); string(data) != fmt.Sprintf("%d\n", os.Getpid()) {
+		t.Errorf("PID file holds %q", data)
+	}
+
+	// A second server on the same jobs directory is refused.
+	if g, err := acquirePIDFile(); err == nil {
+		releasePIDFile(g)
+		t.Fatal("second server got the PID file")
+	} else if !strings.Contains(err.Error(), fmt.Sprint(os.Getpid())) {
+		t.Errorf("error doesn't name the running server: %v", err)
+	}
+
+	releasePIDFile(f)
+	if data, _ := os.ReadFile(path); len(data) != 0 {
+		t.Errorf("released PID file holds %q", data)
+	}
+	g, err := acquirePIDFile()
+	if err != nil {
+		t.Fatalf("PID file not available after release: %v", err)
+	}
+	releasePIDFile(g)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// compressLogs reports whether COMPRESS_LOGS is set, in which case the
+// stdout and stderr of finished jobs are stored gzip-compressed.
+func compressLogs() bool {
+	return os.Getenv("COMPRESS_LOGS") == "1"
+}
+
+// compressOutputs replaces the stdout and stderr of a finished job in dir,
+// including rotated segments, with gzip-compressed copies named <file>.gz.
+// Outputs are written uncompressed while the job runs, so they can be
+// followed live, and compressed once they are complete. Empty files are left
+// as they are.
+func compressOutputs(jobID, dir string) {
+	for _, name := range []string{"stdout", "stderr"} {
+		for _, path := range append(rotatedSegments(dir, name), filepath.Join(dir, name+".txt")) {
+			if err := compressFile(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				slog.Warn("Failed to compress job output", "event", "job_output_error", "job_id", jobID, "file", filepath.Base(path), "error", err)
+			}
+		}
+	}
+}
+
+// compressFile writes path.gz and then removes path. The compressed file is
+// written under a temporary name and renamed into place, so readers always
+// find one of the two complete, and it keeps the modification time of the
+// original.
+func compressFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil || info.Size() == 0 {
+		return err
+	}
+	tmp := path + ".gz.tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	_, err = io.Copy(gz, in)
+	if cerr := gz.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chtimes(tmp, info.ModTime(), info.ModTime())
+	}
+	if err == nil {
+		err = os.Rename(tmp, path+".gz")
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(path)
+}
+
+// gzipWindow is how much of the output just decompressed a gzipReaderAt keeps.
+// It covers the backward reads of a tail, which then don't restart the
+// decompression.
+const gzipWindow = 256 << 10
+
+// gzipReaderAt reads the decompressed content of a gzip file at any offset,
+// without writing it out anywhere. Reads decompress forward from where the
+// last one ended; only a read before that, and before the bytes kept in its
+// window, starts over from the beginning of the file.
+type gzipReaderAt struct {
+	mu     sync.Mutex
+	f      *os.File
+	zr     *gzip.Reader
+	pos    int64
+	window []byte
+}
+
+// openGzip opens the gzip file path for reading at offsets and returns it
+// with its decompressed size and modification time.
+func openGzip(path string) (*gzipReaderAt, int64, time.Time, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, time.Time{}, err
+	}
+	g := &gzipReaderAt{f: f}
+	info, err := f.Stat()
+	if err == nil {
+		err = g.rewind()
+	}
+	var size int64
+	if err == nil {
+		size, err = gzipSize(f, info.Size())
+	}
+	if err != nil {
+		f.Close()
+		return nil, 0, time.Time{}, fmt.Errorf("%s: %w", filepath.Base(path), err)
+	}
+	return g, size, info.ModTime(), nil
+}
+
+// gzipSize returns the decompressed size of the gzip file f, which is size
+// bytes long. The gzip trailer holds it modulo 4 GiB, which is exact for a
+// file too small to decompress to more (deflate expands by at most 1032:1);
+// a larger file is decompressed once to count it.
+func gzipSize(f *os.File, size int64) (int64, error) {
+	if size < 4 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if size < (1<<32)/1032 {
+		var trailer [4]byte
+		if _, err := f.ReadAt(trailer[:], size-4); err != nil {
+			return 0, err
+		}
+		return int64(binary.LittleEndian.Uint32(trailer[:])), nil
+	}
+	zr, err := gzip.NewReader(io.NewSectionReader(f, 0, size))
+	if err != nil {
+		return 0, err
+	}
+	return io.Copy(io.Discard, zr)
+}
+
+func (g *gzipReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	read := 0
+	if start := g.pos - int64(len(g.window)); off >= start && off < g.pos {
+		n := copy(p, g.window[off-start:])
+		read, off, p = read+n, off+int64(n), p[n:]
+	}
+	if len(p) == 0 {
+		return read, nil
+	}
+	if off < g.pos {
+		if err := g.rewind(); err != nil {
+			return read, err
+		}
+	}
+	var scratch [32 << 10]byte
+	for g.pos < off {
+		if _, err := g.read(scratch[:min(int64(len(scratch)), off-g.pos)]); err != nil {
+			return read, err
+		}
+	}
+	n, err := g.read(p)
+	return read + n, err
+}
+
+// read fills p from the decompressor, keeping what it read in the window.
+func (g *gzipReaderAt) read(p []byte) (int, error) {
+	n, err := io.ReadFull(g.zr, p)
+	g.pos += int64(n)
+	b := p[:n]
+	if len(b) >= gzipWindow {
+		g.window = append(g.window[:0], b[len(b)-gzipWindow:]...)
+	} else {
+		if over := len(g.window) + len(b) - gzipWindow; over > 0 {
+			g.window = g.window[:copy(g.window, g.window[over:])]
+		}
+		g.window = append(g.window, b...)
+	}
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// rewind starts decompressing the file over from its beginning.
+func (g *gzipReaderAt) rewind() error {
+	if _, err := g.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	var err error
+	if g.zr == nil {
+		g.zr, err = gzip.NewReader(g.f)
+	} else {
+		err = g.zr.Reset(g.f)
+	}
+	g.pos = 0
+	g.window = g.window[:0]
+	return err
+}
+
+func (g *gzipReaderAt) Close() error {
+	return g.f.Close()
+}
+
+// compressedOutput returns the path of output name of the job in dir if it is
+// stored as a single compressed file, which can be sent to clients as it is,
+// or "" otherwise.
+func compressedOutput(dir, name string) string {
+	if len(rotatedSegments(dir, name)) > 0 {
+		return ""
+	}
+	if _, err := os.Stat(filepath.Join(dir, name+".txt")); err == nil {
+		return ""
+	}
+	path := filepath.Join(dir, name+".txt.gz")
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
+
+// serveGzipFile serves the gzip file path as the compressed representation
+// of its content, for a client that accepts gzip, with the same caching
+// headers as serveContent.
+func serveGzipFile(w http.ResponseWriter, r *http.Request, path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		httpError(w, "File not available", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		httpError(w, "File not available", http.StatusNotFound)
+		return
+	}
+	w.Header().Add("Vary", "Accept-Encoding")
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	etag := fmt.Sprintf(`"%x-%x-gzip"`, info.Size(), info.ModTime().UnixNano())
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+	if notModified(r, etag, info.ModTime()) {
+		w.Header().Del("Content-Type")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+	io.Copy(w, f)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeCompressedOutput writes content as the compressed stdout of a job in
+// a new directory and returns the directory.
+func writeCompressedOutput(t *testing.T, content []byte) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "stdout.txt"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	compressOutputs("test", dir)
+	if _, err := os.Stat(filepath.Join(dir, "stdout.txt.gz")); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestCompressedOutputReadsAtOffsets(t *testing.T) {
+	var b bytes.Buffer
+	for i := 0; b.Len() < 3*gzipWindow; i++ {
+		fmt.Fprintf(&b, "line %d\n", i)
+	}
+	content := b.Bytes()
+	out, err := openOutput(writeCompressedOutput(t, content), "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	if out.Size() != int64(len(content)) {
+		t.Fatalf("Size() = %d, want %d", out.Size(), len(content))
+	}
+
+	// Forward, within the window, backward past it, and up to the end.
+	size := int64(len(content))
+	for _, off := range []int64{0, 100, size / 2, size/2 - 10, 10, size - 50, size - 50 - gzipWindow/2, 5} {
+		p := make([]byte, 100)
+		n, err := out.ReadAt(p, off)
+		want := content[off:min(off+100, size)]
+		if !bytes.Equal(p[:n], want) || (n < 100 && err != io.EOF) {
+			t.Errorf("ReadAt(%d) = %q, %v, want %q", off, p[:n], err, want)
+		}
+	}
+
+	start, err := lastLinesOffset(out, out.Size(), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	if got, want := string(content[start:]), strings.Join(lines[len(lines)-3:], "\n")+"\n"; got != want {
+		t.Errorf("last 3 lines = %q, want %q", got, want)
+	}
+}
+
+func TestCompressedOutputWritesNoTempFiles(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	dir := writeCompressedOutput(t, []byte("hello\nworld\n"))
+	for i := 0; i < 3; i++ {
+		out, err := openOutput(dir, "stdout")
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(out)
+		out.Close()
+		if string(data) != "hello\nworld\n" {
+			t.Fatalf("read %q", data)
+		}
+	}
+	if entries, _ := os.ReadDir(tmp); len(entries) != 0 {
+		t.Errorf("reading left files in TMPDIR: %v", entries)
+	}
+}
+
+func TestCompressedOutputIsServed(t *testing.T) {
+	t.Setenv("COMPRESS_LOGS", "1")
+	srv := newTestServer(t)
+	id := submit(t, srv.URL, `{"args": ["sh", "-c", "seq 1 5000; seq 1 3 >&2"]}`)
+	waitFinished(t, srv.URL, id)
+	if _, err := os.Stat(filepath.Join(getJobDir("", id), "stdout.txt.gz")); err != nil {
+		t.Fatal(err)
+	}
+	// The default transport asks for gzip and decodes it itself; asking for
+	// identity gets the decompressed content.
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/jobs/"+id+"/result/tail?bytes=10", nil)
+	req.Header.Set("Accept-Encoding", "identity")
+	if status, body := send(t, req); status != http.StatusOK || body != "4999\n5000\n" {
+		t.Errorf("result tail: %d %q", status, body)
+	}
+	req, _ = http.NewRequest(http.MethodGet, srv.URL+"/jobs/"+id+"/log?lines=2", nil)
+	req.Header.Set("Accept-Encoding", "identity")
+	if status, body := send(t, req); status != http.StatusOK || body != "2\n3\n" {
+		t.Errorf("log lines: %d %q", status, body)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// createOutput creates the file a job's stdout or stderr (name) is written
+// to, <name>.txt in dir, removing segments left over from an earlier attempt.
+// With LOG_ROTATE_BYTES set, the file is rotated each time it reaches that
+// size: it is renamed to <name>.1.txt, <name>.2.txt, ... and a fresh
+// <name>.txt is started, so the oldest output is in the lowest segment.
+func createOutput(dir, name string) (io.WriteCloser, error) {
+	for _, seg := range rotatedSegments(dir, name) {
+		os.Remove(seg)
+		os.Remove(seg + ".gz")
+	}
+	os.Remove(filepath.Join(dir, name+".txt.gz"))
+	f, err := os.Create(filepath.Join(dir, name+".txt"))
+	if err != nil {
+		return nil, err
+	}
+	limit := int64(envInt("LOG_ROTATE_BYTES", 0))
+	if limit <= 0 {
+		// A plain file lets exec hand the descriptor straight to the
+		// command instead of copying through a pipe.
+		return f, nil
+	}
+	return &rotatingFile{dir: dir, name: name, limit: limit, f: f}, nil
+}
+
+// rotatingFile is the writer returned by createOutput when rotation is on.
+// Each is written from a single goroutine.
+type rotatingFile struct {
+	dir, name string
+	limit     int64
+	f         *os.File
+	size      int64
+	segments  int
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if r.size >= r.limit {
+			if err := r.rotate(); err != nil {
+				return written, err
+			}
+		}
+		chunk := p[:min(int64(len(p)), r.limit-r.size)]
+		n, err := r.f.Write(chunk)
+		written += n
+		r.size += int64(n)
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	r.segments++
+	path := filepath.Join(r.dir, r.name+".txt")
+	if err := os.Rename(path, filepath.Join(r.dir, fmt.Sprintf("%s.%d.txt", r.name, r.segments))); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	r.f, r.size = f, 0
+	return nil
+}
+
+func (r *rotatingFile) Close() error {
+	return r.f.Close()
+}
+
+// rotatedSegments returns the paths of the rotated segments of output name in
+// dir, oldest first. A segment compressed by COMPRESS_LOGS is listed under
+// the path it had before, without .gz.
+func rotatedSegments(dir, name string) []string {
+	matches, _ := filepath.Glob(filepath.Join(dir, name+".*.txt*"))
+	type segment struct {
+		n    int
+		path string
+	}
+	var segs []segment
+	seen := make(map[int]bool)
+	for _, m := range matches {
+		m = strings.TrimSuffix(m, ".gz")
+		n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(m), name+"."), ".txt"))
+		if err == nil && n > 0 && strings.HasSuffix(m, ".txt") && !seen[n] {
+			seen[n] = true
+			segs = append(segs, segment{n, m})
+		}
+	}
+	sort.Slice(segs, func(i, j int) bool { return segs[i].n < segs[j].n })
+	paths := make([]string, len(segs))
+	for i, s := range segs {
+		paths[i] = s.path
+	}
+	return paths
+}
+
+// jobOutput is a job's stdout or stderr read back as one stream, with any
+// rotated segments followed by the current file.
+type jobOutput struct {
+	*io.SectionReader
+	files   []io.Closer
+	modTime time.Time
+}
+
+// openOutput opens output name of the job in dir. It fails with an error
+// wrapping os.ErrNotExist if the job has no such output.
+func openOutput(dir, name string) (*jobOutput, error) {
+	paths := append(rotatedSegments(dir, name), filepath.Join(dir, name+".txt"))
+	out := &jobOutput{}
+	ra := &multiReaderAt{}
+	for _, p := range paths {
+		f, size, modTime, err := openSegment(p)
+		if err != nil {
+			// The current file is briefly missing while it is rotated.
+			if errors.Is(err, os.ErrNotExist) && len(out.files) > 0 {
+				continue
+			}
+			out.Close()
+			return nil, err
+		}
+		out.files = append(out.files, f)
+		ra.add(f, size)
+		if modTime.After(out.modTime) {
+			out.modTime = modTime
+		}
+	}
+	out.SectionReader = io.NewSectionReader(ra, 0, ra.size)
+	return out, nil
+}
+
+// ModTime returns when the output was last written to.
+func (o *jobOutput) ModTime() time.Time {
+	return o.modTime
+}
+
+// segmentFile is an open file of an output, compressed or not.
+type segmentFile interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// openSegment opens file path of an output, or path.gz if only that exists,
+// and returns it with the size of its content and when it was last written
+// to.
+func openSegment(path string) (segmentFile, int64, time.Time, error) {
+	f, err := os.Open(path)
+	if err == nil {
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, 0, time.Time{}, err
+		}
+		return f, info.Size(), info.ModTime(), nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, 0, time.Time{}, err
+	}
+	gz, size, modTime, gzErr := openGzip(path + ".gz")
+	if gzErr != nil {
+		if errors.Is(gzErr, os.ErrNotExist) {
+			// Report the output itself as missing.
+			return nil, 0, time.Time{}, err
+		}
+		return nil, 0, time.Time{}, gzErr
+	}
+	return gz, size, modTime, nil
+}
+
+func (o *jobOutput) Close() error {
+	for _, f := range o.files {
+		f.Close()
+	}
+	return nil
+}
+
+// multiReaderAt reads a sequence of files as if they were concatenated.
+type multiReaderAt struct {
+	parts  []io.ReaderAt
+	starts []int64
+	size   int64
+}
+
+func (m *multiReaderAt) add(r io.ReaderAt, size int64) {
+	m.parts = append(m.parts, r)
+	m.starts = append(m.starts, m.size)
+	m.size += size
+}
+
+func (m *multiReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	read := 0
+	for i := 0; i < len(m.parts) && len(p) > 0; i++ {
+		end := m.size
+		if i+1 < len(m.parts) {
+			end = m.starts[i+1]
+		}
+		if off >= end {
+			continue
+		}
+		want := min(int64(len(p)), end-off)
+		n, err := m.parts[i].ReadAt(p[:want], off-m.starts[i])
+		read += n
+		off += int64(n)
+		p = p[n:]
+		if int64(n) < want {
+			if err == nil {
+				err = io.EOF
+			}
+			return read, err
+		}
+	}
+	if len(p) > 0 {
+		return read, io.EOF
+	}
+	return read, nil
+}
+
+// serveOutput serves output name of the job in dir with serveFile's caching
+// and compression, reassembled from its rotated segments. An output stored
+// compressed by COMPRESS_LOGS goes out as it is to clients accepting gzip.
+// notFound is the message for a job without that output.
+func serveOutput(w http.ResponseWriter, r *http.Request, dir, name, notFound string) {
+	if gz := compressedOutput(dir, name); gz != "" && acceptsGzip(r) && r.Header.Get("Range") == "" {
+		serveGzipFile(w, r, gz)
+		return
+	}
+	out, err := openOutput(dir, name)
+	if err != nil {
+		httpError(w, notFound, http.StatusNotFound)
+		return
+	}
+	defer out.Close()
+	serveContent(w, r, name+".txt", out.Size(), out.ModTime(), out)
+}
+
+// nopWriteCloser stands in for an output file that couldn't be created.
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRotatedOutput(t *testing.T) {
+	t.Setenv("LOG_ROTATE_BYTES", "100")
+	dir := t.TempDir()
+	w, err := createOutput(dir, "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var content strings.Builder
+	for i := 0; content.Len() < 250; i++ {
+		chunk := strings.Repeat(string(rune('a'+i%26)), 1+i*7%40)
+		content.WriteString(chunk)
+		if _, err := io.WriteString(w, chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+	want := content.String()
+
+	segs := rotatedSegments(dir, "stdout")
+	if len(segs) != (len(want)-1)/100 || filepath.Base(segs[0]) != "stdout.1.txt" {
+		t.Fatalf("segments %q for %d bytes", segs, len(want))
+	}
+	for _, seg := range segs {
+		if info, err := os.Stat(seg); err != nil || info.Size() != 100 {
+			t.Errorf("segment %s: %v", seg, err)
+		}
+	}
+	out, err := openOutput(dir, "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	if got, _ := io.ReadAll(out); string(got) != want {
+		t.Errorf("reassembled output %q, want %q", got, want)
+	}
+	buf := make([]byte, 20)
+	if _, err := out.ReadAt(buf, 90); err != nil || string(buf) != want[90:110] {
+		t.Errorf("read across segments: %q, %v", buf, err)
+	}
+
+	// A new attempt starts from scratch.
+	w, err = createOutput(dir, "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if segs := rotatedSegments(dir, "stdout"); len(segs) != 0 {
+		t.Errorf("segments %q left from an earlier attempt", segs)
+	}
+}
+
+func TestRotatedOutputIsServed(t *testing.T) {
+	t.Setenv("LOG_ROTATE_BYTES", "1000")
+	srv := newTestServer(t)
+	id := submit(t, srv.URL, `{"args": ["seq", "1000"]}`)
+	waitFinished(t, srv.URL, id)
+	if segs := rotatedSegments(getJobDir("", id), "stdout"); len(segs) != 3 {
+		t.Errorf("output of %d bytes rotated into segments %q", len(seq(1000)), segs)
+	}
+	if status, body := do(t, http.MethodGet, srv.URL+"/jobs/"+id+"/result", "", ""); status != http.StatusOK || body != seq(1000) {
+		t.Errorf("result: %d, %d bytes", status, len(body))
+	}
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/jobs/"+id+"/result", nil)
+	req.Header.Set("Range", "bytes=995-1004")
+	if status, body := send(t, req); status != http.StatusPartialContent || body != seq(1000)[995:1005] {
+		t.Errorf("range across segments: %d %q", status, body)
+	}
+}
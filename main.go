@@ -1,382 +1,3331 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"regexp"
+	"runtime/debug"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 type JobMeta struct {
-	ID          string    `json:"id"`
-	Args        []string  `json:"args"`
-	MimeType    string    `json:"mime_type,omitempty"`
-	Webhook     string    `json:"webhook,omitempty"`
-	Status      string    `json:"status"`
-	PID         int       `json:"pid,omitempty"`
-	EnqueuedAt  time.Time `json:"enqueued_at"`
-	StartedAt   time.Time `json:"started_at,omitempty"`
-	CompletedAt time.Time `json:"completed_at,omitempty"`
-	StatusURL   string    `json:"status_url,omitempty"`
-	ResultURL   string    `json:"result_url,omitempty"`
-	LogURL      string    `json:"log_url,omitempty"`
+	ID               string            `json:"id"`
+	Namespace        string            `json:"namespace,omitempty"`
+	Labels           map[string]string `json:"labels,omitempty"`
+	Args             []string          `json:"args"`
+	Template         string            `json:"template,omitempty"`
+	MimeType         string            `json:"mime_type,omitempty"`
+	Webhook          string            `json:"webhook,omitempty"`
+	Timeout          int               `json:"timeout_seconds,omitempty"`
+	IdleTimeout      int               `json:"idle_timeout_seconds,omitempty"`
+	MaxOutputBytes   int64             `json:"max_output_bytes,omitempty"`
+	IdempotencyKey   string            `json:"idempotency_key,omitempty"`
+	RunAsUser        string            `json:"run_as_user,omitempty"`
+	Nice             int               `json:"nice,omitempty"`
+	MemoryLimitMB    int               `json:"memory_limit_mb,omitempty"`
+	Weight           int               `json:"weight,omitempty"`
+	HasInput         bool              `json:"has_input,omitempty"`
+	KeepInput        bool              `json:"keep_input,omitempty"`
+	ExpiresAfter     int               `json:"expires_after_seconds,omitempty"`
+	RerunOf          string            `json:"rerun_of,omitempty"`
+	MaxRetries       int               `json:"max_retries,omitempty"`
+	Priority         int               `json:"priority,omitempty"`
+	RunAt            *time.Time        `json:"run_at,omitempty"`
+	EnvKeys          []string          `json:"env_keys,omitempty"`
+	Cwd              string            `json:"cwd,omitempty"`
+	Files            []string          `json:"files,omitempty"`
+	OutputFiles      []string          `json:"output_files,omitempty"`
+	Artifacts        []string          `json:"artifacts,omitempty"`
+	ParentScheduleID string            `json:"parent_schedule_id,omitempty"`
+	BatchID          string            `json:"batch_id,omitempty"`
+	DependsOn        []string          `json:"depends_on,omitempty"`
+	StdinFromJob     string            `json:"stdin_from_job,omitempty"`
+	WebhookEvents    []string          `json:"webhook_events,omitempty"`
+	WebhookMethod    string            `json:"webhook_method,omitempty"`
+	WebhookHeaders   []string          `json:"webhook_header_keys,omitempty"`
+	Attempt          int               `json:"attempt"`
+	Status           string            `json:"status"`
+	PID              int               `json:"pid,omitempty"`
+	EnqueuedAt       time.Time         `json:"enqueued_at"`
+	StartedAt        time.Time         `json:"started_at,omitempty"`
+	CompletedAt      time.Time         `json:"completed_at,omitempty"`
+	ExitCode         *int              `json:"exit_code,omitempty"`
+	CPUUserMs        int64             `json:"cpu_user_ms,omitempty"`
+	CPUSystemMs      int64             `json:"cpu_system_ms,omitempty"`
+	MaxRSSKB         int64             `json:"max_rss_kb,omitempty"`
+	StatusDetail     string            `json:"status_detail,omitempty"`
+	Error            string            `json:"error,omitempty"`
+	WebhookDelivered bool              `json:"webhook_delivered,omitempty"`
+	WebhookAttempts  int               `json:"webhook_attempts,omitempty"`
+	WebhookSkipped   bool              `json:"webhook_skipped,omitempty"`
+	DeadLetter       bool              `json:"dead_letter,omitempty"`
+	ContentHash      string            `json:"content_hash,omitempty"`
+	OutputExpiredAt  *time.Time        `json:"output_expired_at,omitempty"`
+	StatusURL        string            `json:"status_url,omitempty"`
+	ResultURL        string            `json:"result_url,omitempty"`
+	LogURL           string            `json:"log_url,omitempty"`
+
+	// QueuePosition is filled in by the status endpoint for IN_QUEUE jobs and
+	// never stored.
+	QueuePosition int `json:"queue_position,omitempty"`
+	// Progress is read by the status endpoint from the file the job reports
+	// its progress in, and never stored either.
+	Progress *jobProgress `json:"progress,omitempty"`
 }
 
 type queuedJob struct {
 	meta          *JobMeta
 	inputFilePath string
+	seq           uint64
 }
 
 var (
 	runningJobs = make(map[string]*RunningJob)
-	queue       = make(chan *queuedJob, 100)
+	queue       = newJobQueue()
 	mu          sync.Mutex
+
+	// activeJobs counts jobs that have been handed a worker slot.
+	activeJobs sync.WaitGroup
+	// shuttingDown is set once a termination signal has been received.
+	shuttingDown atomic.Bool
+	// workerRunning is set once workerLoop has started.
+	workerRunning atomic.Bool
+	startTime     = time.Now()
 )
 
 type RunningJob struct {
 	Cmd    *exec.Cmd
 	Meta   *JobMeta
 	Cancel context.CancelFunc
+
+	// signal is sent to the job's process group when it is canceled. It is
+	// SIGKILL unless a cancel request asked for another one.
+	signal syscall.Signal
+}
+
+// cancelSignals are the signals accepted by PUT /jobs/{id}/cancel?signal=.
+var cancelSignals = map[string]syscall.Signal{
+	"TERM": syscall.SIGTERM,
+	"KILL": syscall.SIGKILL,
+	"INT":  syscall.SIGINT,
+	"HUP":  syscall.SIGHUP,
 }
 
 func main() {
+	setupLogging()
+
+	// Without a subcommand, any arguments are the fixed command the server
+	// runs, as before subcommands existed; "server" makes that explicit.
 	var fixedArgs []string
 	if len(os.Args) > 1 {
-		fixedArgs = os.Args[1:]
-		fmt.Fprintf(os.Stderr, "Server running on :8080 (fixed command: %v)\n", fixedArgs)
-	} else {
-		fmt.Fprintln(os.Stderr, "Server running on :8080")
+		switch {
+		case clientCommands[os.Args[1]]:
+			os.Exit(runClient(os.Args[1], os.Args[2:]))
+		case os.Args[1] == "server":
+			fixedArgs = os.Args[2:]
+		default:
+			fixedArgs = os.Args[1:]
+		}
 	}
-
-	http.HandleFunc("/jobs", func(w http.ResponseWriter, r *http.Request) {
-		jobsHandler(w, r, fixedArgs)
-	})
-	http.HandleFunc("/jobs/", func(w http.ResponseWriter, r *http.Request) {
-		jobsHandler(w, r, fixedArgs)
-	})
-	go workerLoop()
-	err := http.ListenAndServe(":8080", nil)
+	pidFile, err := acquirePIDFile()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to start server: %v\n", err)
+		slog.Error("Failed to start server", "event", "server_error", "error", err)
 		os.Exit(1)
 	}
-}
-
-func jobsHandler(w http.ResponseWriter, r *http.Request, fixedArgs []string) {
-	fmt.Fprintf(os.Stderr, "[DEBUG] jobsHandler: method=%s path=%s\n", r.Method, r.URL.Path)
-	if r.URL.Path == "/jobs" && r.Method == http.MethodPost {
-		submitJob(w, r, fixedArgs)
-		return
+	defer releasePIDFile(pidFile)
+	if err := os.MkdirAll(getInputDir(), 0700); err != nil {
+		slog.Error("Failed to create input directory", "event", "server_error", "error", err)
+		os.Exit(1)
 	}
-	if r.URL.Path == "/jobs" && r.Method == http.MethodGet {
-		listJobs(w, r)
-		return
+	if err := openStore(); err != nil {
+		slog.Error("Failed to open job store", "event", "server_error", "error", err)
+		os.Exit(1)
 	}
-	if strings.HasPrefix(r.URL.Path, "/jobs/") {
-		jobHandler(w, r)
-		return
+	if err := loadTemplates(); err != nil {
+		slog.Error("Failed to load templates", "event", "server_error", "error", err)
+		os.Exit(1)
 	}
-	http.NotFound(w, r)
-}
-
-func submitJob(w http.ResponseWriter, r *http.Request, fixedArgs []string) {
-	var req struct {
-		Args     []string `json:"args"`
-		MimeType string   `json:"mime_type,omitempty"`
-		Webhook  string   `json:"webhook,omitempty"`
+	addr := os.Getenv("LISTEN_ADDR")
+	if addr == "" {
+		addr = ":8080"
 	}
-	dec := json.NewDecoder(r.Body)
-	if err := dec.Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
-		return
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	if (certFile == "") != (keyFile == "") {
+		slog.Error("TLS_CERT_FILE and TLS_KEY_FILE must be set together", "event", "server_error")
+		os.Exit(1)
 	}
-
-	id := uuid.NewString()
-	jobDir := filepath.Join(getJobsDir(), id)
-	os.MkdirAll(jobDir, 0755)
-
-	// Save any remaining body as input file
-	inputFilePath := ""
-	remaining, _ := io.ReadAll(r.Body)
-	if len(remaining) > 0 {
-		inputFilePath = filepath.Join(os.TempDir(), "input-"+id+".tmp")
-		f, err := os.Create(inputFilePath)
-		if err == nil {
-			_, _ = f.Write(remaining)
-			f.Close()
-		}
+	// Bind before recovering jobs, so a busy port fails startup before any
+	// job runs. The address logged is the one actually bound, which differs
+	// from LISTEN_ADDR for port 0.
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		slog.Error("Failed to start server", "event", "server_error", "error", err)
+		os.Exit(1)
 	}
+	slog.Info("Server running", "event", "server_start", "addr", ln.Addr().String(), "tls", certFile != "", "fixed_command", fixedArgs)
 
-	args := req.Args
-	if len(fixedArgs) > 0 {
-		args = append(append([]string{}, fixedArgs...), req.Args...)
+	registerMetrics()
+	loadIdempotencyKeys()
+	loadContentHashes()
+	recoverJobs()
+	go workerLoop()
+	go scheduleLoop()
+	startSchedules(fixedArgs)
+	go sweepLoop()
+	go reapLoop()
+
+	// Header reads are always bounded so slow clients (slowloris) can't tie
+	// up connections. Whole-request reads and writes are unbounded by default,
+	// since uploads and downloads of job data can legitimately take long.
+	srv := &http.Server{
+		Handler:           newHandler(fixedArgs),
+		ReadHeaderTimeout: envDuration("HTTP_READ_HEADER_TIMEOUT", 10*time.Second),
+		ReadTimeout:       envDuration("HTTP_READ_TIMEOUT", 0),
+		WriteTimeout:      envDuration("HTTP_WRITE_TIMEOUT", 0),
+		IdleTimeout:       envDuration("HTTP_IDLE_TIMEOUT", 120*time.Second),
 	}
+	go func() {
+		var err error
+		if certFile != "" {
+			err = srv.ServeTLS(ln, certFile, keyFile)
+		} else {
+			err = srv.Serve(ln)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			slog.Error("Failed to start server", "event", "server_error", "error", err)
+			os.Exit(1)
+		}
+	}()
 
-	meta := &JobMeta{
-		ID:         id,
-		Args:       args,
-		MimeType:   req.MimeType,
-		Webhook:    req.Webhook,
-		Status:     "IN_QUEUE",
-		EnqueuedAt: time.Now(),
-	}
-	baseURL := os.Getenv("BASE_URL")
-	statusPath := "/jobs/" + id + "/status"
-	resultPath := "/jobs/" + id + "/result"
-	logPath := "/jobs/" + id + "/log"
-	if baseURL != "" {
-		statusPath = baseURL + statusPath
-		resultPath = baseURL + resultPath
-		logPath = baseURL + logPath
-	}
-	meta.StatusURL = statusPath
-	meta.ResultURL = resultPath
-	meta.LogURL = logPath
-	saveMeta(meta)
-	queue <- &queuedJob{meta: meta, inputFilePath: inputFilePath}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	<-ctx.Done()
+	stop()
+	shutdown(srv)
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"id":         id,
-		"status_url": statusPath,
-		"result_url": resultPath,
-		"log_url":    logPath,
-	})
+// newHandler routes every endpoint of the server, behind the request ID,
+// logging and CORS middleware.
+func newHandler(fixedArgs []string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jobs", requireAPIKey(func(w http.ResponseWriter, r *http.Request) {
+		jobsHandler(w, r, fixedArgs)
+	}))
+	mux.HandleFunc("/jobs/", requireAPIKey(func(w http.ResponseWriter, r *http.Request) {
+		jobsHandler(w, r, fixedArgs)
+	}))
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/schedules", requireAPIKey(schedulesHandler))
+	mux.HandleFunc("/schedules/", requireAPIKey(schedulesHandler))
+	mux.HandleFunc("/templates", requireAPIKey(templatesHandler))
+	mux.HandleFunc("/admin/purge", requireAPIKey(purgeHandler))
+	mux.HandleFunc("/stats", requireAPIKey(statsHandler))
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/readyz", readyzHandler)
+	mux.HandleFunc("/openapi.json", openAPIHandler)
+	return withRequestID(logRequests(allowCORS(mux)))
 }
 
-func jobHandler(w http.ResponseWriter, r *http.Request) {
-	// Extract job ID and subpath
-	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/")
-	if len(parts) < 2 {
-		http.NotFound(w, r)
-		return
+// acquirePIDFile locks JOBS_DIR/server.pid and writes our PID to it, failing
+// if another live server already holds the lock on the same jobs directory.
+func acquirePIDFile() (*os.File, error) {
+	if err := os.MkdirAll(getJobsDir(), 0755); err != nil {
+		return nil, err
 	}
-	id := parts[0]
-	endpoint := parts[1]
-
-	switch endpoint {
-	case "status":
-		meta, err := loadMeta(id)
+	path := filepath.Join(getJobsDir(), "server.pid")
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	locked, err := lockFile(f)
+	if err != nil || !locked {
+		pid, _ := io.ReadAll(f)
+		f.Close()
 		if err != nil {
-			http.Error(w, "Job not found", http.StatusNotFound)
-			return
-		}
-		json.NewEncoder(w).Encode(meta)
-	case "result":
-		meta, err := loadMeta(id)
-		if err != nil || meta.Status != "COMPLETED" {
-			http.Error(w, "Result not available", http.StatusNotFound)
-			return
-		}
-		path := filepath.Join(getJobsDir(), id, "stdout.txt")
-		http.ServeFile(w, r, path)
-	case "log":
-		path := filepath.Join(getJobsDir(), id, "stderr.txt")
-		if _, err := os.Stat(path); err != nil {
-			http.Error(w, "Log not available", http.StatusNotFound)
-			return
-		}
-		http.ServeFile(w, r, path)
-	case "cancel":
-		if r.Method != http.MethodPut {
-			http.NotFound(w, r)
-			return
+			return nil, fmt.Errorf("locking %s: %w", path, err)
 		}
+		return nil, fmt.Errorf("another server (pid %s) is already using jobs directory %s", strings.TrimSpace(string(pid)), getJobsDir())
+	}
+	f.Truncate(0)
+	fmt.Fprintf(f, "%d\n", os.Getpid())
+	return f, nil
+}
+
+// releasePIDFile clears and unlocks the PID file. The file itself is left in
+// place, since removing it could race with a server starting up.
+func releasePIDFile(f *os.File) {
+	f.Truncate(0)
+	unlockFile(f)
+	f.Close()
+}
+
+// shutdown stops the server in stages: new submissions are refused and no more
+// queued jobs are started, running jobs get SHUTDOWN_GRACE_PERIOD to finish,
+// and whatever is still running after that is canceled. Queued jobs stay
+// IN_QUEUE on disk and are picked up again on the next start.
+func shutdown(srv *http.Server) {
+	grace := envDuration("SHUTDOWN_GRACE_PERIOD", 5*time.Second)
+	slog.Info("Shutting down", "event", "shutdown_start", "grace_period", grace.String())
+	shuttingDown.Store(true)
+
+	done := make(chan struct{})
+	go func() {
+		activeJobs.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(grace):
 		mu.Lock()
-		if job, ok := runningJobs[id]; ok {
+		slog.Warn("Grace period expired, canceling running jobs", "event", "shutdown_cancel", "count", len(runningJobs))
+		for _, job := range runningJobs {
 			job.Cancel()
 		}
 		mu.Unlock()
-		w.WriteHeader(http.StatusOK)
-	default:
-		http.NotFound(w, r)
+		<-done
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		srv.Close()
 	}
+	slog.Info("Shutdown complete", "event", "shutdown_complete")
 }
 
-func workerLoop() {
-	for qj := range queue {
-		go runJob(qj.meta, qj.inputFilePath)
+// setupLogging installs a JSON slog logger on stderr. The level comes from
+// LOG_LEVEL (debug, info, warn, error); DEBUG=1 is kept as a shorthand for
+// LOG_LEVEL=debug.
+func setupLogging() {
+	level := slog.LevelInfo
+	if os.Getenv("DEBUG") == "1" {
+		level = slog.LevelDebug
+	}
+	if v := os.Getenv("LOG_LEVEL"); v != "" {
+		if err := level.UnmarshalText([]byte(v)); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid LOG_LEVEL=%q, using %s\n", v, level)
+		}
 	}
+	slog.SetDefault(slog.New(contextHandler{slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level})}))
 }
 
-func runJob(meta *JobMeta, inputFilePath string) {
-	jobDir := filepath.Join(getJobsDir(), meta.ID)
-	stdoutPath := filepath.Join(jobDir, "stdout.txt")
-	stderrPath := filepath.Join(jobDir, "stderr.txt")
-	ctx, cancel := context.WithCancel(context.Background())
+// statusRecorder captures the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
 
-	cmd := exec.CommandContext(ctx, meta.Args[0], meta.Args[1:]...)
-	stdoutFile, _ := os.Create(stdoutPath)
-	stderrFile, _ := os.Create(stderrPath)
-	cmd.Stdout = stdoutFile
-	cmd.Stderr = stderrFile
+func (r *statusRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
 
-	// If input file exists, use it as stdin
-	if inputFilePath != "" {
-		inFile, err := os.Open(inputFilePath)
-		if err == nil {
-			cmd.Stdin = inFile
-			defer inFile.Close()
-		}
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
 	}
+}
 
-	// Log the command if DEBUG=1
-	if os.Getenv("DEBUG") == "1" {
-		fmt.Fprintf(os.Stderr, "[DEBUG] Running command: %v\n", cmd.Args)
-	}
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
 
-	if err := cmd.Start(); err != nil {
-		meta.Status = "FAILED"
-		meta.StartedAt = time.Now()
-		meta.CompletedAt = meta.StartedAt
-		saveMeta(meta)
-		return
-	}
-	meta.PID = cmd.Process.Pid
-	meta.Status = "IN_PROGRESS"
-	meta.StartedAt = time.Now()
-	saveMeta(meta)
+// noWriteTimeout lifts HTTP_WRITE_TIMEOUT for a response that is meant to
+// stay open, such as an event stream or a long poll.
+func noWriteTimeout(w http.ResponseWriter) {
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+}
 
-	mu.Lock()
-	runningJobs[meta.ID] = &RunningJob{Cmd: cmd, Meta: meta, Cancel: cancel}
-	mu.Unlock()
+// logRequests logs the method, path, response status and duration of every
+// request.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		slog.InfoContext(r.Context(), "Request handled", "event", "request", "method", r.Method, "path", r.URL.Path,
+			"status", rec.status, "duration_ms", time.Since(start).Milliseconds())
+	})
+}
 
-	err := cmd.Wait()
-	meta.CompletedAt = time.Now()
+// openAPISpec is the OpenAPI 3 description of the HTTP API. It is written by
+// hand, so update it along with the routes.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
 
+// healthzHandler reports that the process is alive, along with basic load
+// information.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
 	mu.Lock()
-	delete(runningJobs, meta.ID)
+	running := len(runningJobs)
 	mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":         "ok",
+		"uptime_seconds": int(time.Since(startTime).Seconds()),
+		"running_jobs":   running,
+		"queue_depth":    queue.Len(),
+	})
+}
 
-	stdoutFile.Close()
-	stderrFile.Close()
+// readyzHandler returns 200 only when the server can accept work: the worker
+// is running, the jobs directory is writable and no shutdown is in progress.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if !workerRunning.Load() || shuttingDown.Load() {
+		httpError(w, "Not ready", http.StatusServiceUnavailable)
+		return
+	}
+	if err := checkJobsDirWritable(); err != nil {
+		httpError(w, "Jobs directory not writable", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
 
-	// Remove input file after job completes
-	if inputFilePath != "" {
-		os.Remove(inputFilePath)
+func checkJobsDirWritable() error {
+	if err := os.MkdirAll(getJobsDir(), 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(getJobsDir(), ".readyz-*")
+	if err != nil {
+		return err
 	}
+	f.Close()
+	return os.Remove(f.Name())
+}
 
-	if ctx.Err() == context.Canceled {
-		meta.Status = "CANCELED"
-	} else if err != nil {
-		meta.Status = "FAILED"
-	} else {
-		meta.Status = "COMPLETED"
+// requireAPIKey rejects requests that don't carry "Authorization: Bearer
+// <API_KEY>". When API_KEY is unset every request is let through.
+func requireAPIKey(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := os.Getenv("API_KEY")
+		if key != "" {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(key)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				httpError(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		next(w, r)
 	}
-	saveMeta(meta)
+}
 
-	if os.Getenv("DEBUG") == "1" {
-		fmt.Fprintf(os.Stderr, "[DEBUG] Job finished: id=%s status=%s\n", meta.ID, meta.Status)
+func jobsHandler(w http.ResponseWriter, r *http.Request, fixedArgs []string) {
+	if r.URL.Path == "/jobs/batch" {
+		if allowMethods(w, r, http.MethodPost) && allowSubmission(w, r) {
+			submitBatch(w, r, fixedArgs)
+		}
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/jobs/") {
+		jobHandler(w, r)
+		return
+	}
+	if !allowMethods(w, r, http.MethodGet, http.MethodHead, http.MethodPost) {
+		return
 	}
+	if r.Method == http.MethodPost {
+		if allowSubmission(w, r) {
+			submitJob(w, r, fixedArgs)
+		}
+		return
+	}
+	listJobs(w, r)
+}
 
-	if meta.Webhook != "" {
-		if os.Getenv("DEBUG") == "1" {
-			fmt.Fprintf(os.Stderr, "[DEBUG] Triggering webhook: url=%s id=%s status=%s\n", meta.Webhook, meta.ID, meta.Status)
+// allowMethods reports whether r uses one of methods. If it doesn't, a 405
+// listing the allowed methods in the Allow header has been written.
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
 		}
-		go sendWebhook(meta)
 	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	return false
 }
 
-func saveMeta(meta *JobMeta) {
-	path := filepath.Join(getJobsDir(), meta.ID, "meta.json")
-	data, _ := json.MarshalIndent(meta, "", "  ")
-	os.WriteFile(path, data, 0644)
+// jobEndpointMethods lists the methods each /jobs/{id}/... endpoint accepts.
+var jobEndpointMethods = map[string][]string{
+	"":             {http.MethodDelete},
+	"status":       {http.MethodGet, http.MethodHead},
+	"meta":         {http.MethodGet, http.MethodHead},
+	"result":       {http.MethodGet, http.MethodHead},
+	"result.json":  {http.MethodGet, http.MethodHead},
+	"result/tail":  {http.MethodGet, http.MethodHead},
+	"result/jsonl": {http.MethodGet},
+	"log":          {http.MethodGet, http.MethodHead},
+	"combined":     {http.MethodGet, http.MethodHead},
+	"stream":       {http.MethodGet},
+	"wait":         {http.MethodGet},
+	"cancel":       {http.MethodPut},
+	"release":      {http.MethodPut},
+	"rerun":        {http.MethodPost},
+	"input":        {http.MethodGet, http.MethodHead},
+	"artifacts":    {http.MethodGet},
+	"artifacts/*":  {http.MethodGet, http.MethodHead},
 }
 
-func loadMeta(id string) (*JobMeta, error) {
-	path := filepath.Join(getJobsDir(), id, "meta.json")
-	data, err := os.ReadFile(path)
-	if err != nil {
+// outputEndpoints are the job endpoints that answer 410 Gone once RESULT_TTL
+// has removed the job's output.
+var outputEndpoints = map[string]bool{
+	"result":       true,
+	"result.json":  true,
+	"result/tail":  true,
+	"result/jsonl": true,
+	"log":          true,
+	"combined":     true,
+	"stream":       true,
+	"input":        true,
+	"artifacts":    true,
+	"artifacts/*":  true,
+}
+
+// jobRequest describes a job submitted to POST /jobs.
+type jobRequest struct {
+	Args           []string          `json:"args"`
+	Template       string            `json:"template,omitempty"`
+	MimeType       string            `json:"mime_type,omitempty"`
+	Webhook        string            `json:"webhook,omitempty"`
+	Timeout        int               `json:"timeout_seconds,omitempty"`
+	IdleTimeout    int               `json:"idle_timeout_seconds,omitempty"`
+	MaxOutputBytes int64             `json:"max_output_bytes,omitempty"`
+	IdempotencyKey string            `json:"idempotency_key,omitempty"`
+	RunAsUser      string            `json:"run_as_user,omitempty"`
+	Nice           int               `json:"nice,omitempty"`
+	MemoryLimitMB  int               `json:"memory_limit_mb,omitempty"`
+	Weight         int               `json:"weight,omitempty"`
+	MaxRetries     int               `json:"max_retries,omitempty"`
+	Priority       int               `json:"priority,omitempty"`
+	Hold           bool              `json:"hold,omitempty"`
+	KeepInput      bool              `json:"keep_input,omitempty"`
+	ExpiresAfter   int               `json:"expires_after_seconds,omitempty"`
+	RunAt          *time.Time        `json:"run_at,omitempty"`
+	Delay          int               `json:"delay_seconds,omitempty"`
+	Schedule       string            `json:"schedule,omitempty"`
+	Env            map[string]string `json:"env,omitempty"`
+	Cwd            string            `json:"cwd,omitempty"`
+	Namespace      string            `json:"namespace,omitempty"`
+	Labels         map[string]string `json:"labels,omitempty"`
+	DependsOn      []string          `json:"depends_on,omitempty"`
+	StdinFromJob   string            `json:"stdin_from_job,omitempty"`
+	InputBase64    string            `json:"input_base64,omitempty"`
+	OutputFiles    []string          `json:"output_files,omitempty"`
+	// WebhookEvents lists the statuses the webhook fires for; "terminal"
+	// stands for all final statuses and is the default.
+	WebhookEvents  []string          `json:"webhook_events,omitempty"`
+	WebhookMethod  string            `json:"webhook_method,omitempty"`
+	WebhookHeaders map[string]string `json:"webhook_headers,omitempty"`
+
+	// files holds the files uploaded with a multipart submission, by field name.
+	files map[string]*multipart.FileHeader
+	// parentScheduleID is set on jobs created by a recurring schedule.
+	parentScheduleID string
+	// batchID is set on jobs submitted together through POST /jobs/batch.
+	batchID string
+	// rerunOf is set on jobs created by POST /jobs/{id}/rerun.
+	rerunOf string
+}
+
+// parseJobRequest reads a job submission and returns the job description
+// along with a reader for the command's stdin. Four forms are accepted:
+//
+//   - Content-Type: application/json. The body starts with a JSON jobRequest
+//     object; everything after it (minus one separating newline) is stdin.
+//     Alternatively, stdin can be given base64-encoded in input_base64.
+//   - Content-Type: multipart/form-data. The job is described by form fields
+//     named like the query parameters below. Every uploaded file is saved in
+//     the job directory and can be referenced in args as {{file:<field>}};
+//     a file uploaded as "stdin" is used as stdin instead.
+//   - Content-Type: application/x-www-form-urlencoded. The job is described by
+//     form fields (and query parameters) named like the query parameters
+//     below, and there is no stdin.
+//   - Any other content type. The job is described by query parameters
+//     (repeated "args" and "env" as KEY=VALUE, "mime_type", "webhook", "cwd",
+//     "timeout_seconds", "max_retries", "priority", "hold", "run_at",
+//     "delay_seconds", "schedule") and the raw request body, untouched, is
+//     stdin.
+//
+// The last form is the one for stdin input: the body reaches the command
+// byte for byte, with nothing to parse around it. JSON submissions are still
+// accepted as they were, so existing clients keep working, but their body is
+// not all stdin; only what follows the JSON object is.
+func parseJobRequest(r *http.Request) (*jobRequest, io.Reader, error) {
+	var req jobRequest
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json":
+		dec := json.NewDecoder(r.Body)
+		if err := dec.Decode(&req); err != nil {
+			return nil, nil, jsonError(err, "Invalid JSON")
+		}
+		// The decoder reads ahead, so stdin is whatever it buffered past the
+		// JSON object followed by the unread remainder of the body.
+		input := bufio.NewReader(io.MultiReader(dec.Buffered(), r.Body))
+		if b, err := input.Peek(2); err == nil && string(b) == "\r\n" {
+			input.Discard(2)
+		} else if len(b) > 0 && b[0] == '\n' {
+			input.Discard(1)
+		}
+		if req.InputBase64 != "" {
+			if _, err := input.Peek(1); err == nil {
+				return nil, nil, badRequest("input_base64 can't be combined with stdin after the JSON object")
+			}
+			decoded, err := decodeInputBase64(&req)
+			if err != nil {
+				return nil, nil, err
+			}
+			return &req, decoded, nil
+		}
+		return &req, input, nil
+	case "multipart/form-data":
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			return nil, nil, bodyError(err, "Invalid multipart form")
+		}
+		if err := parseJobValues(r.MultipartForm.Value, &req); err != nil {
+			return nil, nil, err
+		}
+		var input io.Reader = http.NoBody
+		for name, fhs := range r.MultipartForm.File {
+			if name == "stdin" {
+				f, err := fhs[0].Open()
+				if err != nil {
+					return nil, nil, fmt.Errorf("Failed to read uploaded stdin")
+				}
+				input = f
+				continue
+			}
+			if !validFileName(name) {
+				return nil, nil, fmt.Errorf("Invalid file field name %q", name)
+			}
+			if req.files == nil {
+				req.files = make(map[string]*multipart.FileHeader)
+			}
+			req.files[name] = fhs[0]
+		}
+		return &req, input, nil
+	case "application/x-www-form-urlencoded":
+		if err := r.ParseForm(); err != nil {
+			return nil, nil, bodyError(err, "Invalid form")
+		}
+		if err := parseJobValues(r.Form, &req); err != nil {
+			return nil, nil, err
+		}
+		return &req, http.NoBody, nil
+	}
+
+	if err := parseJobValues(r.URL.Query(), &req); err != nil {
+		return nil, nil, err
+	}
+	return &req, r.Body, nil
+}
+
+// decodeInputBase64 returns a reader decoding req.InputBase64, or nil if it is
+// empty. The input is decoded as it is read, so the decoded bytes are never
+// held in memory. It is decoded once up front too, without keeping the
+// result, so an invalid encoding (400) or an input over MAX_INPUT_BYTES (413)
+// is rejected before any job is created. The field is cleared, as from then
+// on the decoded bytes are the job's input.
+func decodeInputBase64(req *jobRequest) (io.Reader, error) {
+	if req.InputBase64 == "" {
+		return nil, nil
+	}
+	if _, err := io.Copy(io.Discard, newBase64Input(req.InputBase64)); err != nil {
 		return nil, err
 	}
-	var meta JobMeta
-	json.Unmarshal(data, &meta)
-	return &meta, nil
+	input := newBase64Input(req.InputBase64)
+	req.InputBase64 = ""
+	return input, nil
 }
 
-func sendWebhook(meta *JobMeta) {
-	payload := map[string]string{
-		"id":         meta.ID,
-		"status":     meta.Status,
-		"result_url": "/jobs/" + meta.ID + "/result",
+// base64Input decodes an input_base64 field, failing with a requestError if
+// it isn't valid base64 or decodes to more than limit bytes.
+type base64Input struct {
+	r     io.Reader
+	limit int64
+	n     int64
+}
+
+func newBase64Input(s string) *base64Input {
+	in := &base64Input{r: base64.NewDecoder(base64.StdEncoding, strings.NewReader(s))}
+	if limit := envInt("MAX_INPUT_BYTES", 100<<20); limit > 0 {
+		in.limit = int64(limit)
+		in.r = io.LimitReader(in.r, in.limit+1)
 	}
-	data, _ := json.Marshal(payload)
-	http.Post(meta.Webhook, "application/json", bytes.NewReader(data))
+	return in
 }
 
-func listJobs(w http.ResponseWriter, r *http.Request) {
-	entries, err := os.ReadDir(getJobsDir())
+func (in *base64Input) Read(p []byte) (int, error) {
+	n, err := in.r.Read(p)
+	in.n += int64(n)
+	if in.limit > 0 && in.n > in.limit {
+		return n, &requestError{status: http.StatusRequestEntityTooLarge, msg: fmt.Sprintf("input_base64 exceeds %d bytes", in.limit)}
+	}
+	var corrupt base64.CorruptInputError
+	if errors.As(err, &corrupt) {
+		return n, badRequest("input_base64 is not valid base64")
+	}
+	return n, err
+}
+
+// parseJobValues fills req from query parameters or form fields.
+func parseJobValues(values url.Values, req *jobRequest) error {
+	req.Args = values["args"]
+	for _, kv := range values["env"] {
+		k, v, _ := strings.Cut(kv, "=")
+		if req.Env == nil {
+			req.Env = make(map[string]string)
+		}
+		req.Env[k] = v
+	}
+	req.Template = values.Get("template")
+	req.MimeType = values.Get("mime_type")
+	req.Webhook = values.Get("webhook")
+	req.Cwd = values.Get("cwd")
+	req.Namespace = values.Get("namespace")
+	req.DependsOn = values["depends_on"]
+	req.StdinFromJob = values.Get("stdin_from_job")
+	req.OutputFiles = values["output_files"]
+	req.WebhookEvents = values["webhook_events"]
+	req.WebhookMethod = values.Get("webhook_method")
+	for _, h := range values["webhook_headers"] {
+		name, value, _ := strings.Cut(h, ":")
+		if req.WebhookHeaders == nil {
+			req.WebhookHeaders = make(map[string]string)
+		}
+		req.WebhookHeaders[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	req.IdempotencyKey = values.Get("idempotency_key")
+	req.RunAsUser = values.Get("run_as_user")
+	labels, err := parseLabels(values["labels"])
 	if err != nil {
-		http.Error(w, "Failed to read jobs directory", http.StatusInternalServerError)
-		return
+		return err
 	}
-	var jobs []struct {
-		ID         string   `json:"id"`
-		Args       []string `json:"args"`
-		Status     string   `json:"status"`
-		ResultURL  string   `json:"result_url"`
-		LogURL     string   `json:"log_url"`
-		EnqueuedAt string   `json:"enqueued_at"`
+	req.Labels = labels
+	req.Schedule = values.Get("schedule")
+	ints := map[string]*int{
+		"timeout_seconds":       &req.Timeout,
+		"idle_timeout_seconds":  &req.IdleTimeout,
+		"max_retries":           &req.MaxRetries,
+		"priority":              &req.Priority,
+		"delay_seconds":         &req.Delay,
+		"expires_after_seconds": &req.ExpiresAfter,
+		"nice":                  &req.Nice,
+		"memory_limit_mb":       &req.MemoryLimitMB,
+		"weight":                &req.Weight,
 	}
-	baseURL := os.Getenv("BASE_URL")
-	for _, entry := range entries {
-		if !entry.IsDir() {
-			continue
+	for name, dst := range ints {
+		if v := values.Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("Invalid %s", name)
+			}
+			*dst = n
 		}
-		metaPath := filepath.Join(getJobsDir(), entry.Name(), "meta.json")
-		data, err := os.ReadFile(metaPath)
+	}
+	if v := values.Get("max_output_bytes"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
 		if err != nil {
-			continue
+			return fmt.Errorf("Invalid max_output_bytes")
 		}
-		var meta JobMeta
-		if err := json.Unmarshal(data, &meta); err != nil {
-			continue
+		req.MaxOutputBytes = n
+	}
+	if v := values.Get("run_at"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return fmt.Errorf("Invalid run_at")
 		}
-		resultPath := "/jobs/" + meta.ID + "/result"
-		logPath := "/jobs/" + meta.ID + "/log"
-		if baseURL != "" {
-			resultPath = baseURL + resultPath
-			logPath = baseURL + logPath
-		}
-		jobs = append(jobs, struct {
-			ID         string   `json:"id"`
-			Args       []string `json:"args"`
-			Status     string   `json:"status"`
-			ResultURL  string   `json:"result_url"`
-			LogURL     string   `json:"log_url"`
-			EnqueuedAt string   `json:"enqueued_at"`
-		}{
-			ID:         meta.ID,
-			Args:       meta.Args,
-			Status:     meta.Status,
-			ResultURL:  resultPath,
-			LogURL:     logPath,
-			EnqueuedAt: meta.EnqueuedAt.Format(time.RFC3339),
-		})
+		req.RunAt = &t
+	}
+	bools := map[string]*bool{
+		"hold":       &req.Hold,
+		"keep_input": &req.KeepInput,
+	}
+	for name, dst := range bools {
+		if v := values.Get(name); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("Invalid %s", name)
+			}
+			*dst = b
+		}
+	}
+	return nil
+}
+
+func submitJob(w http.ResponseWriter, r *http.Request, fixedArgs []string) {
+	if shuttingDown.Load() {
+		httpError(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+	if !dryRun && queueFull(w, 1) {
+		return
+	}
+	if limit := envInt("MAX_INPUT_BYTES", 100<<20); limit > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, int64(limit))
+	}
+	req, input, err := parseJobRequest(r)
+	if err != nil {
+		var re *requestError
+		if !errors.As(err, &re) {
+			err = badRequest("%s", err)
+		}
+		writeRequestError(w, err)
+		return
+	}
+	if ns := r.Header.Get("X-Namespace"); ns != "" {
+		if req.Namespace != "" && req.Namespace != ns {
+			httpError(w, "namespace does not match X-Namespace", http.StatusBadRequest)
+			return
+		}
+		req.Namespace = ns
+	}
+	if r.MultipartForm != nil {
+		defer r.MultipartForm.RemoveAll()
+	}
+	if c, ok := input.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	if dryRun {
+		validateJob(w, req, fixedArgs)
+		return
+	}
+	if req.Schedule != "" {
+		createSchedule(w, req, input)
+		return
+	}
+
+	meta, err := createJob(r.Context(), req, input, fixedArgs)
+	if err != nil {
+		writeRequestError(w, err)
+		return
 	}
-	// Sort jobs by EnqueuedAt descending
-	sort.Slice(jobs, func(i, j int) bool {
-		return jobs[i].EnqueuedAt > jobs[j].EnqueuedAt
-	})
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(jobs)
+	json.NewEncoder(w).Encode(jobLinks(meta))
 }
 
-func getJobsDir() string {
-	dir := os.Getenv("JOBS_DIR")
-	if dir == "" {
-		dir = "jobs"
+// validateJob answers a ?dry_run=true submission: it runs every check a real
+// submission would and reports the command that would run, without creating
+// anything.
+func validateJob(w http.ResponseWriter, req *jobRequest, fixedArgs []string) {
+	if req.Schedule != "" {
+		if err := checkSchedule(req.Schedule, req); err != nil {
+			writeRequestError(w, err)
+			return
+		}
 	}
-	return dir
+	meta, err := prepareJob(req, fixedArgs)
+	if err != nil {
+		writeRequestError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"valid":     true,
+		"args":      meta.Args,
+		"cwd":       meta.Cwd,
+		"namespace": meta.Namespace,
+	})
+}
+
+// queueFullRetryAfter is the Retry-After sent with a 503 for a full queue.
+const queueFullRetryAfter = 5 * time.Second
+
+// queueFull reports whether adding n jobs would take the queue past
+// MAX_QUEUE_LENGTH, in which case a 503 with a Retry-After header has been
+// written. Jobs already accepted (retries, released or scheduled jobs) are
+// always queued, so the limit can be briefly exceeded.
+func queueFull(w http.ResponseWriter, n int) bool {
+	limit := envInt("MAX_QUEUE_LENGTH", 0)
+	if limit <= 0 || queue.Len()+n <= limit {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(queueFullRetryAfter.Seconds())))
+	httpError(w, "Queue is full", http.StatusServiceUnavailable)
+	return true
+}
+
+// submitBatch creates every job in a JSON array of job requests. All of them
+// are validated before any is created, so an invalid item rejects the whole
+// batch. The jobs share a batch_id, and the response lists them in request
+// order.
+func submitBatch(w http.ResponseWriter, r *http.Request, fixedArgs []string) {
+	if shuttingDown.Load() {
+		httpError(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if limit := envInt("MAX_INPUT_BYTES", 100<<20); limit > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, int64(limit))
+	}
+	var reqs []*jobRequest
+	if err := json.NewDecoder(r.Body).Decode(&reqs); err != nil {
+		err = jsonError(err, "Invalid JSON: expected an array of jobs")
+		writeRequestError(w, err)
+		return
+	}
+	if len(reqs) == 0 {
+		httpError(w, "Batch must contain at least one job", http.StatusBadRequest)
+		return
+	}
+	if queueFull(w, len(reqs)) {
+		return
+	}
+	ns := r.Header.Get("X-Namespace")
+	batchID := uuid.NewString()
+	inputs := make([]io.Reader, len(reqs))
+	for i, req := range reqs {
+		if req == nil {
+			httpError(w, fmt.Sprintf("Job %d: missing job", i), http.StatusBadRequest)
+			return
+		}
+		input, err := decodeInputBase64(req)
+		if err != nil {
+			writeRequestError(w, fmt.Errorf("Job %d: %w", i, err))
+			return
+		}
+		inputs[i] = input
+		if req.Schedule != "" {
+			httpError(w, fmt.Sprintf("Job %d: schedule can't be used in a batch", i), http.StatusBadRequest)
+			return
+		}
+		if ns != "" {
+			if req.Namespace != "" && req.Namespace != ns {
+				httpError(w, fmt.Sprintf("Job %d: namespace does not match X-Namespace", i), http.StatusBadRequest)
+				return
+			}
+			req.Namespace = ns
+		}
+		req.batchID = batchID
+		check := *req
+		if _, err := prepareJob(&check, fixedArgs); err != nil {
+			writeRequestError(w, fmt.Errorf("Job %d: %w", i, err))
+			return
+		}
+	}
+
+	out := make([]map[string]string, 0, len(reqs))
+	for i, req := range reqs {
+		meta, err := createJob(r.Context(), req, inputs[i], fixedArgs)
+		if err != nil {
+			writeRequestError(w, fmt.Errorf("Job %d: %w", i, err))
+			return
+		}
+		links := jobLinks(meta)
+		links["batch_id"] = batchID
+		out = append(out, links)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// createSchedule registers a recurring job instead of running it once.
+// Scheduled jobs can't take stdin since there is nowhere to replay it from.
+func createSchedule(w http.ResponseWriter, req *jobRequest, input io.Reader) {
+	if n, _ := input.Read(make([]byte, 1)); n > 0 {
+		httpError(w, "stdin input can't be combined with schedule", http.StatusBadRequest)
+		return
+	}
+	if req.IdempotencyKey != "" {
+		httpError(w, "idempotency_key can't be combined with schedule", http.StatusBadRequest)
+		return
+	}
+	spec := req.Schedule
+	req.Schedule = ""
+	sched, err := schedules.Create(spec, req)
+	if err != nil {
+		writeRequestError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(sched)
+}
+
+// jobLinks is the response body returned when a job is created.
+func jobLinks(meta *JobMeta) map[string]string {
+	return map[string]string{
+		"id":         meta.ID,
+		"status_url": meta.StatusURL,
+		"result_url": meta.ResultURL,
+		"log_url":    meta.LogURL,
+	}
+}
+
+// requestError is a problem with a job request, carrying the HTTP status it
+// should be reported with and, optionally, an error code more specific than
+// the status's default.
+type requestError struct {
+	status int
+	code   string
+	msg    string
+}
+
+func (e *requestError) Error() string { return e.msg }
+
+func badRequest(format string, a ...any) error {
+	return &requestError{status: http.StatusBadRequest, msg: fmt.Sprintf(format, a...)}
+}
+
+// bodyError reports a failure to read the request body: 413 if it went over
+// MAX_INPUT_BYTES, or a 400 with msg otherwise.
+func bodyError(err error, msg string) error {
+	var mbe *http.MaxBytesError
+	if errors.As(err, &mbe) {
+		return &requestError{status: http.StatusRequestEntityTooLarge, msg: fmt.Sprintf("Request body exceeds %d bytes", mbe.Limit)}
+	}
+	return badRequest(msg)
+}
+
+// jsonError is bodyError for a body that failed to decode as JSON, reported
+// with the invalid_json code.
+func jsonError(err error, msg string) error {
+	err = bodyError(err, msg)
+	if re := err.(*requestError); re.status == http.StatusBadRequest {
+		re.code = codeInvalidJSON
+	}
+	return err
+}
+
+// errorStatus returns the HTTP status for an error from prepareJob or
+// createJob; anything that isn't a requestError is a server-side failure.
+func errorStatus(err error) int {
+	var re *requestError
+	if errors.As(err, &re) {
+		return re.status
+	}
+	return http.StatusInternalServerError
+}
+
+// prepareJob validates a job request and builds the metadata for it without
+// touching the filesystem or the queue. The returned meta has no ID yet.
+func prepareJob(req *jobRequest, fixedArgs []string) (*JobMeta, error) {
+	if err := applyTemplate(req); err != nil {
+		return nil, err
+	}
+	if req.Timeout < 0 {
+		return nil, badRequest("timeout_seconds must not be negative")
+	}
+	if req.Timeout == 0 {
+		req.Timeout = envInt("DEFAULT_TIMEOUT_SECONDS", 0)
+	}
+	if err := checkLabels(req.Labels); err != nil {
+		return nil, err
+	}
+	if err := checkOutputFiles(req.OutputFiles); err != nil {
+		return nil, err
+	}
+	if len(req.IdempotencyKey) > maxIdempotencyKeyLen {
+		return nil, badRequest("idempotency_key must be at most %d bytes", maxIdempotencyKeyLen)
+	}
+	if req.ExpiresAfter < 0 {
+		return nil, badRequest("expires_after_seconds must not be negative")
+	}
+	if req.MaxOutputBytes < 0 {
+		return nil, badRequest("max_output_bytes must not be negative")
+	}
+	if req.IdleTimeout < 0 {
+		return nil, badRequest("idle_timeout_seconds must not be negative")
+	}
+	if req.MaxRetries < 0 {
+		return nil, badRequest("max_retries must not be negative")
+	}
+	if req.Delay < 0 {
+		return nil, badRequest("delay_seconds must not be negative")
+	}
+	if req.Namespace != "" && !validNamespace(req.Namespace) {
+		return nil, badRequest("Invalid namespace %q", req.Namespace)
+	}
+	runAt := req.RunAt
+	if req.Delay > 0 {
+		if req.RunAt != nil {
+			return nil, badRequest("Only one of run_at and delay_seconds may be set")
+		}
+		t := time.Now().Add(time.Duration(req.Delay) * time.Second)
+		runAt = &t
+	}
+
+	args := req.Args
+	if len(fixedArgs) > 0 {
+		args = append(append([]string{}, fixedArgs...), req.Args...)
+	}
+	if err := checkArgs(args); err != nil {
+		return nil, err
+	}
+
+	if !commandAllowed(args[0]) {
+		return nil, &requestError{status: http.StatusForbidden, msg: "Command not allowed"}
+	}
+	if len(req.Env) > 0 {
+		if err := checkJobEnv(req.Env); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range referencedFiles(args) {
+		if _, ok := req.files[name]; !ok {
+			return nil, badRequest("File %q referenced in args was not uploaded", name)
+		}
+	}
+	if req.StdinFromJob != "" {
+		if !validJobID(req.StdinFromJob) {
+			return nil, badRequest("Invalid job ID %q in stdin_from_job", req.StdinFromJob)
+		}
+		if _, err := loadMeta(req.Namespace, req.StdinFromJob); err != nil {
+			return nil, badRequest("Job %s in stdin_from_job not found", req.StdinFromJob)
+		}
+		// The source's output is only complete once it has finished, so it
+		// is waited for like any other dependency.
+		if !slices.Contains(req.DependsOn, req.StdinFromJob) {
+			req.DependsOn = append(slices.Clip(req.DependsOn), req.StdinFromJob)
+		}
+	}
+	if len(req.DependsOn) > 0 {
+		if req.Hold || runAt != nil {
+			return nil, badRequest("depends_on and stdin_from_job can't be combined with hold, run_at or delay_seconds")
+		}
+		for _, dep := range req.DependsOn {
+			if !validJobID(dep) {
+				return nil, badRequest("Invalid job ID %q in depends_on", dep)
+			}
+			if _, err := loadMeta(req.Namespace, dep); err != nil {
+				return nil, badRequest("Job %s in depends_on not found", dep)
+			}
+		}
+	}
+	for _, event := range req.WebhookEvents {
+		if event != "terminal" && !slices.Contains(jobStatuses, event) {
+			return nil, badRequest("Unknown webhook event %q", event)
+		}
+	}
+	if err := checkWebhookOptions(req); err != nil {
+		return nil, err
+	}
+	if req.Nice < -20 || req.Nice > 19 {
+		return nil, badRequest("nice must be between -20 and 19")
+	}
+	// Only privileged processes may raise priority, and doing so can starve
+	// the host, so negative values must be allowed explicitly.
+	if req.Nice < 0 && os.Getenv("ALLOW_NEGATIVE_NICE") != "1" {
+		return nil, &requestError{status: http.StatusForbidden, msg: "Negative nice values are not allowed"}
+	}
+	if req.MemoryLimitMB < 0 {
+		return nil, badRequest("memory_limit_mb must not be negative")
+	}
+	if req.MemoryLimitMB > 0 && !memoryLimitSupported {
+		return nil, badRequest("memory_limit_mb is not supported on this platform")
+	}
+	if req.Weight < 0 {
+		return nil, badRequest("weight must not be negative")
+	}
+	if limit := getMaxConcurrentJobs(); req.Weight > limit {
+		return nil, badRequest("weight can't exceed MAX_CONCURRENT_JOBS (%d)", limit)
+	}
+	if req.RunAsUser != "" {
+		if os.Getenv("ALLOW_RUN_AS") != "1" {
+			return nil, &requestError{status: http.StatusForbidden, msg: "Running jobs as another user is not allowed"}
+		}
+		if _, err := lookupCredential(req.RunAsUser); err != nil {
+			return nil, badRequest("Invalid run_as_user: %s", err)
+		}
+	}
+	cwd := ""
+	if req.Cwd != "" {
+		var err error
+		if cwd, err = resolveJobCwd(req.Cwd); err != nil {
+			return nil, badRequest("%s", err)
+		}
+	}
+
+	return &JobMeta{
+		Namespace:        req.Namespace,
+		Args:             args,
+		MimeType:         req.MimeType,
+		Webhook:          req.Webhook,
+		Timeout:          req.Timeout,
+		IdleTimeout:      req.IdleTimeout,
+		MaxOutputBytes:   req.MaxOutputBytes,
+		IdempotencyKey:   req.IdempotencyKey,
+		RunAsUser:        req.RunAsUser,
+		RerunOf:          req.rerunOf,
+		KeepInput:        req.KeepInput,
+		ExpiresAfter:     req.ExpiresAfter,
+		Nice:             req.Nice,
+		MemoryLimitMB:    req.MemoryLimitMB,
+		Weight:           req.Weight,
+		Labels:           req.Labels,
+		MaxRetries:       req.MaxRetries,
+		Priority:         req.Priority,
+		RunAt:            runAt,
+		EnvKeys:          sortedKeys(req.Env),
+		Cwd:              cwd,
+		Files:            sortedKeys(req.files),
+		ParentScheduleID: req.parentScheduleID,
+		BatchID:          req.batchID,
+		DependsOn:        req.DependsOn,
+		StdinFromJob:     req.StdinFromJob,
+		OutputFiles:      req.OutputFiles,
+		Template:         req.Template,
+		WebhookEvents:    req.WebhookEvents,
+		WebhookMethod:    req.WebhookMethod,
+		WebhookHeaders:   sortedKeys(req.WebhookHeaders),
+		Status:           "IN_QUEUE",
+	}, nil
+}
+
+// createJob validates a job request, stores the job on disk along with its
+// uploaded files, stdin input and environment, and then queues, holds or
+// schedules it. ctx is the submitting request's, for logging.
+func createJob(ctx context.Context, req *jobRequest, input io.Reader, fixedArgs []string) (*JobMeta, error) {
+	meta, err := prepareJob(req, fixedArgs)
+	if err != nil {
+		return nil, err
+	}
+	// Submitting an idempotency key again returns the job created with it
+	// the first time instead of creating another one.
+	if meta.IdempotencyKey != "" {
+		idempotency.Lock()
+		existing := idempotentJob(meta.Namespace, meta.IdempotencyKey)
+		idempotency.Unlock()
+		if existing != nil {
+			slog.DebugContext(ctx, "Returning job for repeated idempotency key", "event", "job_idempotent", "job_id", existing.ID)
+			return existing, nil
+		}
+	}
+
+	id := uuid.NewString()
+	jobDir := getJobDir(meta.Namespace, id)
+	// Until the job has been stored, any failure removes what was written
+	// for it so far, so nothing is left behind for a job that doesn't exist.
+	stored := false
+	defer func() {
+		if !stored {
+			os.RemoveAll(jobDir)
+			os.Remove(inputPath(id))
+		}
+	}()
+	if err := os.MkdirAll(jobDir, 0755); err != nil {
+		return nil, fmt.Errorf("Failed to create job directory")
+	}
+	if err := saveUploadedFiles(jobDir, req.files); err != nil {
+		return nil, fmt.Errorf("Failed to save uploaded files")
+	}
+
+	// With DEDUPLICATE_JOBS, the input is hashed on its way to disk.
+	dedupable := deduplicateJobs() && dedupEligible(req)
+	var inputHash hash.Hash
+	if dedupable && input != nil {
+		inputHash = sha256.New()
+		input = io.TeeReader(input, inputHash)
+	}
+
+	// Stream any remaining body into the input file; it is never held in
+	// memory, so inputs can be larger than RAM.
+	inputFilePath, err := stageInput(id, input)
+	if err != nil {
+		return nil, err
+	}
+	if inputFilePath != "" && meta.StdinFromJob != "" {
+		return nil, badRequest("stdin input can't be combined with stdin_from_job")
+	}
+
+	if len(req.Env) > 0 {
+		if err := saveJobEnv(meta.Namespace, id, req.Env); err != nil {
+			return nil, fmt.Errorf("Failed to save job environment")
+		}
+	}
+	if len(req.WebhookHeaders) > 0 {
+		if err := saveWebhookHeaders(meta.Namespace, id, req.WebhookHeaders); err != nil {
+			return nil, fmt.Errorf("Failed to save webhook headers")
+		}
+	}
+
+	// The input is staged without holding idempotency, as reading it can
+	// take as long as the client takes to send it. The key is checked again
+	// now: a submission racing this one may have created its job meanwhile.
+	if meta.IdempotencyKey != "" {
+		idempotency.Lock()
+		defer idempotency.Unlock()
+		if existing := idempotentJob(meta.Namespace, meta.IdempotencyKey); existing != nil {
+			slog.DebugContext(ctx, "Returning job for repeated idempotency key", "event", "job_idempotent", "job_id", existing.ID)
+			return existing, nil
+		}
+	}
+
+	// An identical job that hasn't finished yet is returned instead of
+	// creating another; what was written for this one is removed on return.
+	if dedupable {
+		var digest []byte
+		if inputFilePath != "" {
+			digest = inputHash.Sum(nil)
+		}
+		meta.ContentHash = contentHash(req, meta, digest)
+		dedup.Lock()
+		defer dedup.Unlock()
+		if existing := duplicateJob(meta.Namespace, meta.ContentHash); existing != nil {
+			slog.InfoContext(ctx, "Coalesced identical job", "event", "job_deduplicated", "job_id", existing.ID)
+			return existing, nil
+		}
+	}
+
+	meta.ID = id
+	meta.HasInput = inputFilePath != ""
+	meta.EnqueuedAt = time.Now()
+	meta.StatusURL = jobURL(meta.Namespace, id, "status")
+	meta.ResultURL = jobURL(meta.Namespace, id, "result")
+	meta.LogURL = jobURL(meta.Namespace, id, "log")
+	if req.Hold {
+		meta.Status = "HELD"
+	} else if len(meta.DependsOn) > 0 {
+		meta.Status = "WAITING"
+	} else if meta.RunAt != nil && meta.RunAt.After(time.Now()) {
+		meta.Status = "SCHEDULED"
+	}
+	jobLimit.Lock()
+	defer jobLimit.Unlock()
+	if err := makeRoomForJob(ctx); err != nil {
+		return nil, err
+	}
+	if err := store.Create(meta); err != nil {
+		slog.WarnContext(ctx, "Failed to save job metadata", "event", "store_error", "job_id", id, "error", err)
+		return nil, fmt.Errorf("Failed to save job")
+	}
+	stored = true
+	if meta.ContentHash != "" {
+		dedup.ids[dedupIndexKey(meta.Namespace, meta.ContentHash)] = id
+	}
+	if meta.IdempotencyKey != "" {
+		idempotency.ids[idempotencyIndexKey(meta.Namespace, meta.IdempotencyKey)] = id
+	}
+	notifyTransition(meta)
+	if meta.Status == "WAITING" {
+		waitForDependencies(meta)
+	} else if meta.Status == "SCHEDULED" {
+		scheduleJob(meta.Namespace, id, *meta.RunAt)
+	} else if meta.Status == "IN_QUEUE" {
+		// The worker updates the queued meta as the job runs, so it gets its
+		// own copy and the caller can keep reading this one.
+		queued := *meta
+		queue.Push(&queuedJob{meta: &queued, inputFilePath: inputFilePath})
+	}
+	jobsSubmitted.Inc()
+	return meta, nil
+}
+
+// stageInput copies input to the staged input file of job id and returns its
+// path, or "" if there was no input. A partially written file is removed.
+func stageInput(id string, input io.Reader) (string, error) {
+	if input == nil {
+		return "", nil
+	}
+	path := inputPath(id)
+	f, err := os.Create(path)
+	if err != nil {
+		return "", fmt.Errorf("Failed to stage input")
+	}
+	n, err := io.Copy(f, input)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil || n == 0 {
+		os.Remove(path)
+	}
+	var mbe *http.MaxBytesError
+	var re *requestError
+	if errors.As(err, &mbe) {
+		return "", bodyError(err, "")
+	} else if errors.As(err, &re) {
+		return "", re
+	} else if err != nil {
+		return "", fmt.Errorf("Failed to stage input")
+	}
+	if n == 0 {
+		return "", nil
+	}
+	return path, nil
+}
+
+func jobHandler(w http.ResponseWriter, r *http.Request) {
+	// Extract job ID and subpath
+	parts := strings.Split(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/"), "/")
+	ns, err := requestNamespace(r)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// IDs end up in file paths, so anything that isn't one of our UUIDs is
+	// refused before the filesystem is touched.
+	if !validJobID(parts[0]) {
+		httpError(w, "Invalid job ID", http.StatusBadRequest)
+		return
+	}
+	id := parts[0]
+	endpoint := strings.Join(parts[1:], "/")
+	var artifact string
+	if len(parts) == 3 && parts[1] == "artifacts" {
+		endpoint, artifact = "artifacts/*", parts[2]
+	}
+	methods, ok := jobEndpointMethods[endpoint]
+	if !ok {
+		httpError(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if !allowMethods(w, r, methods...) {
+		return
+	}
+	if outputEndpoints[endpoint] {
+		if meta, err := loadMeta(ns, id); err == nil && meta.OutputExpiredAt != nil {
+			httpError(w, "Output of the job has expired", http.StatusGone)
+			return
+		}
+	}
+
+	switch endpoint {
+	case "":
+		deleteJob(w, ns, id)
+	case "status":
+		meta, err := loadMeta(ns, id)
+		if err != nil {
+			httpError(w, "Job not found", http.StatusNotFound)
+			return
+		}
+		if meta.Status == "IN_QUEUE" {
+			meta.QueuePosition = queue.Position(id)
+		}
+		meta.Progress = readProgress(ns, id)
+		json.NewEncoder(w).Encode(meta)
+	case "meta":
+		// The stored bytes, unlike status, keep fields this version of the
+		// server doesn't know about.
+		data, err := store.LoadRaw(ns, id)
+		if err != nil {
+			httpError(w, "Job not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+	case "result":
+		meta, err := loadMeta(ns, id)
+		// ?partial=true serves the stdout written so far by a job that hasn't
+		// completed, marked as incomplete by X-Job-Status.
+		partial := err == nil && meta.Status != "COMPLETED" && r.URL.Query().Get("partial") == "true"
+		if err != nil || (meta.Status != "COMPLETED" && !partial) {
+			httpError(w, "Result not available", http.StatusNotFound)
+			return
+		}
+		if partial {
+			w.Header().Set("X-Job-Status", meta.Status)
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		// The file server only sniffs the type when Content-Type is unset.
+		if meta.MimeType != "" {
+			w.Header().Set("Content-Type", meta.MimeType)
+		}
+		serveOutput(w, r, getJobDir(ns, id), "stdout", "Result not available")
+	case "result.json":
+		serveJSONResult(w, r, ns, id)
+	case "result/tail":
+		serveResultTail(w, r, ns, id)
+	case "result/jsonl":
+		streamJSONLines(w, r, ns, id)
+	case "log":
+		if r.URL.Query().Has("lines") {
+			serveLogLines(w, r, ns, id)
+			return
+		}
+		serveOutput(w, r, getJobDir(ns, id), "stderr", "Log not available")
+	case "combined":
+		path := filepath.Join(getJobDir(ns, id), "combined.txt")
+		if _, err := os.Stat(path); err != nil {
+			httpError(w, "Combined log not available", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		serveFile(w, r, path)
+	case "stream":
+		streamJob(w, r, ns, id)
+	case "wait":
+		waitJob(w, r, ns, id)
+	case "cancel":
+		cancelJob(w, r, ns, id)
+	case "release":
+		releaseJob(w, ns, id)
+	case "rerun":
+		rerunJob(w, r, ns, id)
+	case "input":
+		meta, err := loadMeta(ns, id)
+		path := jobInput(ns, id)
+		if err != nil || !meta.KeepInput || path == "" {
+			httpError(w, "Input not available", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		serveFile(w, r, path)
+	case "artifacts", "artifacts/*":
+		serveArtifacts(w, r, ns, id, artifact)
+	}
+}
+
+// cancelJob stops a running job by signalling its process group, with SIGKILL
+// or the signal named by ?signal=. A job that hasn't started yet is marked
+// CANCELED straight away; if it is still in the queue the worker skips it.
+func cancelJob(w http.ResponseWriter, r *http.Request, ns, id string) {
+	sig := syscall.SIGKILL
+	if name := r.URL.Query().Get("signal"); name != "" {
+		var ok bool
+		if sig, ok = cancelSignals[strings.TrimPrefix(strings.ToUpper(name), "SIG")]; !ok {
+			httpError(w, "signal must be one of TERM, KILL, INT or HUP", http.StatusBadRequest)
+			return
+		}
+	}
+	mu.Lock()
+	meta, err := loadMeta(ns, id)
+	if err != nil {
+		mu.Unlock()
+		httpError(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	if job, ok := runningJobs[id]; ok {
+		job.signal = sig
+		job.Cancel()
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	switch meta.Status {
+	case "IN_QUEUE", "HELD", "SCHEDULED", "WAITING":
+	default:
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	meta.Status = "CANCELED"
+	meta.CompletedAt = time.Now()
+	saveMeta(meta)
+	mu.Unlock()
+	queue.Remove(id)
+
+	releaseInput(meta)
+	os.RemoveAll(filepath.Join(getJobDir(ns, id), "files"))
+	jobFinished(meta)
+	slog.InfoContext(r.Context(), "Canceled job before it started", "event", "job_cancel", "job_id", id)
+	if webhookWanted(meta) {
+		go sendWebhook(meta)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// releaseJob moves a HELD job into the queue.
+func releaseJob(w http.ResponseWriter, ns, id string) {
+	mu.Lock()
+	defer mu.Unlock()
+	meta, err := loadMeta(ns, id)
+	if err != nil {
+		httpError(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	if meta.Status != "HELD" {
+		httpError(w, "Job is not held", http.StatusConflict)
+		return
+	}
+	meta.Status = "IN_QUEUE"
+	saveMeta(meta)
+	notifyTransition(meta)
+	queue.Push(&queuedJob{meta: meta, inputFilePath: stagedInput(id)})
+	w.WriteHeader(http.StatusOK)
+}
+
+// rerunJob creates a new job from a finished one, with the same command,
+// settings, environment and stdin input. It fails with 409 if the original
+// input or uploaded files have already been cleaned up.
+func rerunJob(w http.ResponseWriter, r *http.Request, ns, id string) {
+	if shuttingDown.Load() {
+		httpError(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	meta, err := loadMeta(ns, id)
+	if err != nil {
+		httpError(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	if !isTerminal(meta.Status) {
+		httpError(w, "Job has not finished", http.StatusConflict)
+		return
+	}
+	if len(meta.Files) > 0 {
+		httpError(w, "Uploaded files of the job are no longer available", http.StatusConflict)
+		return
+	}
+	var input io.Reader
+	if meta.HasInput && meta.StdinFromJob == "" {
+		f, err := os.Open(jobInput(ns, id))
+		if err != nil {
+			httpError(w, "Input of the job is no longer available", http.StatusConflict)
+			return
+		}
+		defer f.Close()
+		input = f
+	}
+	if queueFull(w, 1) {
+		return
+	}
+	var env map[string]string
+	if len(meta.EnvKeys) > 0 {
+		if env, err = loadJobEnv(ns, id); err != nil {
+			httpError(w, "Failed to load job environment", http.StatusInternalServerError)
+			return
+		}
+	}
+	var webhookHeaders map[string]string
+	if len(meta.WebhookHeaders) > 0 {
+		if webhookHeaders, err = loadWebhookHeaders(ns, id); err != nil {
+			httpError(w, "Failed to load webhook headers", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// meta.Args already includes the fixed command, so none is passed below.
+	req := &jobRequest{
+		Args:           meta.Args,
+		MimeType:       meta.MimeType,
+		Webhook:        meta.Webhook,
+		WebhookEvents:  meta.WebhookEvents,
+		WebhookMethod:  meta.WebhookMethod,
+		WebhookHeaders: webhookHeaders,
+		Timeout:        meta.Timeout,
+		IdleTimeout:    meta.IdleTimeout,
+		MaxOutputBytes: meta.MaxOutputBytes,
+		MaxRetries:     meta.MaxRetries,
+		Priority:       meta.Priority,
+		Env:            env,
+		Cwd:            meta.Cwd,
+		Namespace:      ns,
+		RunAsUser:      meta.RunAsUser,
+		Labels:         meta.Labels,
+		KeepInput:      meta.KeepInput,
+		ExpiresAfter:   meta.ExpiresAfter,
+		Nice:           meta.Nice,
+		MemoryLimitMB:  meta.MemoryLimitMB,
+		Weight:         meta.Weight,
+		StdinFromJob:   meta.StdinFromJob,
+		OutputFiles:    meta.OutputFiles,
+		rerunOf:        id,
+	}
+	rerun, err := createJob(r.Context(), req, input, nil)
+	if err != nil {
+		writeRequestError(w, err)
+		return
+	}
+	slog.InfoContext(r.Context(), "Job rerun", "event", "job_rerun", "job_id", rerun.ID, "rerun_of", id)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(jobLinks(rerun))
+}
+
+// serveResultTail serves the last ?bytes=N bytes of a completed job's stdout,
+// or the whole output if it is shorter than that.
+func serveResultTail(w http.ResponseWriter, r *http.Request, ns, id string) {
+	n, err := strconv.ParseInt(r.URL.Query().Get("bytes"), 10, 64)
+	if err != nil || n < 0 {
+		httpError(w, "bytes must be a non-negative integer", http.StatusBadRequest)
+		return
+	}
+	meta, err := loadMeta(ns, id)
+	if err != nil || meta.Status != "COMPLETED" {
+		httpError(w, "Result not available", http.StatusNotFound)
+		return
+	}
+	f, err := openOutput(getJobDir(ns, id), "stdout")
+	if err != nil {
+		httpError(w, "Result not available", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	n = min(n, f.Size())
+	if _, err := f.Seek(-n, io.SeekEnd); err != nil {
+		httpError(w, "Failed to read result", http.StatusInternalServerError)
+		return
+	}
+	contentType := meta.MimeType
+	if contentType == "" {
+		contentType = "text/plain; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(n, 10))
+	io.CopyN(w, f, n)
+}
+
+// serveLogLines serves the last ?lines=N lines of a job's stderr. The log is
+// read backward from the end, so only the tail is touched however large it
+// is; with fewer than N lines all of it is served.
+func serveLogLines(w http.ResponseWriter, r *http.Request, ns, id string) {
+	n, err := strconv.Atoi(r.URL.Query().Get("lines"))
+	if err != nil || n < 0 {
+		httpError(w, "lines must be a non-negative integer", http.StatusBadRequest)
+		return
+	}
+	f, err := openOutput(getJobDir(ns, id), "stderr")
+	if err != nil {
+		httpError(w, "Log not available", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	start, err := lastLinesOffset(f, f.Size(), n)
+	if err != nil {
+		httpError(w, "Failed to read log", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.FormatInt(f.Size()-start, 10))
+	if r.Method == http.MethodHead {
+		return
+	}
+	io.Copy(w, io.NewSectionReader(f, start, f.Size()-start))
+}
+
+// lastLinesOffset returns the offset at which the last n lines of the size
+// bytes in ra start. A final line without a newline counts as a line.
+func lastLinesOffset(ra io.ReaderAt, size int64, n int) (int64, error) {
+	if n == 0 {
+		return size, nil
+	}
+	buf := make([]byte, 32<<10)
+	end := size
+	// The newline ending the last line doesn't start another one.
+	if end > 0 {
+		if _, err := ra.ReadAt(buf[:1], end-1); err != nil {
+			return 0, err
+		}
+		if buf[0] == '\n' {
+			end--
+		}
+	}
+	for end > 0 {
+		start := max(end-int64(len(buf)), 0)
+		chunk := buf[:end-start]
+		if _, err := ra.ReadAt(chunk, start); err != nil && err != io.EOF {
+			return 0, err
+		}
+		for i := len(chunk) - 1; i >= 0; i-- {
+			if chunk[i] != '\n' {
+				continue
+			}
+			if n--; n == 0 {
+				return start + int64(i) + 1, nil
+			}
+		}
+		end = start
+	}
+	return 0, nil
+}
+
+// serveJSONResult serves a completed job's stdout as application/json after
+// checking that it holds a single valid JSON document (422 otherwise). Jobs
+// whose mime_type says the output is something other than JSON get 406.
+func serveJSONResult(w http.ResponseWriter, r *http.Request, ns, id string) {
+	meta, err := loadMeta(ns, id)
+	if err != nil || meta.Status != "COMPLETED" {
+		httpError(w, "Result not available", http.StatusNotFound)
+		return
+	}
+	if meta.MimeType != "" && !isJSONMimeType(meta.MimeType) {
+		httpError(w, "Result is not JSON (mime_type is "+meta.MimeType+")", http.StatusNotAcceptable)
+		return
+	}
+	f, err := openOutput(getJobDir(ns, id), "stdout")
+	if err != nil {
+		httpError(w, "Result not available", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	if !isSingleJSONValue(f) {
+		httpError(w, "Result is not valid JSON", http.StatusUnprocessableEntity)
+		return
+	}
+	f.Seek(0, io.SeekStart)
+	w.Header().Set("Content-Type", "application/json")
+	serveContent(w, r, "stdout.txt", f.Size(), f.ModTime(), f)
+}
+
+func isJSONMimeType(mimeType string) bool {
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	return err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"))
+}
+
+// isSingleJSONValue reports whether r holds exactly one JSON value. It walks
+// the tokens rather than decoding, so large results aren't held in memory.
+func isSingleJSONValue(r io.Reader) bool {
+	dec := json.NewDecoder(r)
+	depth, values := 0, 0
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return values == 1 && depth == 0
+		}
+		if err != nil || (depth == 0 && values == 1) {
+			return false
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			values++
+		}
+	}
+}
+
+// streamJob sends a job's stderr (and stdout with ?stdout=true) as
+// Server-Sent Events, one "stderr"/"stdout" event per line, as the files grow.
+// A final "done" event carrying the job status is sent once the job reaches a
+// terminal state, after which the stream is closed.
+func streamJob(w http.ResponseWriter, r *http.Request, ns, id string) {
+	jobDir := getJobDir(ns, id)
+	if _, err := os.Stat(jobDir); err != nil {
+		httpError(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		httpError(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	noWriteTimeout(w)
+
+	tails := []*logTail{{event: "stderr", dir: jobDir, name: "stderr"}}
+	if r.URL.Query().Get("stdout") == "true" {
+		tails = append(tails, &logTail{event: "stdout", dir: jobDir, name: "stdout"})
+	}
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		// Check the status before reading so output written just before the
+		// job finished is still sent.
+		meta, err := loadMeta(ns, id)
+		done := err == nil && isTerminal(meta.Status)
+		for _, t := range tails {
+			t.poll(w, done)
+		}
+		if done {
+			writeEvent(w, "done", []byte(meta.Status))
+			flusher.Flush()
+			return
+		}
+		flusher.Flush()
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// streamJSONLines follows a job's stdout like streamJob, for commands that
+// print one JSON document per line. Each valid line is sent as a "record"
+// event; a line that isn't valid JSON is sent as an "invalid" event carrying
+// its line number, an error message and the raw text, so bad records are
+// visible instead of being dropped. Blank lines are skipped. A final "done"
+// event carries the job status.
+func streamJSONLines(w http.ResponseWriter, r *http.Request, ns, id string) {
+	jobDir := getJobDir(ns, id)
+	if _, err := os.Stat(jobDir); err != nil {
+		httpError(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		httpError(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	noWriteTimeout(w)
+
+	lineNo := 0
+	tail := &logTail{dir: jobDir, name: "stdout", emit: func(w io.Writer, line []byte) {
+		lineNo++
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if len(bytes.TrimSpace(line)) == 0 {
+			return
+		}
+		if json.Valid(line) {
+			writeEvent(w, "record", line)
+			return
+		}
+		msg, _ := json.Marshal(map[string]any{"line": lineNo, "error": "invalid JSON", "text": string(line)})
+		writeEvent(w, "invalid", msg)
+	}}
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		meta, err := loadMeta(ns, id)
+		done := err == nil && isTerminal(meta.Status)
+		tail.poll(w, done)
+		if done {
+			writeEvent(w, "done", []byte(meta.Status))
+			flusher.Flush()
+			return
+		}
+		flusher.Flush()
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// logTail follows a growing job output, remembering how far it has been
+// read. Offsets count from the start of the output, so rotation doesn't
+// disturb them.
+type logTail struct {
+	event   string
+	dir     string
+	name    string
+	offset  int64
+	partial []byte
+	// emit, if set, is called for each line instead of sending it as an
+	// event named event.
+	emit func(w io.Writer, line []byte)
+}
+
+func (t *logTail) send(w io.Writer, line []byte) {
+	if t.emit != nil {
+		t.emit(w, line)
+		return
+	}
+	writeEvent(w, t.event, line)
+}
+
+// poll writes every complete line appended to the file since the last call as
+// an event. A trailing partial line is held back until it is completed, unless
+// final is set.
+func (t *logTail) poll(w io.Writer, final bool) {
+	f, err := openOutput(t.dir, t.name)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	if _, err := f.Seek(t.offset, io.SeekStart); err != nil {
+		return
+	}
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			t.offset += int64(n)
+			data := append(t.partial, buf[:n]...)
+			for {
+				i := bytes.IndexByte(data, '\n')
+				if i < 0 {
+					break
+				}
+				t.send(w, data[:i])
+				data = data[i+1:]
+			}
+			t.partial = append([]byte(nil), data...)
+		}
+		if err != nil {
+			break
+		}
+	}
+	if final && len(t.partial) > 0 {
+		t.send(w, t.partial)
+		t.partial = nil
+	}
+}
+
+func writeEvent(w io.Writer, event string, data []byte) {
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+}
+
+// recoverJobs re-enqueues jobs left IN_QUEUE by a previous run of the server,
+// oldest first, and reschedules SCHEDULED ones. Jobs found IN_PROGRESS lost
+// their process when the server went away, so they are marked FAILED.
+func recoverJobs() {
+	var pending, waiting []*JobMeta
+	for _, meta := range loadAllMetas() {
+		if !isTerminal(meta.Status) {
+			adoptLegacyInput(meta)
+		}
+		switch meta.Status {
+		case "IN_QUEUE":
+			pending = append(pending, meta)
+		case "SCHEDULED":
+			if meta.RunAt != nil {
+				scheduleJob(meta.Namespace, meta.ID, *meta.RunAt)
+			}
+		case "WAITING":
+			waiting = append(waiting, meta)
+		case "IN_PROGRESS":
+			meta.Status = "FAILED"
+			meta.PID = 0
+			meta.CompletedAt = time.Now()
+			meta.Error = "server restarted while the job was running"
+			saveMeta(meta)
+			jobFinished(meta)
+			if webhookWanted(meta) {
+				go sendWebhook(meta)
+			}
+		default:
+			if isTerminal(meta.Status) {
+				scheduleExpiry(meta)
+			}
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].EnqueuedAt.Before(pending[j].EnqueuedAt)
+	})
+	for _, meta := range pending {
+		queue.Push(&queuedJob{meta: meta, inputFilePath: stagedInput(meta.ID)})
+	}
+	if len(pending) > 0 {
+		slog.Info("Recovered queued jobs", "event", "jobs_recovered", "count", len(pending))
+	}
+	for _, meta := range waiting {
+		waitForDependencies(meta)
+	}
+}
+
+// getInputDir returns the directory stdin inputs are staged in until their
+// job has run: INPUT_TMP_DIR, or .input inside the jobs directory so inputs
+// share a filesystem with the job directories they may be moved into.
+func getInputDir() string {
+	if dir := os.Getenv("INPUT_TMP_DIR"); dir != "" {
+		return dir
+	}
+	return filepath.Join(getJobsDir(), ".input")
+}
+
+// inputPath returns where a job's stdin input is staged until the job has run.
+func inputPath(id string) string {
+	return filepath.Join(getInputDir(), "input-"+id+".tmp")
+}
+
+// adoptLegacyInput moves the input of a job queued by an older server, which
+// staged inputs in the system temp directory, to where it is looked for now.
+func adoptLegacyInput(meta *JobMeta) {
+	legacy := filepath.Join(os.TempDir(), "input-"+meta.ID+".tmp")
+	if !meta.HasInput || legacy == inputPath(meta.ID) || stagedInput(meta.ID) != "" {
+		return
+	}
+	if err := moveFile(legacy, inputPath(meta.ID)); err != nil && !os.IsNotExist(err) {
+		slog.Warn("Failed to move staged input", "event", "job_input_error", "job_id", meta.ID, "error", err)
+	}
+}
+
+// stagedInput returns the path of a job's staged input, or "" if it has none.
+func stagedInput(id string) string {
+	path := inputPath(id)
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
+
+// releaseInput disposes of the staged input of a job that has finished: with
+// keep_input it is moved into the job directory as input.dat, otherwise it is
+// deleted.
+func releaseInput(meta *JobMeta) {
+	path := inputPath(meta.ID)
+	if !meta.KeepInput {
+		os.Remove(path)
+		return
+	}
+	dst := filepath.Join(getJobDir(meta.Namespace, meta.ID), "input.dat")
+	if err := moveFile(path, dst); err != nil && !os.IsNotExist(err) {
+		slog.Warn("Failed to keep job input", "event", "job_input_error", "job_id", meta.ID, "error", err)
+	}
+}
+
+// jobInput returns the path of a job's input: the kept input.dat of a
+// finished job, or the staged input of one that hasn't run yet. It returns ""
+// if there is neither.
+func jobInput(ns, id string) string {
+	kept := filepath.Join(getJobDir(ns, id), "input.dat")
+	if _, err := os.Stat(kept); err == nil {
+		return kept
+	}
+	return stagedInput(id)
+}
+
+// moveFile renames src to dst, copying it instead when they are on different
+// filesystems (INPUT_TMP_DIR may be elsewhere).
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
+
+// deleteJob removes a job's directory along with its meta, result and log.
+// Jobs that are queued or running cannot be deleted.
+func deleteJob(w http.ResponseWriter, ns, id string) {
+	meta, err := loadMeta(ns, id)
+	if err != nil || meta.ID != id {
+		httpError(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	mu.Lock()
+	_, running := runningJobs[id]
+	mu.Unlock()
+	if running || meta.Status == "IN_QUEUE" || meta.Status == "IN_PROGRESS" {
+		httpError(w, "Job is still running", http.StatusConflict)
+		return
+	}
+	if err := removeJob(ns, id); err != nil {
+		httpError(w, "Failed to delete job", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// removeJob deletes a job that isn't running: its metadata, its directory
+// and any staged input. Waiters and dependent jobs are told it is gone.
+func removeJob(ns, id string) error {
+	if err := deleteStoredJob(ns, id); err != nil {
+		return err
+	}
+	notifyFinished(id)
+	dependencyFinished(id)
+	return nil
+}
+
+// deleteStoredJob is the part of removeJob that may run under mu: it deletes
+// the job without telling anyone, as dependent jobs are checked under mu.
+func deleteStoredJob(ns, id string) error {
+	if err := store.Delete(ns, id); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(getJobDir(ns, id)); err != nil {
+		return err
+	}
+	os.Remove(inputPath(id))
+	return nil
+}
+
+// workerLoop runs queued jobs, never allowing the weights of the jobs
+// executing at once to add up to more than MAX_CONCURRENT_JOBS slots. A slot
+// is claimed before a job is taken off the queue, so the job picked is the
+// highest-priority one waiting when the slot opened. A heavier job then waits
+// for the rest of its slots, holding up the jobs behind it so that a stream
+// of light jobs can't starve it. A job waiting for slots stays IN_QUEUE.
+func workerLoop() {
+	slots := newSlotPool(getMaxConcurrentJobs())
+	workerRunning.Store(true)
+	for {
+		slots.acquire(1)
+		qj := queue.Pop()
+		if shuttingDown.Load() {
+			// Leave the job IN_QUEUE on disk for the next start.
+			return
+		}
+		weight := slots.weight(qj.meta)
+		slots.acquire(weight - 1)
+		ctx, cancel, ok := claimJob(qj.meta)
+		if !ok {
+			slots.release(weight)
+			continue
+		}
+		activeJobs.Add(1)
+		go func(qj *queuedJob) {
+			defer activeJobs.Done()
+			defer slots.release(weight)
+			defer cancel()
+			runJob(ctx, qj.meta, qj.inputFilePath)
+		}(qj)
+	}
+}
+
+// claimJob checks that a job taken off the queue is still IN_QUEUE on disk,
+// since it may have been canceled while it waited, and registers it as running
+// so that cancel requests reach it from then on. The returned context is
+// canceled by such a request.
+func claimJob(meta *JobMeta) (context.Context, context.CancelFunc, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	current, err := loadMeta(meta.Namespace, meta.ID)
+	if err != nil || current.Status != "IN_QUEUE" {
+		slog.Debug("Skipping job that is no longer queued", "event", "job_skip", "job_id", meta.ID)
+		return nil, nil, false
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	runningJobs[meta.ID] = &RunningJob{Meta: meta, Cancel: cancel, signal: syscall.SIGKILL}
+	return ctx, cancel, true
+}
+
+func runJob(ctx context.Context, meta *JobMeta, inputFilePath string) {
+	var cmd *exec.Cmd
+	defer func() {
+		if p := recover(); p != nil {
+			failPanickedJob(meta, cmd, inputFilePath, p)
+		}
+	}()
+	jobDir := getJobDir(meta.Namespace, meta.ID)
+	if meta.Timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, time.Duration(meta.Timeout)*time.Second)
+		defer cancelTimeout()
+	}
+	// The idle watchdog and the output limit stop the job with a cause that
+	// tells the outcome apart from a plain cancel.
+	ctx, cancelCause := context.WithCancelCause(ctx)
+	defer cancelCause(nil)
+	var watchdog *idleWatchdog
+	if meta.IdleTimeout > 0 {
+		watchdog = newIdleWatchdog(time.Duration(meta.IdleTimeout) * time.Second)
+	}
+
+	meta.Attempt++
+	args := expandFilePlaceholders(meta.Args, jobDir)
+	if len(args) > 0 {
+		cmd = exec.CommandContext(ctx, args[0], args[1:]...)
+	} else {
+		// Submissions always have a command, but a job recovered from a
+		// damaged or hand-edited meta file might not. Start then fails and the
+		// job is marked FAILED like any other command that can't be started.
+		cmd = exec.CommandContext(ctx, "")
+		cmd.Err = errors.New("job has no command (args is empty)")
+	}
+	// Run the job in its own process group and signal the whole group when it
+	// is canceled or times out, so child processes don't outlive it.
+	setProcessGroup(cmd)
+	cmd.Cancel = func() error {
+		mu.Lock()
+		job := runningJobs[meta.ID]
+		sig := syscall.SIGKILL
+		if job != nil {
+			sig = job.signal
+		}
+		mu.Unlock()
+		if sig != syscall.SIGKILL {
+			// Give the job killGracePeriod to exit on its own before the group
+			// is killed.
+			time.AfterFunc(killGracePeriod(), func() {
+				mu.Lock()
+				defer mu.Unlock()
+				if runningJobs[meta.ID] == job {
+					signalProcessGroup(cmd.Process.Pid, syscall.SIGKILL)
+				}
+			})
+		}
+		return signalProcessGroup(cmd.Process.Pid, sig)
+	}
+	stdoutFile, err := createOutput(jobDir, "stdout")
+	if err != nil {
+		slog.Warn("Failed to create output file", "event", "job_output_error", "job_id", meta.ID, "error", err)
+		stdoutFile = nopWriteCloser{io.Discard}
+	}
+	stderrFile, err := createOutput(jobDir, "stderr")
+	if err != nil {
+		slog.Warn("Failed to create output file", "event", "job_output_error", "job_id", meta.ID, "error", err)
+		stderrFile = nopWriteCloser{io.Discard}
+	}
+	cmd.Stdout = stdoutFile
+	cmd.Stderr = stderrFile
+	var combined *combinedLog
+	if os.Getenv("COMBINED_LOG") == "1" {
+		if f, err := os.Create(filepath.Join(jobDir, "combined.txt")); err == nil {
+			combined = newCombinedLog(f)
+			cmd.Stdout = io.MultiWriter(stdoutFile, combined.Stream("stdout"))
+			cmd.Stderr = io.MultiWriter(stderrFile, combined.Stream("stderr"))
+		}
+	}
+	if limit := outputLimit(meta); limit > 0 {
+		limiter := &outputLimiter{limit: limit, cancel: cancelCause}
+		cmd.Stdout = limiter.Wrap(cmd.Stdout)
+		cmd.Stderr = limiter.Wrap(cmd.Stderr)
+	}
+	if watchdog != nil {
+		cmd.Stdout = watchdog.Wrap(cmd.Stdout)
+		cmd.Stderr = watchdog.Wrap(cmd.Stderr)
+	}
+	// What the server creates in the job directory for the job to write,
+	// which a job running as another user is given.
+	var jobWritable []string
+	cmd.Dir = meta.Cwd
+	// Without a cwd, a job that declares output_files runs in a scratch
+	// directory inside its job directory, where the files are collected from.
+	if cmd.Dir == "" && len(meta.OutputFiles) > 0 {
+		cmd.Dir = workDir(jobDir)
+		if err := os.MkdirAll(cmd.Dir, 0755); err != nil {
+			slog.Warn("Failed to create work directory", "event", "job_workdir_error", "job_id", meta.ID, "error", err)
+		}
+		jobWritable = append(jobWritable, cmd.Dir)
+	}
+	if len(meta.EnvKeys) > 0 {
+		env, err := loadJobEnv(meta.Namespace, meta.ID)
+		if err != nil {
+			slog.Warn("Failed to load job environment", "event", "job_env_error", "job_id", meta.ID, "error", err)
+		}
+		cmd.Env = os.Environ()
+		for _, k := range sortedKeys(env) {
+			cmd.Env = append(cmd.Env, k+"="+env[k])
+		}
+	}
+	// A retried job starts without the progress of its previous attempt: the
+	// file is created anew and empty, as a job running as another user can't
+	// create it in the job directory itself. The path is made absolute since
+	// the command may run in another directory.
+	progressFile, err := filepath.Abs(progressPath(jobDir))
+	if err == nil {
+		os.Remove(progressFile)
+		if f, err := os.OpenFile(progressFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644); err == nil {
+			f.Close()
+			jobWritable = append(jobWritable, progressFile)
+		}
+		if cmd.Env == nil {
+			cmd.Env = os.Environ()
+		}
+		cmd.Env = append(cmd.Env, "JOB_PROGRESS_FILE="+progressFile)
+	}
+
+	// If input file exists, use it as stdin
+	if inputFilePath != "" {
+		inFile, err := os.Open(inputFilePath)
+		if err == nil {
+			cmd.Stdin = inFile
+			defer inFile.Close()
+		}
+	}
+
+	slog.Debug("Running command", "event", "job_start", "job_id", meta.ID, "args", cmd.Args)
+
+	startErr := setCredential(cmd, meta.RunAsUser)
+	if startErr == nil {
+		startErr = chownToJobUser(cmd, jobWritable...)
+	}
+	if startErr == nil && meta.MemoryLimitMB > 0 {
+		// If the limit can't be applied the job fails to start rather than
+		// run unconstrained.
+		if err := limitMemory(cmd, uint64(meta.MemoryLimitMB)<<20); err != nil {
+			startErr = fmt.Errorf("%w: %v", errMemoryLimit, err)
+		}
+	}
+	if startErr == nil {
+		startErr = cmd.Start()
+	}
+	if startErr != nil {
+		// The command never ran, e.g. because args[0] isn't an executable.
+		// The reason goes into stderr.txt as well as the metadata, so the log
+		// endpoint explains the failure. Retrying wouldn't help, so the job
+		// fails for good. It stays in runningJobs until finishRun records the
+		// outcome, so a cancel request can't write CANCELED in between only to
+		// have it overwritten.
+		status := "FAILED"
+		meta.StatusDetail = "start_failed"
+		meta.Error = "failed to start command: " + startErr.Error()
+		if ctx.Err() == context.Canceled {
+			status = "CANCELED"
+			meta.StatusDetail = ""
+		}
+		fmt.Fprintln(stderrFile, meta.Error)
+		stdoutFile.Close()
+		stderrFile.Close()
+		combined.Close()
+		if inputFilePath != "" {
+			releaseInput(meta)
+		}
+		if len(meta.Files) > 0 {
+			os.RemoveAll(filepath.Join(jobDir, "files"))
+		}
+		meta.StartedAt = time.Now()
+		meta.CompletedAt = meta.StartedAt
+		finishRun(meta, status)
+		moveToDeadLetter(meta)
+		jobFinished(meta)
+		slog.Info("Job failed to start", "event", "job_start_failed", "job_id", meta.ID, "status", meta.Status, "error", startErr)
+		if webhookWanted(meta) {
+			go sendWebhook(meta)
+		}
+		return
+	}
+	meta.PID = cmd.Process.Pid
+	if meta.Nice != 0 {
+		if err := setNiceness(meta.PID, meta.Nice); err != nil {
+			slog.Warn("Failed to set job niceness", "event", "job_nice_error", "job_id", meta.ID, "nice", meta.Nice, "error", err)
+		}
+	}
+	meta.Status = "IN_PROGRESS"
+	meta.StartedAt = time.Now()
+	saveMeta(meta)
+	notifyTransition(meta)
+
+	mu.Lock()
+	runningJobs[meta.ID].Cmd = cmd
+	mu.Unlock()
+	if watchdog != nil {
+		go watchdog.Watch(ctx, cancelCause)
+	}
+
+	err = cmd.Wait()
+	meta.CompletedAt = time.Now()
+
+	stdoutFile.Close()
+	stderrFile.Close()
+	combined.Close()
+
+	// ExitCode is -1 when the process was killed by a signal, which includes
+	// cancellation and timeouts.
+	exitCode := 0
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		exitCode = exitErr.ExitCode()
+	} else if err != nil {
+		exitCode = -1
+	}
+	meta.ExitCode = &exitCode
+	recordUsage(meta, cmd.ProcessState)
+
+	if ctx.Err() == context.DeadlineExceeded {
+		meta.Status = "TIMEOUT"
+	} else if context.Cause(ctx) == errIdleTimeout {
+		meta.Status = "TIMEOUT"
+		meta.Error = fmt.Sprintf("no output for %d seconds", meta.IdleTimeout)
+	} else if context.Cause(ctx) == errOutputLimit {
+		meta.Status = "OUTPUT_LIMIT_EXCEEDED"
+		meta.Error = fmt.Sprintf("output exceeded %d bytes", outputLimit(meta))
+	} else if ctx.Err() == context.Canceled {
+		meta.Status = "CANCELED"
+		if shuttingDown.Load() {
+			meta.Error = "canceled by server shutdown"
+		}
+	} else if err != nil {
+		meta.Status = "FAILED"
+		// Allocations past the limit simply fail, and how a command reacts
+		// to that varies, so running out of memory can only be suggested.
+		if meta.MemoryLimitMB > 0 {
+			meta.Error = fmt.Sprintf("command failed while limited to %d MB of memory (memory_limit_mb); it may have run out of memory", meta.MemoryLimitMB)
+		}
+	} else {
+		meta.Status = "COMPLETED"
+	}
+
+	// A failed job with attempts left goes back to the queue after a backoff
+	// delay; it only notifies the webhook if IN_QUEUE is in webhook_events.
+	if meta.Status == "FAILED" && meta.Attempt <= meta.MaxRetries {
+		delay := retryBackoff(meta.Attempt)
+		finishRun(meta, "IN_QUEUE")
+		notifyTransition(meta)
+		slog.Info("Retrying job", "event", "job_retry", "job_id", meta.ID, "attempt", meta.Attempt,
+			"max_retries", meta.MaxRetries, "delay_ms", delay.Milliseconds())
+		time.AfterFunc(delay, func() {
+			queue.Push(&queuedJob{meta: meta, inputFilePath: inputFilePath})
+		})
+		return
+	}
+
+	// Remove (or keep, with keep_input) the input and remove uploaded files
+	// after the job completes
+	if inputFilePath != "" {
+		releaseInput(meta)
+	}
+	if len(meta.Files) > 0 {
+		os.RemoveAll(filepath.Join(jobDir, "files"))
+	}
+	if meta.Status == "COMPLETED" && len(meta.OutputFiles) > 0 {
+		collectArtifacts(meta, jobDir, cmd.Dir)
+	}
+	if meta.Cwd == "" && len(meta.OutputFiles) > 0 {
+		os.RemoveAll(workDir(jobDir))
+	}
+	if compressLogs() {
+		compressOutputs(meta.ID, jobDir)
+	}
+	finishRun(meta, meta.Status)
+	moveToDeadLetter(meta)
+	jobFinished(meta)
+
+	slog.Info("Job finished", "event", "job_finish", "job_id", meta.ID, "status", meta.Status,
+		"duration_ms", meta.CompletedAt.Sub(meta.StartedAt).Milliseconds())
+
+	if webhookWanted(meta) {
+		slog.Debug("Triggering webhook", "event", "webhook", "job_id", meta.ID, "status", meta.Status, "url", meta.Webhook)
+		go sendWebhook(meta)
+	}
+}
+
+// failPanickedJob cleans up after a panic in runJob, so a bug hit by one job
+// can't take down the server or leave the job looking like it is still
+// running. The job is marked FAILED with the panic in its error and log,
+// unless it had already finished, and its process group is killed if the
+// command is still running. The worker's slot is freed when runJob returns.
+func failPanickedJob(meta *JobMeta, cmd *exec.Cmd, inputFilePath string, p any) {
+	slog.Error("Job runner panicked", "event", "job_panic", "job_id", meta.ID, "panic", fmt.Sprint(p), "stack", string(debug.Stack()))
+	if cmd != nil && cmd.Process != nil && cmd.ProcessState == nil {
+		signalProcessGroup(cmd.Process.Pid, syscall.SIGKILL)
+		go cmd.Wait()
+	}
+	mu.Lock()
+	_, running := runningJobs[meta.ID]
+	mu.Unlock()
+	if !running {
+		return
+	}
+	meta.Error = fmt.Sprintf("internal error while running job: %v", p)
+	if f, err := os.OpenFile(filepath.Join(getJobDir(meta.Namespace, meta.ID), "stderr.txt"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err == nil {
+		fmt.Fprintln(f, meta.Error)
+		f.Close()
+	}
+	if inputFilePath != "" {
+		releaseInput(meta)
+	}
+	meta.PID = 0
+	if meta.StartedAt.IsZero() {
+		meta.StartedAt = time.Now()
+	}
+	meta.CompletedAt = time.Now()
+	finishRun(meta, "FAILED")
+	moveToDeadLetter(meta)
+	jobFinished(meta)
+	if webhookWanted(meta) {
+		go sendWebhook(meta)
+	}
+}
+
+// jobFinished does the bookkeeping for a job that has reached a terminal
+// state: metrics, waking /wait requests and releasing or failing the jobs that
+// depend on it.
+func jobFinished(meta *JobMeta) {
+	recordJobFinished(meta)
+	forgetContentHash(meta)
+	notifyFinished(meta.ID)
+	dependencyFinished(meta.ID)
+	scheduleExpiry(meta)
+}
+
+// finishRun records the outcome of a run and unregisters the job from
+// runningJobs in one step under mu. A cancel request therefore either still
+// reaches the running job, or finds the outcome on disk: a job going back to
+// the queue for a retry shows up as IN_QUEUE and is canceled before it runs
+// again.
+func finishRun(meta *JobMeta, status string) {
+	mu.Lock()
+	defer mu.Unlock()
+	meta.Status = status
+	saveMeta(meta)
+	delete(runningJobs, meta.ID)
+}
+
+// moveToDeadLetter moves the directory of a job that failed for good (FAILED
+// after its last retry, TIMEOUT or OUTPUT_LIMIT_EXCEEDED) into the dead-letter directory when
+// DEAD_LETTER=1, so failures can be inspected without cluttering /jobs.
+func moveToDeadLetter(meta *JobMeta) {
+	if os.Getenv("DEAD_LETTER") != "1" || !slices.Contains([]string{"FAILED", "TIMEOUT", "OUTPUT_LIMIT_EXCEEDED"}, meta.Status) {
+		return
+	}
+	src := filepath.Join(getNamespaceDir(meta.Namespace), meta.ID)
+	deadLetterDir := getDeadLetterDir(meta.Namespace)
+	if err := os.MkdirAll(deadLetterDir, 0755); err != nil {
+		slog.Warn("Failed to create dead-letter directory", "event", "dead_letter_error", "job_id", meta.ID, "error", err)
+		return
+	}
+	if err := os.Rename(src, filepath.Join(deadLetterDir, meta.ID)); err != nil {
+		slog.Warn("Failed to move job to dead-letter directory", "event", "dead_letter_error", "job_id", meta.ID, "error", err)
+		return
+	}
+	meta.DeadLetter = true
+	saveMeta(meta)
+	slog.Info("Moved job to dead-letter directory", "event", "dead_letter", "job_id", meta.ID, "status", meta.Status)
+}
+
+// killGracePeriod is how long a job canceled with a signal other than SIGKILL
+// gets to exit before its process group is killed (CANCEL_GRACE_PERIOD,
+// default 10s).
+func killGracePeriod() time.Duration {
+	return envDuration("CANCEL_GRACE_PERIOD", 10*time.Second)
+}
+
+// retryBackoff returns how long to wait before retrying a job that failed on
+// the given attempt: RETRY_BACKOFF (default 1s) doubled for every previous
+// attempt, capped at five minutes.
+func retryBackoff(attempt int) time.Duration {
+	delay := envDuration("RETRY_BACKOFF", time.Second)
+	for i := 1; i < attempt && delay < 5*time.Minute; i++ {
+		delay *= 2
+	}
+	return min(delay, 5*time.Minute)
+}
+
+// sweepLoop periodically deletes jobs that finished more than META_TTL ago,
+// and the output of jobs that finished more than RESULT_TTL ago, keeping
+// their metadata. It does nothing when neither is set. JOB_TTL is the older
+// name of META_TTL. Jobs with their own expires_after_seconds are left to
+// scheduleExpiry, except for RESULT_TTL.
+func sweepLoop() {
+	metaTTL := envDuration("META_TTL", envDuration("JOB_TTL", 0))
+	resultTTL := envDuration("RESULT_TTL", 0)
+	if metaTTL <= 0 && resultTTL <= 0 {
+		return
+	}
+	ticker := time.NewTicker(envDuration("JOB_SWEEP_INTERVAL", 10*time.Minute))
+	defer ticker.Stop()
+	for {
+		sweepJobs(metaTTL, resultTTL)
+		<-ticker.C
+	}
+}
+
+func sweepJobs(metaTTL, resultTTL time.Duration) {
+	now := time.Now()
+	removed, expired := 0, 0
+	for _, meta := range loadAllMetas() {
+		if !isTerminal(meta.Status) || meta.CompletedAt.IsZero() {
+			continue
+		}
+		if metaTTL > 0 && meta.ExpiresAfter == 0 && now.Sub(meta.CompletedAt) > metaTTL {
+			if err := removeJob(meta.Namespace, meta.ID); err != nil {
+				slog.Warn("Failed to delete expired job", "event", "sweep_error", "job_id", meta.ID, "error", err)
+				continue
+			}
+			removed++
+			continue
+		}
+		if resultTTL > 0 && meta.OutputExpiredAt == nil && now.Sub(meta.CompletedAt) > resultTTL {
+			if expireOutput(meta.Namespace, meta.ID) {
+				expired++
+			}
+		}
+	}
+	slog.Debug("Sweeper removed expired jobs", "event", "sweep", "count", removed, "outputs_expired", expired)
+}
+
+// expireOutput removes the output of a finished job, i.e. everything in its
+// directory but the metadata and the environment that rerun needs, and
+// records when in output_expired_at.
+func expireOutput(ns, id string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	meta, err := loadMeta(ns, id)
+	if err != nil || meta.OutputExpiredAt != nil {
+		return false
+	}
+	dir := getJobDir(ns, id)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+	for _, entry := range entries {
+		if name := entry.Name(); name != "meta.json" && name != "env.json" && name != "webhook_headers.json" {
+			os.RemoveAll(filepath.Join(dir, name))
+		}
+	}
+	now := time.Now()
+	meta.OutputExpiredAt = &now
+	saveMeta(meta)
+	return true
+}
+
+// jobStatuses are all the states a job can be in.
+var jobStatuses = []string{"IN_QUEUE", "IN_PROGRESS", "COMPLETED", "FAILED", "CANCELED", "TIMEOUT", "OUTPUT_LIMIT_EXCEEDED", "HELD", "SCHEDULED", "WAITING"}
+
+// isTerminal reports whether a job in the given status has finished for good.
+func isTerminal(status string) bool {
+	switch status {
+	case "COMPLETED", "FAILED", "CANCELED", "TIMEOUT", "OUTPUT_LIMIT_EXCEEDED":
+		return true
+	}
+	return false
+}
+
+// saveMeta stores an update to a job's meta. A job deleted in the meantime
+// stays deleted.
+func saveMeta(meta *JobMeta) {
+	err := store.Save(meta)
+	if errors.Is(err, os.ErrNotExist) {
+		slog.Debug("Not saving metadata of deleted job", "event", "store_skip", "job_id", meta.ID)
+	} else if err != nil {
+		slog.Warn("Failed to save job metadata", "event", "store_error", "job_id", meta.ID, "error", err)
+	}
+}
+
+func loadMeta(ns, id string) (*JobMeta, error) {
+	return store.Load(ns, id)
+}
+
+// webhookPayload is the JSON body POSTed to a job's webhook. URLs are
+// absolute when BASE_URL is set. Timestamps are omitted (null) when the job
+// never reached that stage; exit_code is null if the process never ran.
+type webhookPayload struct {
+	ID          string     `json:"id"`
+	Status      string     `json:"status"`
+	Args        []string   `json:"args"`
+	ExitCode    *int       `json:"exit_code"`
+	Error       string     `json:"error,omitempty"`
+	EnqueuedAt  time.Time  `json:"enqueued_at"`
+	StartedAt   *time.Time `json:"started_at"`
+	CompletedAt *time.Time `json:"completed_at"`
+	StatusURL   string     `json:"status_url"`
+	ResultURL   string     `json:"result_url"`
+	LogURL      string     `json:"log_url"`
+}
+
+// webhookWanted reports whether the job's webhook should fire for its current
+// status.
+func webhookWanted(meta *JobMeta) bool {
+	if meta.Webhook == "" {
+		return false
+	}
+	if len(meta.WebhookEvents) == 0 {
+		return isTerminal(meta.Status)
+	}
+	for _, event := range meta.WebhookEvents {
+		if event == meta.Status || (event == "terminal" && isTerminal(meta.Status)) {
+			return true
+		}
+	}
+	return false
+}
+
+// notifyTransition sends the webhook for a job that has just moved to a
+// non-terminal status, if webhook_events asks for it. It sends a snapshot, as
+// the job keeps changing, and doesn't record the delivery: webhook_delivered
+// and webhook_attempts are about the final notification.
+func notifyTransition(meta *JobMeta) {
+	if isTerminal(meta.Status) || !webhookWanted(meta) {
+		return
+	}
+	snapshot := *meta
+	go deliverWithRetry(&snapshot)
+}
+
+// sendWebhook sends the final webhook for a job and records the outcome of
+// the delivery in its meta. The delivery can take a while, so the outcome is
+// recorded on the meta as stored by then: changes made to the job in the
+// meantime are kept, and a job deleted in the meantime isn't saved again.
+func sendWebhook(meta *JobMeta) {
+	attempts, delivered, skipped := deliverWithRetry(meta)
+	mu.Lock()
+	defer mu.Unlock()
+	current, err := loadMeta(meta.Namespace, meta.ID)
+	if err != nil {
+		slog.Debug("Not recording webhook delivery of deleted job", "event", "webhook", "job_id", meta.ID)
+		return
+	}
+	current.WebhookAttempts, current.WebhookDelivered, current.WebhookSkipped = attempts, delivered, skipped
+	saveMeta(current)
+}
+
+// deliverWithRetry sends the webhook payload for meta, retrying with
+// exponential backoff until it succeeds or WEBHOOK_MAX_ATTEMPTS is reached. It
+// returns the number of attempts made, whether one succeeded and whether
+// delivery was given up on because the circuit breaker for the webhook's host
+// is open.
+func deliverWithRetry(meta *JobMeta) (int, bool, bool) {
+	payload := webhookPayload{
+		ID:         meta.ID,
+		Status:     meta.Status,
+		Args:       meta.Args,
+		ExitCode:   meta.ExitCode,
+		Error:      meta.Error,
+		EnqueuedAt: meta.EnqueuedAt,
+		StatusURL:  jobURL(meta.Namespace, meta.ID, "status"),
+		ResultURL:  jobURL(meta.Namespace, meta.ID, "result"),
+		LogURL:     jobURL(meta.Namespace, meta.ID, "log"),
+	}
+	if !meta.StartedAt.IsZero() {
+		payload.StartedAt = &meta.StartedAt
+	}
+	if !meta.CompletedAt.IsZero() {
+		payload.CompletedAt = &meta.CompletedAt
+	}
+	data, _ := json.Marshal(payload)
+	client := &http.Client{Timeout: envDuration("WEBHOOK_TIMEOUT", 10*time.Second)}
+	method := meta.WebhookMethod
+	if method == "" {
+		method = http.MethodPost
+	}
+	var headers map[string]string
+	if len(meta.WebhookHeaders) > 0 {
+		var err error
+		if headers, err = loadWebhookHeaders(meta.Namespace, meta.ID); err != nil {
+			slog.Warn("Failed to load webhook headers", "event", "webhook_failed", "job_id", meta.ID, "error", err)
+			return 0, false, false
+		}
+	}
+
+	host := webhookHost(meta.Webhook)
+	maxAttempts := max(envInt("WEBHOOK_MAX_ATTEMPTS", 5), 1)
+	delay := envDuration("WEBHOOK_BACKOFF", time.Second)
+	for attempt := 1; ; attempt++ {
+		if !breakerAllows(host) {
+			slog.Warn("Webhook skipped, circuit breaker open", "event", "webhook_skipped", "job_id", meta.ID,
+				"status", meta.Status, "host", host, "attempts", attempt-1)
+			return attempt - 1, false, true
+		}
+		err := deliverWebhook(client, method, meta.Webhook, headers, data)
+		if recordDelivery(host, err) {
+			slog.Warn("Webhook circuit breaker opened", "event", "webhook_breaker_open", "host", host)
+		}
+		if err == nil {
+			slog.Debug("Webhook delivered", "event", "webhook_delivered", "job_id", meta.ID,
+				"status", meta.Status, "attempt", attempt)
+			return attempt, true, false
+		}
+		if attempt >= maxAttempts {
+			slog.Warn("Webhook delivery failed", "event", "webhook_failed", "job_id", meta.ID,
+				"status", meta.Status, "attempts", attempt, "error", err)
+			return attempt, false, false
+		}
+		slog.Debug("Webhook attempt failed, retrying", "event", "webhook_retry", "job_id", meta.ID,
+			"attempt", attempt, "delay_ms", delay.Milliseconds(), "error", err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// deliverWebhook sends data to url with the given method and extra headers,
+// treating network errors and non-2xx responses as failures. The body is
+// application/json unless the headers say otherwise. When WEBHOOK_SECRET is
+// set the body is signed in an X-Signature-256 header.
+func deliverWebhook(client *http.Client, method, url string, headers map[string]string, data []byte) error {
+	req, err := http.NewRequest(method, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	if req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if secret := os.Getenv("WEBHOOK_SECRET"); secret != "" {
+		req.Header.Set("X-Signature-256", signPayload([]byte(secret), data))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// signPayload returns the HMAC-SHA256 of data keyed with secret, formatted as
+// "sha256=<hex>" like GitHub's X-Hub-Signature-256 header.
+func signPayload(secret, data []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(data)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// jobURL returns the URL of one of a job's endpoints, prefixed with BASE_URL
+// when it is set. Jobs outside the default namespace carry it in the query.
+func jobURL(ns, id, endpoint string) string {
+	u := os.Getenv("BASE_URL") + "/jobs/" + id + "/" + endpoint
+	if ns != "" {
+		u += "?namespace=" + url.QueryEscape(ns)
+	}
+	return u
+}
+
+// checkArgs validates a job's full command line: it must name a command, and
+// stay within MAX_ARGS arguments and MAX_ARGS_BYTES bytes in total (0
+// disables either limit).
+func checkArgs(args []string) error {
+	if len(args) == 0 || args[0] == "" {
+		return badRequest("args must contain at least the command to run")
+	}
+	if max := envInt("MAX_ARGS", 1024); max > 0 && len(args) > max {
+		return badRequest("Too many args: at most %d are allowed", max)
+	}
+	size := 0
+	for _, a := range args {
+		if strings.IndexByte(a, 0) >= 0 {
+			return badRequest("args must not contain NUL bytes")
+		}
+		size += len(a)
+	}
+	if max := envInt("MAX_ARGS_BYTES", 128<<10); max > 0 && size > max {
+		return badRequest("args are too long: at most %d bytes in total are allowed", max)
+	}
+	return nil
+}
+
+// commandAllowed reports whether cmd may be run. ALLOWED_COMMANDS is a
+// comma-separated list of permitted commands, matched exactly against args[0];
+// when it is empty any command is allowed.
+func commandAllowed(cmd string) bool {
+	allowed := os.Getenv("ALLOWED_COMMANDS")
+	if allowed == "" {
+		return true
+	}
+	for _, c := range strings.Split(allowed, ",") {
+		if strings.TrimSpace(c) == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+// fileRefPattern matches {{file:<name>}} placeholders in job args.
+var fileRefPattern = regexp.MustCompile(`\{\{file:([^{}]+)\}\}`)
+
+// referencedFiles returns the names of the uploaded files referenced by
+// {{file:<name>}} placeholders in args.
+func referencedFiles(args []string) []string {
+	var names []string
+	for _, arg := range args {
+		for _, m := range fileRefPattern.FindAllStringSubmatch(arg, -1) {
+			names = append(names, m[1])
+		}
+	}
+	return names
+}
+
+// expandFilePlaceholders returns a copy of args with every {{file:<name>}}
+// replaced by the absolute path of that uploaded file in the job directory.
+func expandFilePlaceholders(args []string, jobDir string) []string {
+	filesDir, _ := filepath.Abs(filepath.Join(jobDir, "files"))
+	out := make([]string, len(args))
+	for i, arg := range args {
+		out[i] = fileRefPattern.ReplaceAllStringFunc(arg, func(ref string) string {
+			return filepath.Join(filesDir, fileRefPattern.FindStringSubmatch(ref)[1])
+		})
+	}
+	return out
+}
+
+// validFileName reports whether name is safe to use as a file name inside a
+// job directory.
+func validFileName(name string) bool {
+	if name == "" || name == "." || name == ".." || len(name) > 128 {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// saveUploadedFiles copies the files uploaded with a submission into the
+// job's files directory.
+func saveUploadedFiles(jobDir string, files map[string]*multipart.FileHeader) error {
+	if len(files) == 0 {
+		return nil
+	}
+	dir := filepath.Join(jobDir, "files")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for name, fh := range files {
+		src, err := fh.Open()
+		if err != nil {
+			return err
+		}
+		dst, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			src.Close()
+			return err
+		}
+		_, err = io.Copy(dst, src)
+		src.Close()
+		if cerr := dst.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveJobCwd checks a requested working directory and returns its absolute,
+// symlink-free path. Working directories are only accepted when
+// ALLOWED_CWD_ROOT is set, and must be an existing directory inside that root;
+// relative paths are taken relative to the root.
+func resolveJobCwd(cwd string) (string, error) {
+	root := os.Getenv("ALLOWED_CWD_ROOT")
+	if root == "" {
+		return "", fmt.Errorf("Setting cwd is not allowed")
+	}
+	root, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", fmt.Errorf("ALLOWED_CWD_ROOT is not accessible")
+	}
+	root, _ = filepath.Abs(root)
+	if !filepath.IsAbs(cwd) {
+		cwd = filepath.Join(root, cwd)
+	}
+	dir, err := filepath.EvalSymlinks(cwd)
+	if err != nil {
+		return "", fmt.Errorf("cwd does not exist")
+	}
+	dir, _ = filepath.Abs(dir)
+	if rel, err := filepath.Rel(root, dir); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("cwd is outside the allowed root")
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return "", fmt.Errorf("cwd is not a directory")
+	}
+	return dir, nil
+}
+
+// defaultEnvBlocklist lists variables jobs may not set unless
+// JOB_ENV_BLOCKLIST overrides it, since they change which code gets executed.
+const defaultEnvBlocklist = "PATH,LD_PRELOAD,LD_LIBRARY_PATH,LD_AUDIT,DYLD_INSERT_LIBRARIES,DYLD_LIBRARY_PATH"
+
+// checkJobEnv validates the environment variables requested for a job.
+// Per-job variables must be enabled with ALLOW_JOB_ENV=1, and keys on the
+// blocklist (JOB_ENV_BLOCKLIST, or defaultEnvBlocklist when unset) are refused.
+func checkJobEnv(env map[string]string) error {
+	if os.Getenv("ALLOW_JOB_ENV") != "1" {
+		return &requestError{status: http.StatusForbidden, msg: "Per-job environment variables are not allowed"}
+	}
+	blocklist, ok := os.LookupEnv("JOB_ENV_BLOCKLIST")
+	if !ok {
+		blocklist = defaultEnvBlocklist
+	}
+	blocked := make(map[string]bool)
+	for _, k := range strings.Split(blocklist, ",") {
+		blocked[strings.TrimSpace(k)] = true
+	}
+	for k, v := range env {
+		if k == "" || strings.ContainsAny(k, "=\x00") || strings.ContainsRune(v, 0) {
+			return badRequest("Invalid environment variable %q", k)
+		}
+		if blocked[k] {
+			return &requestError{status: http.StatusForbidden, msg: fmt.Sprintf("Environment variable %s may not be set", k)}
+		}
+	}
+	return nil
+}
+
+// saveJobEnv stores a job's environment variables in env.json in its
+// directory. Only the keys go into meta.json; the values are kept apart, with
+// owner-only permissions, since they may hold secrets.
+func saveJobEnv(ns, id string, env map[string]string) error {
+	data, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(getJobDir(ns, id), "env.json"), data, 0600)
+}
+
+func loadJobEnv(ns, id string) (map[string]string, error) {
+	data, err := os.ReadFile(filepath.Join(getJobDir(ns, id), "env.json"))
+	if err != nil {
+		return nil, err
+	}
+	var env map[string]string
+	err = json.Unmarshal(data, &env)
+	return env, err
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// jobSummary is the per-job entry returned by GET /jobs.
+type jobSummary struct {
+	ID         string            `json:"id"`
+	Args       []string          `json:"args"`
+	Status     string            `json:"status"`
+	ResultURL  string            `json:"result_url"`
+	LogURL     string            `json:"log_url"`
+	EnqueuedAt string            `json:"enqueued_at"`
+	Labels     map[string]string `json:"labels,omitempty"`
+}
+
+// listJobs returns jobs newest first as {"total": n, "jobs": [...]}. The list
+// can be narrowed with ?status= and ?label=key=value (repeatable, all must
+// match) and paged with ?limit= and ?offset=; total
+// counts every job matching the filter, not just the returned page. A limit of
+// 0 (the default) means no limit.
+func listJobs(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	statusFilter := q.Get("status")
+	limit, offset := 0, 0
+	for name, dst := range map[string]*int{"limit": &limit, "offset": &offset} {
+		if v := q.Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				httpError(w, name+" must be a non-negative integer", http.StatusBadRequest)
+				return
+			}
+			*dst = n
+		}
+	}
+
+	ns, err := requestNamespace(r)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	deadLetter := q.Get("dead_letter")
+	switch deadLetter {
+	case "", "exclude", "include", "only":
+	default:
+		httpError(w, "dead_letter must be one of exclude, include or only", http.StatusBadRequest)
+		return
+	}
+	labels, err := parseLabels(q["label"])
+	if err == nil {
+		err = checkLabels(labels)
+	}
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	metas, total, err := store.List(jobFilter{
+		Namespace:  ns,
+		Status:     statusFilter,
+		DeadLetter: deadLetter,
+		Labels:     labels,
+		Limit:      limit,
+		Offset:     offset,
+	})
+	if err != nil {
+		httpError(w, "Failed to list jobs", http.StatusInternalServerError)
+		return
+	}
+	jobs := []jobSummary{}
+	for _, meta := range metas {
+		jobs = append(jobs, jobSummary{
+			ID:         meta.ID,
+			Args:       meta.Args,
+			Status:     meta.Status,
+			ResultURL:  jobURL(meta.Namespace, meta.ID, "result"),
+			LogURL:     jobURL(meta.Namespace, meta.ID, "log"),
+			EnqueuedAt: meta.EnqueuedAt.Format(time.RFC3339),
+			Labels:     meta.Labels,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"total": total,
+		"jobs":  jobs,
+	})
+}
+
+func getJobsDir() string {
+	dir := os.Getenv("JOBS_DIR")
+	if dir == "" {
+		dir = "jobs"
+	}
+	return dir
+}
+
+// validJobID reports whether id has the canonical 36-character UUID form that
+// job IDs are created with.
+func validJobID(id string) bool {
+	if len(id) != 36 {
+		return false
+	}
+	_, err := uuid.Parse(id)
+	return err == nil
+}
+
+// namespacePattern is the character set allowed in namespace names. It keeps
+// them to a single safe path element.
+var namespacePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{0,63}$`)
+
+// validNamespace reports whether ns can be used as a namespace. Names that
+// could be mistaken for a job ID or that collide with the directories kept
+// under JOBS_DIR are rejected.
+func validNamespace(ns string) bool {
+	if !namespacePattern.MatchString(ns) || ns == "dead-letter" || ns == "schedules" {
+		return false
+	}
+	_, err := uuid.Parse(ns)
+	return err != nil
+}
+
+// requestNamespace returns the namespace a request is made in, taken from the
+// X-Namespace header or the namespace query parameter. "" is the default
+// namespace.
+func requestNamespace(r *http.Request) (string, error) {
+	ns := r.Header.Get("X-Namespace")
+	if ns == "" {
+		ns = r.URL.Query().Get("namespace")
+	}
+	if ns != "" && !validNamespace(ns) {
+		return "", fmt.Errorf("Invalid namespace %q", ns)
+	}
+	return ns, nil
+}
+
+// namespaces returns every namespace with jobs on disk, starting with the
+// default one.
+func namespaces() []string {
+	list := []string{""}
+	entries, _ := os.ReadDir(getJobsDir())
+	for _, entry := range entries {
+		if !entry.IsDir() || !validNamespace(entry.Name()) {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(getJobsDir(), entry.Name(), "meta.json")); err == nil {
+			continue
+		}
+		list = append(list, entry.Name())
+	}
+	return list
+}
+
+// loadAllMetas returns the meta of every job in every namespace, leaving out
+// dead-lettered jobs.
+func loadAllMetas() []*JobMeta {
+	metas, _, err := store.List(jobFilter{AllNamespaces: true})
+	if err != nil {
+		slog.Warn("Failed to list jobs", "event", "store_error", "error", err)
+	}
+	return metas
+}
+
+// getNamespaceDir returns the directory holding the jobs of namespace ns; the
+// default namespace is JOBS_DIR itself.
+func getNamespaceDir(ns string) string {
+	return filepath.Join(getJobsDir(), ns)
+}
+
+// getDeadLetterDir returns the directory that jobs of namespace ns which failed
+// for good are moved to when DEAD_LETTER=1.
+func getDeadLetterDir(ns string) string {
+	return filepath.Join(getNamespaceDir(ns), "dead-letter")
+}
+
+// getJobDir returns the directory of job id in namespace ns, which is under the
+// dead-letter directory once the job has been moved there.
+func getJobDir(ns, id string) string {
+	dir := filepath.Join(getNamespaceDir(ns), id)
+	if _, err := os.Stat(dir); err != nil {
+		if dl := filepath.Join(getDeadLetterDir(ns), id); dirExists(dl) {
+			return dl
+		}
+	}
+	return dir
+}
+
+func dirExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+func getMaxConcurrentJobs() int {
+	n := envInt("MAX_CONCURRENT_JOBS", 4)
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// envDuration returns the duration value (e.g. "24h") of the environment
+// variable key, or def if it is unset or not a valid duration.
+func envDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		slog.Warn("Invalid duration in environment, using default", "key", key, "value", v, "default", def.String())
+		return def
+	}
+	return d
+}
+
+// envFloat returns the numeric value of the environment variable key, or def
+// if it is unset or not a valid number.
+func envFloat(key string, def float64) float64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		slog.Warn("Invalid number in environment, using default", "key", key, "value", v, "default", def)
+		return def
+	}
+	return f
+}
+
+// envInt returns the integer value of the environment variable key, or def if
+// it is unset or not a valid integer.
+func envInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		slog.Warn("Invalid integer in environment, using default", "key", key, "value", v, "default", def)
+		return def
+	}
+	return n
 }
@@ -0,0 +1,1528 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// testMaxConcurrentJobs is the worker's slot count for the whole test run; the
+// pool is sized once, when workerLoop starts.
+const testMaxConcurrentJobs = 2
+
+func TestMain(m *testing.M) {
+	// serverProcess runs the test binary as the server itself.
+	if os.Getenv("TEST_RUN_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	if os.Getenv("TEST_LOG") == "" {
+		slog.SetDefault(slog.New(slog.NewJSONHandler(io.Discard, nil)))
+	}
+	os.Setenv("MAX_CONCURRENT_JOBS", fmt.Sprint(testMaxConcurrentJobs))
+	registerMetrics()
+	go workerLoop()
+	go scheduleLoop()
+	os.Exit(m.Run())
+}
+
+// newTestServer starts the server's handler on a fresh JOBS_DIR, with the
+// in-memory state of any earlier test cleared. Environment variables the
+// server reads at startup must be set before calling it. When the test ends,
+// running jobs are canceled and the queue is emptied, so nothing it started
+// carries over into the next test.
+func newTestServer(t *testing.T, fixedArgs ...string) *httptest.Server {
+	t.Helper()
+	t.Setenv("JOBS_DIR", t.TempDir())
+	resetState()
+	if err := os.MkdirAll(getInputDir(), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := openStore(); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadTemplates(); err != nil {
+		t.Fatal(err)
+	}
+	loadIdempotencyKeys()
+	loadContentHashes()
+	startSchedules(fixedArgs)
+	srv := httptest.NewServer(newHandler(fixedArgs))
+	t.Cleanup(func() {
+		srv.Close()
+		schedules.cron.Stop()
+		stopAllJobs()
+		if s, ok := store.(countingStore); ok {
+			if db, ok := s.jobStore.(*sqliteStore); ok {
+				db.db.Close()
+			}
+		}
+		// Timers such as those of expires_after_seconds may still fire;
+		// they use the store under mu.
+		mu.Lock()
+		store = fileStore{}
+		mu.Unlock()
+	})
+	return srv
+}
+
+// resetState clears the package-level state a test may have left behind.
+func resetState() {
+	shuttingDown.Store(false)
+	jobCounts = &statusCounts{status: make(map[string]string), counts: make(map[string]int)}
+	templates = map[string]*jobRequest{}
+	for _, m := range []struct {
+		sync.Locker
+		clear func()
+	}{
+		{&idempotency, func() { clear(idempotency.ids) }},
+		{&dedup, func() { clear(dedup.ids) }},
+		{&dependents, func() { clear(dependents.byDep) }},
+		{&scheduledJobs, func() { clear(scheduledJobs.due) }},
+		{&finishedJobs, func() { clear(finishedJobs.chans) }},
+		{&submitLimiters, func() { clear(submitLimiters.byClient) }},
+		{&webhookBreaker, func() { clear(webhookBreaker.hosts) }},
+	} {
+		m.Lock()
+		m.clear()
+		m.Unlock()
+	}
+}
+
+// stopAllJobs empties the queue and cancels every running job, then waits
+// for the workers to be done with them.
+func stopAllJobs() {
+	queue.mu.Lock()
+	queue.items = nil
+	queue.mu.Unlock()
+	mu.Lock()
+	for _, job := range runningJobs {
+		job.Cancel()
+	}
+	mu.Unlock()
+	activeJobs.Wait()
+}
+
+// do sends a request with an optional body and returns the response status
+// and body.
+func do(t *testing.T, method, url, contentType, body string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return send(t, req)
+}
+
+// send sends req and returns the response status and body.
+func send(t *testing.T, req *http.Request) (int, string) {
+	t.Helper()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(data)
+}
+
+// submit posts a JSON job request and returns the new job's ID, failing the
+// test unless the submission is accepted.
+func submit(t *testing.T, base, body string) string {
+	t.Helper()
+	status, resp := do(t, http.MethodPost, base+"/jobs", "application/json", body)
+	if status != http.StatusOK {
+		t.Fatalf("submit %s: status %d: %s", body, status, resp)
+	}
+	var links map[string]string
+	if err := json.Unmarshal([]byte(resp), &links); err != nil {
+		t.Fatalf("submit %s: %v: %s", body, err, resp)
+	}
+	return links["id"]
+}
+
+// getStatus returns the status endpoint's view of job id.
+func getStatus(t *testing.T, base, id string) *JobMeta {
+	t.Helper()
+	status, body := do(t, http.MethodGet, base+"/jobs/"+id+"/status", "", "")
+	if status != http.StatusOK {
+		t.Fatalf("status of %s: %d: %s", id, status, body)
+	}
+	var meta JobMeta
+	if err := json.Unmarshal([]byte(body), &meta); err != nil {
+		t.Fatal(err)
+	}
+	return &meta
+}
+
+// waitFinished waits for job id to reach a terminal state and returns its
+// meta.
+func waitFinished(t *testing.T, base, id string) *JobMeta {
+	t.Helper()
+	return waitFor(t, base, id, isTerminal)
+}
+
+// waitFor polls job id until its status satisfies cond, failing the test
+// after ten seconds.
+func waitFor(t *testing.T, base, id string, cond func(status string) bool) *JobMeta {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		meta := getStatus(t, base, id)
+		if cond(meta.Status) {
+			return meta
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s still %s", id, meta.Status)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// finishedTotal sums jobqueue_jobs_finished_total over all statuses.
+func finishedTotal() int {
+	total := 0
+	for _, s := range jobStatuses {
+		var m dto.Metric
+		jobsFinished.WithLabelValues(s).Write(&m)
+		total += int(m.GetCounter().GetValue())
+	}
+	return total
+}
+
+// eventually retries check until it returns true, failing the test with msg
+// after ten seconds.
+func eventually(t *testing.T, msg string, check func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !check() {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestConcurrentSubmitCancelList(t *testing.T) {
+	srv := newTestServer(t)
+
+	// Commands that run briefly, run longer, and fail to start are mixed, so
+	// cancel requests land in every phase of a job, including the start
+	// failure path.
+	commands := []string{
+		`{"args": ["sleep", "0.05"]}`,
+		`{"args": ["true"]}`,
+		`{"args": ["/nonexistent/command"]}`,
+		`{"args": ["sleep", "0.2"], "max_retries": 1}`,
+	}
+	const workers = 8
+	const perWorker = 6
+	finishedBefore := finishedTotal()
+	ids := make(chan string, workers*perWorker)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				resp, err := http.Post(srv.URL+"/jobs", "application/json", strings.NewReader(commands[(w+i)%len(commands)]))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				var links map[string]string
+				err = json.NewDecoder(resp.Body).Decode(&links)
+				resp.Body.Close()
+				if err != nil || links["id"] == "" {
+					t.Errorf("submit: status %d, %v", resp.StatusCode, err)
+					return
+				}
+				id := links["id"]
+				ids <- id
+				urls := []string{srv.URL + "/jobs?limit=10", srv.URL + "/jobs/" + id + "/status"}
+				if (w+i)%2 == 0 {
+					req, _ := http.NewRequest(http.MethodPut, srv.URL+"/jobs/"+id+"/cancel", nil)
+					if resp, err := http.DefaultClient.Do(req); err == nil {
+						resp.Body.Close()
+					}
+				}
+				for _, url := range urls {
+					if resp, err := http.Get(url); err == nil {
+						io.Copy(io.Discard, resp.Body)
+						resp.Body.Close()
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(ids)
+
+	n := 0
+	for id := range ids {
+		n++
+		waitFinished(t, srv.URL, id)
+	}
+	// Every job is finished exactly once: a cancel racing the job's own
+	// outcome must not count it twice.
+	eventually(t, "jobs finished more than once", func() bool { return finishedTotal()-finishedBefore == n })
+	counts, total := jobCounts.snapshot()
+	if total != n {
+		t.Errorf("jobCounts total = %d, want %d", total, n)
+	}
+	for _, s := range []string{"IN_QUEUE", "IN_PROGRESS"} {
+		if counts[s] != 0 {
+			t.Errorf("%d jobs still counted as %s", counts[s], s)
+		}
+	}
+	mu.Lock()
+	running := len(runningJobs)
+	mu.Unlock()
+	if running != 0 {
+		t.Errorf("%d jobs left in runningJobs", running)
+	}
+}
+
+func TestCancelDuringStartFailureKeepsOutcome(t *testing.T) {
+	srv := newTestServer(t)
+	for i := 0; i < 20; i++ {
+		id := submit(t, srv.URL, `{"args": ["/nonexistent/command"]}`)
+		do(t, http.MethodPut, srv.URL+"/jobs/"+id+"/cancel", "", "")
+		meta := waitFinished(t, srv.URL, id)
+		// A job that was still queued when the cancel came is CANCELED; one
+		// that had been claimed fails to start. Either way, the stored
+		// outcome must match the bookkeeping done for it.
+		if meta.Status != "CANCELED" && meta.Status != "FAILED" {
+			t.Fatalf("job %s: status %s", id, meta.Status)
+		}
+		if meta.Status == "FAILED" && meta.StatusDetail != "start_failed" {
+			t.Fatalf("job %s: FAILED without start_failed: %+v", id, meta)
+		}
+	}
+}
+
+// blockingReceiver is a webhook receiver that holds each delivery until
+// release is closed. Deliveries reaching it are sent on received.
+func blockingReceiver(t *testing.T) (url string, received <-chan struct{}, release chan struct{}) {
+	t.Helper()
+	got := make(chan struct{}, 10)
+	release = make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- struct{}{}
+		<-release
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, got, release
+}
+
+func TestWebhookDeliveryKeepsConcurrentChanges(t *testing.T) {
+	srv := newTestServer(t)
+	url, received, release := blockingReceiver(t)
+	id := submit(t, srv.URL, `{"args": ["true"], "webhook": "`+url+`"}`)
+	<-received
+	if !expireOutput("", id) {
+		t.Fatal("expireOutput failed")
+	}
+	close(release)
+	var meta *JobMeta
+	eventually(t, "webhook delivery not recorded", func() bool {
+		meta = getStatus(t, srv.URL, id)
+		return meta.WebhookDelivered
+	})
+	if meta.OutputExpiredAt == nil {
+		t.Error("webhook delivery overwrote output_expired_at")
+	}
+}
+
+func TestWebhookDeliveryDoesNotRecreateDeletedJob(t *testing.T) {
+	srv := newTestServer(t)
+	url, received, release := blockingReceiver(t)
+	id := submit(t, srv.URL, `{"args": ["true"], "webhook": "`+url+`"}`)
+	<-received
+	if status, body := do(t, http.MethodDelete, srv.URL+"/jobs/"+id, "", ""); status != http.StatusNoContent {
+		t.Fatalf("DELETE: %d %s", status, body)
+	}
+	close(release)
+	time.Sleep(200 * time.Millisecond)
+	if status, _ := do(t, http.MethodGet, srv.URL+"/jobs/"+id+"/status", "", ""); status != http.StatusNotFound {
+		t.Errorf("status after delete: %d", status)
+	}
+	if _, err := os.Stat(getJobDir("", id)); !os.IsNotExist(err) {
+		t.Errorf("job directory is back after delete: %v", err)
+	}
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	srv := newTestServer(t)
+	var ids []string
+	for i := 0; i < 5; i++ {
+		ids = append(ids, submit(t, srv.URL, `{"args": ["sleep", "0.3"]}`))
+	}
+	peak := 0
+	eventually(t, "jobs not finished", func() bool {
+		counts, _ := jobCounts.snapshot()
+		peak = max(peak, counts["IN_PROGRESS"])
+		return counts["IN_QUEUE"]+counts["IN_PROGRESS"] == 0
+	})
+	if peak != testMaxConcurrentJobs {
+		t.Errorf("at most %d jobs ran at once, want %d", peak, testMaxConcurrentJobs)
+	}
+	for _, id := range ids {
+		if meta := getStatus(t, srv.URL, id); meta.Status != "COMPLETED" {
+			t.Errorf("job %s: %s", id, meta.Status)
+		}
+	}
+}
+
+func TestDeleteJob(t *testing.T) {
+	srv := newTestServer(t)
+	running := submit(t, srv.URL, `{"args": ["sleep", "30"]}`)
+	waitFor(t, srv.URL, running, func(s string) bool { return s == "IN_PROGRESS" })
+	if status, body := do(t, http.MethodDelete, srv.URL+"/jobs/"+running, "", ""); status != http.StatusConflict {
+		t.Errorf("DELETE of a running job: %d %s", status, body)
+	}
+
+	id := submit(t, srv.URL, `{"args": ["echo", "hi"]}`)
+	waitFinished(t, srv.URL, id)
+	dir := getJobDir("", id)
+	if status, body := do(t, http.MethodDelete, srv.URL+"/jobs/"+id, "", ""); status != http.StatusNoContent {
+		t.Fatalf("DELETE: %d %s", status, body)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("job directory left behind: %v", err)
+	}
+	if status, _ := do(t, http.MethodGet, srv.URL+"/jobs/"+id+"/status", "", ""); status != http.StatusNotFound {
+		t.Errorf("status after delete: %d", status)
+	}
+	if status, _ := do(t, http.MethodDelete, srv.URL+"/jobs/"+id, "", ""); status != http.StatusNotFound {
+		t.Errorf("second DELETE: %d", status)
+	}
+}
+
+func TestSweepJobs(t *testing.T) {
+	srv := newTestServer(t)
+	finished := submit(t, srv.URL, `{"args": ["true"]}`)
+	waitFinished(t, srv.URL, finished)
+	dir := getJobDir("", finished)
+	running := submit(t, srv.URL, `{"args": ["sleep", "30"]}`)
+	waitFor(t, srv.URL, running, func(s string) bool { return s == "IN_PROGRESS" })
+
+	sweepJobs(time.Hour, 0)
+	if status, _ := do(t, http.MethodGet, srv.URL+"/jobs/"+finished+"/status", "", ""); status != http.StatusOK {
+		t.Errorf("job that finished within the TTL: %d", status)
+	}
+	sweepJobs(time.Nanosecond, 0)
+	if status, _ := do(t, http.MethodGet, srv.URL+"/jobs/"+finished+"/status", "", ""); status != http.StatusNotFound {
+		t.Errorf("job past the TTL: %d", status)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("directory of job past the TTL: %v", err)
+	}
+	if meta := getStatus(t, srv.URL, running); meta.Status != "IN_PROGRESS" {
+		t.Errorf("running job: %s", meta.Status)
+	}
+}
+
+func TestRecoverJobsAfterRestart(t *testing.T) {
+	srv := newTestServer(t)
+	// Jobs as a server that stopped left them on disk: one still queued,
+	// with its input staged, and one that was running.
+	queued := &JobMeta{ID: uuid.NewString(), Args: []string{"cat"}, Status: "IN_QUEUE", EnqueuedAt: time.Now(), HasInput: true}
+	running := &JobMeta{ID: uuid.NewString(), Args: []string{"sleep", "30"}, Status: "IN_PROGRESS", EnqueuedAt: time.Now(), PID: 1}
+	for _, meta := range []*JobMeta{queued, running} {
+		if err := os.MkdirAll(getJobDir("", meta.ID), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Create(meta); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(inputPath(queued.ID), []byte("queued input"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	recoverJobs()
+
+	if meta := waitFinished(t, srv.URL, queued.ID); meta.Status != "COMPLETED" {
+		t.Errorf("queued job: %s %s", meta.Status, meta.Error)
+	}
+	if status, body := do(t, http.MethodGet, srv.URL+"/jobs/"+queued.ID+"/result", "", ""); status != http.StatusOK || body != "queued input" {
+		t.Errorf("queued job's result: %d %q", status, body)
+	}
+	if meta := getStatus(t, srv.URL, running.ID); meta.Status != "FAILED" || meta.PID != 0 || meta.Error == "" {
+		t.Errorf("interrupted job: %+v", meta)
+	}
+}
+
+func TestAPIKey(t *testing.T) {
+	t.Setenv("API_KEY", "s3cret")
+	srv := newTestServer(t)
+	for _, auth := range []string{"", "Bearer wrong", "s3cret", "Basic s3cret"} {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/jobs", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("Authorization %q: %d, WWW-Authenticate %q", auth, resp.StatusCode, resp.Header.Get("WWW-Authenticate"))
+		}
+	}
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/jobs", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	if status, body := send(t, req); status != http.StatusOK {
+		t.Errorf("with the key: %d %s", status, body)
+	}
+	if status, _ := do(t, http.MethodGet, srv.URL+"/healthz", "", ""); status != http.StatusOK {
+		t.Errorf("healthz needs no key, got %d", status)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	t.Setenv("RETRY_BACKOFF", "10ms")
+	srv := newTestServer(t)
+	counter := filepath.Join(t.TempDir(), "attempts")
+	// Fails on its first two attempts; stdin must be there on each of them.
+	script := fmt.Sprintf(`grep -q input && echo x >> %s && [ $(wc -l < %s) -ge 3 ]`, counter, counter)
+	body, _ := json.Marshal(map[string]any{"args": []string{"sh", "-c", script}, "max_retries": 2})
+	id := submit(t, srv.URL, string(body)+"\ninput")
+	if meta := waitFinished(t, srv.URL, id); meta.Status != "COMPLETED" || meta.Attempt != 3 {
+		t.Errorf("job retried until it succeeded: %s after %d attempts", meta.Status, meta.Attempt)
+	}
+
+	id = submit(t, srv.URL, `{"args": ["false"], "max_retries": 1}`)
+	if meta := waitFinished(t, srv.URL, id); meta.Status != "FAILED" || meta.Attempt != 2 {
+		t.Errorf("job out of retries: %s after %d attempts", meta.Status, meta.Attempt)
+	}
+	if status, _ := do(t, http.MethodPost, srv.URL+"/jobs", "application/json", `{"args": ["true"], "max_retries": -1}`); status != http.StatusBadRequest {
+		t.Errorf("negative max_retries: %d", status)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	t.Setenv("RETRY_BACKOFF", "1s")
+	for attempt, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 4: 8 * time.Second, 20: 5 * time.Minute} {
+		if got := retryBackoff(attempt); got != want {
+			t.Errorf("retryBackoff(%d) = %v, want %v", attempt, got, want)
+		}
+	}
+}
+
+func TestAllowedCommands(t *testing.T) {
+	t.Setenv("ALLOWED_COMMANDS", "echo, true")
+	srv := newTestServer(t)
+	id := submit(t, srv.URL, `{"args": ["echo", "hi"]}`)
+	if meta := waitFinished(t, srv.URL, id); meta.Status != "COMPLETED" {
+		t.Errorf("allowed command: %s", meta.Status)
+	}
+	for _, args := range []string{`["rm", "-rf", "/tmp/x"]`, `["/bin/echo", "hi"]`, `["echo,true"]`} {
+		status, body := do(t, http.MethodPost, srv.URL+"/jobs", "application/json", `{"args": `+args+`}`)
+		if status != http.StatusForbidden {
+			t.Errorf("args %s: %d %s", args, status, body)
+		}
+	}
+	if _, total := jobCounts.snapshot(); total != 1 {
+		t.Errorf("%d jobs created, want 1", total)
+	}
+}
+
+func TestFixedCommand(t *testing.T) {
+	srv := newTestServer(t, "echo", "fixed")
+	id := submit(t, srv.URL, `{"args": ["extra", "; rm -rf /"]}`)
+	waitFinished(t, srv.URL, id)
+	// Client args are appended as arguments, never run as a command.
+	if status, body := do(t, http.MethodGet, srv.URL+"/jobs/"+id+"/result", "", ""); status != http.StatusOK || body != "fixed extra ; rm -rf /\n" {
+		t.Errorf("result: %d %q", status, body)
+	}
+}
+
+// webhookDelivery is a request received by a test webhook receiver.
+type webhookDelivery struct {
+	method string
+	header http.Header
+	body   []byte
+}
+
+// webhookReceiver starts a webhook receiver answering with status and
+// returns its URL and the deliveries it receives.
+func webhookReceiver(t *testing.T, status int) (string, <-chan webhookDelivery) {
+	t.Helper()
+	deliveries := make(chan webhookDelivery, 100)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		deliveries <- webhookDelivery{r.Method, r.Header, body}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, deliveries
+}
+
+// nextDelivery returns the next delivery made to a webhook receiver.
+func nextDelivery(t *testing.T, deliveries <-chan webhookDelivery) webhookDelivery {
+	t.Helper()
+	select {
+	case d := <-deliveries:
+		return d
+	case <-time.After(10 * time.Second):
+		t.Fatal("no webhook delivered")
+		return webhookDelivery{}
+	}
+}
+
+// webhookRecorded waits for the outcome of job id's final webhook delivery to
+// be saved, so the delivery is over before the test ends.
+func webhookRecorded(t *testing.T, base, id string) *JobMeta {
+	t.Helper()
+	var meta *JobMeta
+	eventually(t, "webhook delivery not recorded", func() bool {
+		meta = getStatus(t, base, id)
+		return meta.WebhookAttempts > 0
+	})
+	return meta
+}
+
+func TestWebhookSignature(t *testing.T) {
+	t.Setenv("WEBHOOK_SECRET", "topsecret")
+	srv := newTestServer(t)
+	url, deliveries := webhookReceiver(t, http.StatusOK)
+	id := submit(t, srv.URL, `{"args": ["true"], "webhook": "`+url+`"}`)
+	d := nextDelivery(t, deliveries)
+	webhookRecorded(t, srv.URL, id)
+	mac := hmac.New(sha256.New, []byte("topsecret"))
+	mac.Write(d.body)
+	if got, want := d.header.Get("X-Signature-256"), "sha256="+hex.EncodeToString(mac.Sum(nil)); got != want {
+		t.Errorf("X-Signature-256 = %q, want %q", got, want)
+	}
+}
+
+func TestWebhookUnsignedWithoutSecret(t *testing.T) {
+	srv := newTestServer(t)
+	url, deliveries := webhookReceiver(t, http.StatusOK)
+	id := submit(t, srv.URL, `{"args": ["true"], "webhook": "`+url+`"}`)
+	d := nextDelivery(t, deliveries)
+	webhookRecorded(t, srv.URL, id)
+	if d.header.Get("X-Signature-256") != "" {
+		t.Errorf("delivery signed without WEBHOOK_SECRET: %q", d.header.Get("X-Signature-256"))
+	}
+}
+
+func TestJobCwd(t *testing.T) {
+	root := t.TempDir()
+	os.Mkdir(filepath.Join(root, "work"), 0755)
+	os.WriteFile(filepath.Join(root, "file"), nil, 0644)
+	os.Symlink(t.TempDir(), filepath.Join(root, "escape"))
+
+	srv := newTestServer(t)
+	if status, _ := do(t, http.MethodPost, srv.URL+"/jobs", "application/json", `{"args": ["pwd"], "cwd": "work"}`); status != http.StatusBadRequest {
+		t.Errorf("cwd without ALLOWED_CWD_ROOT: %d", status)
+	}
+
+	t.Setenv("ALLOWED_CWD_ROOT", root)
+	id := submit(t, srv.URL, `{"args": ["pwd"], "cwd": "work"}`)
+	waitFinished(t, srv.URL, id)
+	want, _ := filepath.EvalSymlinks(filepath.Join(root, "work"))
+	if status, body := do(t, http.MethodGet, srv.URL+"/jobs/"+id+"/result", "", ""); status != http.StatusOK || strings.TrimSpace(body) != want {
+		t.Errorf("pwd: %d %q, want %q", status, body, want)
+	}
+	for _, cwd := range []string{"missing", "file", "..", "escape", "/tmp", "work/../.."} {
+		if status, body := do(t, http.MethodPost, srv.URL+"/jobs", "application/json", `{"args": ["pwd"], "cwd": "`+cwd+`"}`); status != http.StatusBadRequest {
+			t.Errorf("cwd %q: %d %s", cwd, status, body)
+		}
+	}
+}
+
+// resultContentType returns the Content-Type the result of job id is served
+// with.
+func resultContentType(t *testing.T, base, id string) string {
+	t.Helper()
+	resp, err := http.Get(base + "/jobs/" + id + "/result")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("result of %s: %d", id, resp.StatusCode)
+	}
+	return resp.Header.Get("Content-Type")
+}
+
+func TestResultMimeType(t *testing.T) {
+	srv := newTestServer(t)
+	id := submit(t, srv.URL, `{"args": ["echo", "a,b"], "mime_type": "text/csv"}`)
+	waitFinished(t, srv.URL, id)
+	if ct := resultContentType(t, srv.URL, id); ct != "text/csv" {
+		t.Errorf("Content-Type with mime_type: %q", ct)
+	}
+	if status, _ := do(t, http.MethodGet, srv.URL+"/jobs/"+id+"/result.json", "", ""); status != http.StatusNotAcceptable {
+		t.Errorf("result.json of a CSV result: %d", status)
+	}
+
+	id = submit(t, srv.URL, `{"args": ["echo", "plain"]}`)
+	waitFinished(t, srv.URL, id)
+	if ct := resultContentType(t, srv.URL, id); ct != "text/plain; charset=utf-8" {
+		t.Errorf("sniffed Content-Type: %q", ct)
+	}
+}
+
+func TestHeldJob(t *testing.T) {
+	srv := newTestServer(t)
+	id := submit(t, srv.URL, `{"args": ["echo", "released"], "hold": true}`)
+	time.Sleep(100 * time.Millisecond)
+	if meta := getStatus(t, srv.URL, id); meta.Status != "HELD" || !meta.StartedAt.IsZero() {
+		t.Fatalf("held job: %s, started %v", meta.Status, meta.StartedAt)
+	}
+	if status, _ := do(t, http.MethodPut, srv.URL+"/jobs/"+id+"/release", "", ""); status != http.StatusOK {
+		t.Fatalf("release: %d", status)
+	}
+	if meta := waitFinished(t, srv.URL, id); meta.Status != "COMPLETED" {
+		t.Errorf("released job: %s", meta.Status)
+	}
+	if status, _ := do(t, http.MethodPut, srv.URL+"/jobs/"+id+"/release", "", ""); status != http.StatusConflict {
+		t.Errorf("release of a job that isn't held: %d", status)
+	}
+
+	id = submit(t, srv.URL, `{"args": ["true"], "hold": true}`)
+	do(t, http.MethodPut, srv.URL+"/jobs/"+id+"/cancel", "", "")
+	if meta := getStatus(t, srv.URL, id); meta.Status != "CANCELED" {
+		t.Errorf("canceled held job: %s", meta.Status)
+	}
+}
+
+func TestDelayedJob(t *testing.T) {
+	srv := newTestServer(t)
+	submitted := time.Now()
+	id := submit(t, srv.URL, `{"args": ["true"], "delay_seconds": 1}`)
+	if meta := getStatus(t, srv.URL, id); meta.Status != "SCHEDULED" || meta.RunAt == nil {
+		t.Fatalf("delayed job: %s, run_at %v", meta.Status, meta.RunAt)
+	}
+	meta := waitFinished(t, srv.URL, id)
+	if meta.Status != "COMPLETED" || meta.StartedAt.Sub(submitted) < time.Second {
+		t.Errorf("delayed job: %s, started %v after submission", meta.Status, meta.StartedAt.Sub(submitted))
+	}
+
+	past := time.Now().Add(-time.Hour).Format(time.RFC3339)
+	id = submit(t, srv.URL, `{"args": ["true"], "run_at": "`+past+`"}`)
+	if meta := waitFinished(t, srv.URL, id); meta.Status != "COMPLETED" {
+		t.Errorf("job with run_at in the past: %s", meta.Status)
+	}
+
+	future := time.Now().Add(time.Hour).Format(time.RFC3339)
+	id = submit(t, srv.URL, `{"args": ["true"], "run_at": "`+future+`"}`)
+	do(t, http.MethodPut, srv.URL+"/jobs/"+id+"/cancel", "", "")
+	if meta := getStatus(t, srv.URL, id); meta.Status != "CANCELED" {
+		t.Errorf("canceled scheduled job: %s", meta.Status)
+	}
+
+	if status, _ := do(t, http.MethodPost, srv.URL+"/jobs", "application/json", `{"args": ["true"], "run_at": "`+future+`", "delay_seconds": 5}`); status != http.StatusBadRequest {
+		t.Errorf("run_at with delay_seconds: %d", status)
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	t.Setenv("DEAD_LETTER", "1")
+	srv := newTestServer(t)
+	failed := submit(t, srv.URL, `{"args": ["sh", "-c", "echo oops >&2; exit 3"]}`)
+	completed := submit(t, srv.URL, `{"args": ["true"]}`)
+	waitFinished(t, srv.URL, completed)
+	eventually(t, "failed job not dead-lettered", func() bool { return getStatus(t, srv.URL, failed).DeadLetter })
+
+	if _, err := os.Stat(filepath.Join(getDeadLetterDir(""), failed)); err != nil {
+		t.Errorf("failed job not in the dead-letter directory: %v", err)
+	}
+	if getStatus(t, srv.URL, completed).DeadLetter {
+		t.Error("completed job dead-lettered")
+	}
+	if status, body := do(t, http.MethodGet, srv.URL+"/jobs/"+failed+"/log", "", ""); status != http.StatusOK || body != "oops\n" {
+		t.Errorf("log of a dead-lettered job: %d %q", status, body)
+	}
+	for query, want := range map[string][2]bool{"": {false, true}, "?dead_letter=include": {true, true}, "?dead_letter=only": {true, false}} {
+		_, body := do(t, http.MethodGet, srv.URL+"/jobs"+query, "", "")
+		if strings.Contains(body, failed) != want[0] || strings.Contains(body, completed) != want[1] {
+			t.Errorf("GET /jobs%s: %s", query, body)
+		}
+	}
+}
+
+func TestJobIDsCantEscapeJobsDir(t *testing.T) {
+	srv := newTestServer(t)
+	for _, path := range []string{
+		"..%2Fstatus",
+		"..%2F..%2Fetc%2Fpasswd/status",
+		"%2E%2E/result",
+		"not-a-uuid/status",
+		"00000000-0000-0000-0000-00000000000/status",
+	} {
+		// Paths with dot segments are already turned away by the mux.
+		if status, body := do(t, http.MethodGet, srv.URL+"/jobs/"+path, "", ""); status != http.StatusBadRequest && status != http.StatusNotFound {
+			t.Errorf("GET /jobs/%s: %d %s", path, status, body)
+		}
+	}
+	for _, ns := range []string{"..", "../x", "a/b", "dead-letter", "schedules"} {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/jobs", nil)
+		req.Header.Set("X-Namespace", ns)
+		if status, _ := send(t, req); status != http.StatusBadRequest {
+			t.Errorf("namespace %q: %d", ns, status)
+		}
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	srv := newTestServer(t)
+	id := submit(t, srv.URL, `{"args": ["true"]}`)
+	waitFinished(t, srv.URL, id)
+	check := func(method, path, allow string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, srv.URL+path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != allow {
+			t.Errorf("%s %s: %d, Allow %q, want 405 with Allow %q", method, path, resp.StatusCode, resp.Header.Get("Allow"), allow)
+		}
+	}
+	for endpoint, methods := range jobEndpointMethods {
+		path := "/jobs/" + id + "/" + endpoint
+		if endpoint == "" {
+			path = "/jobs/" + id
+		} else if endpoint == "artifacts/*" {
+			path = "/jobs/" + id + "/artifacts/out.txt"
+		}
+		check(http.MethodPatch, path, strings.Join(methods, ", "))
+	}
+	check(http.MethodDelete, "/jobs", "GET, HEAD, POST")
+	check(http.MethodGet, "/jobs/batch", "POST")
+	check(http.MethodGet, "/admin/purge", "POST")
+}
+
+func TestOpenAPISpec(t *testing.T) {
+	srv := newTestServer(t)
+	resp, err := http.Get(srv.URL + "/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); resp.StatusCode != http.StatusOK || ct != "application/json" {
+		t.Fatalf("GET /openapi.json: %d %s", resp.StatusCode, ct)
+	}
+	var spec struct {
+		OpenAPI string                                `json:"openapi"`
+		Paths   map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&spec); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(spec.OpenAPI, "3.") {
+		t.Errorf("openapi = %q", spec.OpenAPI)
+	}
+	// Every job endpoint is documented with every method it accepts but HEAD.
+	for endpoint, methods := range jobEndpointMethods {
+		path := "/jobs/{id}/" + strings.Replace(endpoint, "*", "{name}", 1)
+		if endpoint == "" {
+			path = "/jobs/{id}"
+		}
+		for _, m := range methods {
+			if _, ok := spec.Paths[path][strings.ToLower(m)]; !ok && m != http.MethodHead {
+				t.Errorf("%s %s is not documented", m, path)
+			}
+		}
+	}
+}
+
+// fillSlots starts long-running jobs until every worker slot is taken, so
+// jobs submitted after it stay queued. The jobs are canceled when the test
+// ends.
+func fillSlots(t *testing.T, base string) {
+	t.Helper()
+	for i := 0; i < testMaxConcurrentJobs; i++ {
+		id := submit(t, base, `{"args": ["sleep", "30"]}`)
+		waitFor(t, base, id, func(s string) bool { return s == "IN_PROGRESS" })
+	}
+}
+
+func TestCancelQueuedJob(t *testing.T) {
+	srv := newTestServer(t)
+	fillSlots(t, srv.URL)
+	id := submitRaw(t, srv.URL, "args=cat", "application/octet-stream", "input")
+	if meta := getStatus(t, srv.URL, id); meta.Status != "IN_QUEUE" {
+		t.Fatalf("job with all slots taken: %s", meta.Status)
+	}
+	if status, _ := do(t, http.MethodPut, srv.URL+"/jobs/"+id+"/cancel", "", ""); status != http.StatusOK {
+		t.Fatalf("cancel: %d", status)
+	}
+	meta := getStatus(t, srv.URL, id)
+	if meta.Status != "CANCELED" || !meta.StartedAt.IsZero() || meta.CompletedAt.IsZero() {
+		t.Errorf("canceled queued job: %s, started %v, completed %v", meta.Status, meta.StartedAt, meta.CompletedAt)
+	}
+	if pos := queue.Position(id); pos != 0 {
+		t.Errorf("canceled job still queued at %d", pos)
+	}
+	if stagedInput(id) != "" {
+		t.Error("staged input of the canceled job left behind")
+	}
+	if status, _ := do(t, http.MethodPut, srv.URL+"/jobs/"+id+"/cancel", "", ""); status != http.StatusOK {
+		t.Errorf("cancel of a finished job: %d", status)
+	}
+}
+
+// startedJob submits a shell script that prints "ready" once it is set up,
+// and waits for that.
+func startedJob(t *testing.T, base, script string) string {
+	t.Helper()
+	body, _ := json.Marshal(map[string]any{"args": []string{"sh", "-c", script + "; echo ready; while :; do sleep 0.05; done"}})
+	id := submit(t, base, string(body))
+	eventually(t, "job not ready", func() bool {
+		_, out := do(t, http.MethodGet, base+"/jobs/"+id+"/result?partial=true", "", "")
+		return strings.Contains(out, "ready")
+	})
+	return id
+}
+
+func TestCancelSignal(t *testing.T) {
+	t.Setenv("CANCEL_GRACE_PERIOD", "200ms")
+	srv := newTestServer(t)
+	if status, _ := do(t, http.MethodPut, srv.URL+"/jobs/"+uuid.NewString()+"/cancel?signal=STOP", "", ""); status != http.StatusBadRequest {
+		t.Errorf("cancel with an unsupported signal: %d", status)
+	}
+
+	// The job handles SIGTERM by cleaning up and exiting.
+	id := startedJob(t, srv.URL, `trap 'echo cleaned up; exit 0' TERM`)
+	do(t, http.MethodPut, srv.URL+"/jobs/"+id+"/cancel?signal=TERM", "", "")
+	if meta := waitFinished(t, srv.URL, id); meta.Status != "CANCELED" {
+		t.Errorf("job canceled with TERM: %s", meta.Status)
+	}
+	if _, out := do(t, http.MethodGet, srv.URL+"/jobs/"+id+"/result?partial=true", "", ""); !strings.Contains(out, "cleaned up") {
+		t.Errorf("job didn't get SIGTERM: %q", out)
+	}
+
+	// A job ignoring SIGTERM is killed once the grace period is over.
+	id = startedJob(t, srv.URL, `trap '' TERM`)
+	start := time.Now()
+	do(t, http.MethodPut, srv.URL+"/jobs/"+id+"/cancel?signal=SIGTERM", "", "")
+	if meta := waitFinished(t, srv.URL, id); meta.Status != "CANCELED" || time.Since(start) < 200*time.Millisecond {
+		t.Errorf("job ignoring TERM: %s after %v", meta.Status, time.Since(start))
+	}
+
+	// Without a signal the job is killed straight away.
+	id = startedJob(t, srv.URL, `trap '' TERM`)
+	do(t, http.MethodPut, srv.URL+"/jobs/"+id+"/cancel", "", "")
+	if meta := waitFinished(t, srv.URL, id); meta.Status != "CANCELED" {
+		t.Errorf("killed job: %s", meta.Status)
+	}
+}
+
+func TestQueuePosition(t *testing.T) {
+	srv := newTestServer(t)
+	var running string
+	for i := 0; i < testMaxConcurrentJobs; i++ {
+		running = submit(t, srv.URL, `{"args": ["sleep", "30"]}`)
+		waitFor(t, srv.URL, running, func(s string) bool { return s == "IN_PROGRESS" })
+	}
+	var queued []string
+	for i := 0; i < 3; i++ {
+		queued = append(queued, submit(t, srv.URL, `{"args": ["true"]}`))
+	}
+	for i, id := range queued {
+		if meta := getStatus(t, srv.URL, id); meta.Status != "IN_QUEUE" || meta.QueuePosition != i+1 {
+			t.Errorf("job %d: %s at position %d", i, meta.Status, meta.QueuePosition)
+		}
+	}
+	if status, _ := do(t, http.MethodPut, srv.URL+"/jobs/"+queued[0]+"/cancel", "", ""); status != http.StatusOK {
+		t.Fatalf("cancel: %d", status)
+	}
+	if pos := getStatus(t, srv.URL, queued[2]).QueuePosition; pos != 2 {
+		t.Errorf("last job at position %d after the first was canceled, want 2", pos)
+	}
+	if _, body := do(t, http.MethodGet, srv.URL+"/jobs/"+running+"/status", "", ""); strings.Contains(body, "queue_position") {
+		t.Errorf("running job has a queue position: %s", body)
+	}
+}
+
+func TestPartialResult(t *testing.T) {
+	srv := newTestServer(t)
+	id := startedJob(t, srv.URL, "echo first")
+	if status, _ := do(t, http.MethodGet, srv.URL+"/jobs/"+id+"/result", "", ""); status != http.StatusNotFound {
+		t.Errorf("result of a running job without ?partial: %d", status)
+	}
+	resp, err := http.Get(srv.URL + "/jobs/" + id + "/result?partial=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "first\nready\n" {
+		t.Errorf("partial result: %d %q", resp.StatusCode, body)
+	}
+	if got := resp.Header.Get("X-Job-Status"); got != "IN_PROGRESS" {
+		t.Errorf("X-Job-Status = %q", got)
+	}
+}
+
+func TestBatchSubmit(t *testing.T) {
+	srv := newTestServer(t)
+	status, body := do(t, http.MethodPost, srv.URL+"/jobs/batch", "application/json",
+		`[{"args": ["echo", "a"]}, {"args": ["echo", "b"]}, {"args": ["echo", "c"]}]`)
+	if status != http.StatusOK {
+		t.Fatalf("batch: %d %s", status, body)
+	}
+	var links []map[string]string
+	if err := json.Unmarshal([]byte(body), &links); err != nil || len(links) != 3 {
+		t.Fatalf("batch response: %v %s", err, body)
+	}
+	for i, l := range links {
+		meta := waitFinished(t, srv.URL, l["id"])
+		if meta.Status != "COMPLETED" || meta.BatchID == "" || meta.BatchID != links[0]["batch_id"] {
+			t.Errorf("job %d: %s in batch %q", i, meta.Status, meta.BatchID)
+		}
+		if want := string(rune('a'+i)) + "\n"; catOutput(t, srv.URL, l["id"]) != want {
+			t.Errorf("link %d is for a different job", i)
+		}
+	}
+
+	status, body = do(t, http.MethodPost, srv.URL+"/jobs/batch", "application/json",
+		`[{"args": ["true"]}, {"args": []}]`)
+	if status != http.StatusBadRequest || !strings.Contains(body, "Job 1") {
+		t.Errorf("batch with an invalid job: %d %s", status, body)
+	}
+	if _, total := jobCounts.snapshot(); total != 3 {
+		t.Errorf("%d jobs after a rejected batch, want 3", total)
+	}
+}
+
+func TestWebhookEvents(t *testing.T) {
+	srv := newTestServer(t)
+	url, deliveries := webhookReceiver(t, http.StatusOK)
+	statuses := func(n int) string {
+		var got []string
+		for i := 0; i < n; i++ {
+			var payload webhookPayload
+			if err := json.Unmarshal(nextDelivery(t, deliveries).body, &payload); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, payload.Status)
+		}
+		// Transition notifications are sent concurrently, so they may
+		// arrive in any order.
+		sort.Strings(got)
+		return strings.Join(got, " ")
+	}
+
+	id := submit(t, srv.URL, `{"args": ["sleep", "0.2"], "webhook": "`+url+`", "webhook_events": ["IN_QUEUE", "IN_PROGRESS", "terminal"]}`)
+	if got := statuses(3); got != "COMPLETED IN_PROGRESS IN_QUEUE" {
+		t.Errorf("webhooks sent for %s", got)
+	}
+	webhookRecorded(t, srv.URL, id)
+
+	id = submit(t, srv.URL, `{"args": ["true"], "webhook": "`+url+`"}`)
+	if got := statuses(1); got != "COMPLETED" {
+		t.Errorf("webhook sent for %s without webhook_events", got)
+	}
+	webhookRecorded(t, srv.URL, id)
+	if len(deliveries) != 0 {
+		t.Errorf("%d extra webhooks sent", len(deliveries))
+	}
+
+	if status, body := do(t, http.MethodPost, srv.URL+"/jobs", "application/json", `{"args": ["true"], "webhook": "`+url+`", "webhook_events": ["DONE"]}`); status != http.StatusBadRequest {
+		t.Errorf("unknown webhook event: %d %s", status, body)
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	t.Setenv("MAX_QUEUE_LENGTH", "2")
+	srv := newTestServer(t)
+	fillSlots(t, srv.URL)
+	first := submit(t, srv.URL, `{"args": ["true"]}`)
+	submit(t, srv.URL, `{"args": ["true"]}`)
+
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/jobs", strings.NewReader(`{"args": ["true"]}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("submit to a full queue: %d, Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	if status, body := do(t, http.MethodPost, srv.URL+"/jobs/batch", "application/json", `[{"args": ["true"]}]`); status != http.StatusServiceUnavailable {
+		t.Errorf("batch to a full queue: %d %s", status, body)
+	}
+
+	if status, _ := do(t, http.MethodPut, srv.URL+"/jobs/"+first+"/cancel", "", ""); status != http.StatusOK {
+		t.Fatalf("cancel: %d", status)
+	}
+	submit(t, srv.URL, `{"args": ["true"]}`)
+}
+
+func TestRerun(t *testing.T) {
+	t.Setenv("ALLOW_JOB_ENV", "1")
+	srv := newTestServer(t)
+	id := submit(t, srv.URL, `{"args": ["sh", "-c", "cat; echo $GREETING"], "env": {"GREETING": "hi"}, "input_base64": "aGVsbG8K", "keep_input": true}`)
+	if out := catOutput(t, srv.URL, id); out != "hello\nhi\n" {
+		t.Fatalf("first run: %q", out)
+	}
+	status, body := do(t, http.MethodPost, srv.URL+"/jobs/"+id+"/rerun", "", "")
+	if status != http.StatusOK {
+		t.Fatalf("rerun: %d %s", status, body)
+	}
+	var links map[string]string
+	if err := json.Unmarshal([]byte(body), &links); err != nil {
+		t.Fatal(err)
+	}
+	rerun := links["id"]
+	if rerun == "" || rerun == id {
+		t.Fatalf("rerun got id %q", rerun)
+	}
+	if out := catOutput(t, srv.URL, rerun); out != "hello\nhi\n" {
+		t.Errorf("rerun: %q", out)
+	}
+	if orig, again := getStatus(t, srv.URL, id), getStatus(t, srv.URL, rerun); !slices.Equal(orig.Args, again.Args) {
+		t.Errorf("rerun args %q, original %q", again.Args, orig.Args)
+	}
+
+	os.Remove(jobInput("", id))
+	if status, body := do(t, http.MethodPost, srv.URL+"/jobs/"+id+"/rerun", "", ""); status != http.StatusConflict {
+		t.Errorf("rerun without the input: %d %s", status, body)
+	}
+	running := startedJob(t, srv.URL, "true")
+	if status, body := do(t, http.MethodPost, srv.URL+"/jobs/"+running+"/rerun", "", ""); status != http.StatusConflict {
+		t.Errorf("rerun of a running job: %d %s", status, body)
+	}
+}
+
+// serverProcess starts the server in a separate process, on a free port of
+// 127.0.0.1 and a fresh JOBS_DIR, with env added to its environment. It
+// returns the address the server listens on; the server is stopped when the
+// test ends.
+func serverProcess(t *testing.T, env ...string) string {
+	t.Helper()
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(exe)
+	cmd.Env = append(os.Environ(), "TEST_RUN_MAIN=1", "LISTEN_ADDR=127.0.0.1:0", "JOBS_DIR="+t.TempDir())
+	cmd.Env = append(cmd.Env, env...)
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Signal(syscall.SIGTERM)
+		cmd.Wait()
+	})
+	addr := make(chan string, 1)
+	go func() {
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			var entry struct{ Event, Addr string }
+			if json.Unmarshal(scanner.Bytes(), &entry) == nil && entry.Event == "server_start" {
+				addr <- entry.Addr
+			}
+		}
+		io.Copy(io.Discard, stderr)
+	}()
+	select {
+	case a := <-addr:
+		return a
+	case <-time.After(10 * time.Second):
+		t.Fatal("server didn't start")
+		return ""
+	}
+}
+
+// selfSignedCert writes a certificate for 127.0.0.1 and its key to dir and
+// returns their paths, along with a pool trusting the certificate.
+func selfSignedCert(t *testing.T, dir string) (certFile, keyFile string, pool *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool = x509.NewCertPool()
+	pool.AddCert(cert)
+	return certFile, keyFile, pool
+}
+
+func TestTLS(t *testing.T) {
+	certFile, keyFile, pool := selfSignedCert(t, t.TempDir())
+	addr := serverProcess(t, "TLS_CERT_FILE="+certFile, "TLS_KEY_FILE="+keyFile)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	resp, err := client.Get("https://" + addr + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.TLS == nil {
+		t.Errorf("healthz over TLS: %d", resp.StatusCode)
+	}
+	if resp, err := http.Get("http://" + addr + "/healthz"); err == nil {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			t.Error("TLS server answered plain HTTP")
+		}
+	}
+
+	exe, _ := os.Executable()
+	cmd := exec.Command(exe)
+	cmd.Env = append(os.Environ(), "TEST_RUN_MAIN=1", "LISTEN_ADDR=127.0.0.1:0", "JOBS_DIR="+t.TempDir(), "TLS_CERT_FILE="+certFile)
+	if err := cmd.Run(); err == nil {
+		t.Error("server started with TLS_CERT_FILE but no TLS_KEY_FILE")
+	}
+}
+
+func TestListenAddr(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ln.Addr().String()
+	exe, _ := os.Executable()
+	busy := exec.Command(exe)
+	busy.Env = append(os.Environ(), "TEST_RUN_MAIN=1", "LISTEN_ADDR="+want, "JOBS_DIR="+t.TempDir())
+	if err := busy.Run(); err == nil {
+		t.Error("server started on an address already in use")
+	}
+	ln.Close()
+
+	if addr := serverProcess(t, "LISTEN_ADDR="+want); addr != want {
+		t.Errorf("server logged address %s, want %s", addr, want)
+	}
+	if status, _ := do(t, http.MethodGet, "http://"+want+"/healthz", "", ""); status != http.StatusOK {
+		t.Errorf("healthz on %s: %d", want, status)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	t.Setenv("ALLOWED_COMMANDS", "echo")
+	srv := newTestServer(t, "echo", "fixed")
+	status, body := do(t, http.MethodPost, srv.URL+"/jobs?dry_run=true", "application/json", `{"args": ["hello"]}`)
+	if status != http.StatusOK {
+		t.Fatalf("valid dry run: %d %s", status, body)
+	}
+	var resp struct {
+		Valid bool
+		Args  []string
+	}
+	if err := json.Unmarshal([]byte(body), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Valid || !slices.Equal(resp.Args, []string{"echo", "fixed", "hello"}) {
+		t.Errorf("valid dry run: %s", body)
+	}
+	if _, total := jobCounts.snapshot(); total != 0 {
+		t.Errorf("dry run created %d jobs", total)
+	}
+
+	srv = newTestServer(t)
+	for _, job := range []string{`{"args": []}`, `{"args": ["rm", "-rf", "/"]}`, `{"args": ["echo"], "cwd": "relative"}`} {
+		if status, body := do(t, http.MethodPost, srv.URL+"/jobs?dry_run=true", "application/json", job); status < 400 || status >= 500 {
+			t.Errorf("dry run of %s: %d %s", job, status, body)
+		}
+	}
+	if _, total := jobCounts.snapshot(); total != 0 {
+		t.Errorf("dry runs created %d jobs", total)
+	}
+}
+
+// sseEvent is one server-sent event.
+type sseEvent struct {
+	name, data string
+}
+
+// readEvent reads the next server-sent event from r, returning false at the
+// end of the stream.
+func readEvent(t *testing.T, r *bufio.Reader) (sseEvent, bool) {
+	t.Helper()
+	var ev sseEvent
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return ev, false
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && ev.name != "":
+			return ev, true
+		case strings.HasPrefix(line, "event: "):
+			ev.name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			ev.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func TestResultJSONLines(t *testing.T) {
+	srv := newTestServer(t)
+	id := submit(t, srv.URL, `{"args": ["sh", "-c", "echo '{\"a\": 1}'; sleep 0.5; printf 'not json\n\n[2]\n{\"c\": 3}'"]}`)
+	resp, err := http.Get(srv.URL + "/jobs/" + id + "/result/jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	r := bufio.NewReader(resp.Body)
+	first, ok := readEvent(t, r)
+	if !ok || first != (sseEvent{"record", `{"a": 1}`}) {
+		t.Fatalf("first event: %+v", first)
+	}
+	if meta := getStatus(t, srv.URL, id); isTerminal(meta.Status) {
+		t.Errorf("first record arrived with the job %s, want it streamed while running", meta.Status)
+	}
+	var got []sseEvent
+	for {
+		ev, ok := readEvent(t, r)
+		if !ok {
+			break
+		}
+		got = append(got, ev)
+	}
+	want := []sseEvent{
+		{"invalid", `{"error":"invalid JSON","line":2,"text":"not json"}`},
+		{"record", `[2]`},
+		// The last line has no newline; it is sent once the job is done.
+		{"record", `{"c": 3}`},
+		{"done", "COMPLETED"},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("events after the first:\n%+v\nwant\n%+v", got, want)
+	}
+	if status, _ := do(t, http.MethodGet, srv.URL+"/jobs/"+uuid.NewString()+"/result/jsonl", "", ""); status != http.StatusNotFound {
+		t.Errorf("stream of a missing job: %d", status)
+	}
+}
+
+func TestCommandNotFound(t *testing.T) {
+	srv := newTestServer(t)
+	id := submit(t, srv.URL, `{"args": ["no-such-command-here", "arg"], "max_retries": 2}`)
+	meta := waitFinished(t, srv.URL, id)
+	if meta.Status != "FAILED" || meta.StatusDetail != "start_failed" || !strings.Contains(meta.Error, "executable file not found") {
+		t.Errorf("missing command: %s (%s) %q", meta.Status, meta.StatusDetail, meta.Error)
+	}
+	if meta.Attempt != 1 || meta.ExitCode != nil {
+		t.Errorf("missing command: attempt %d, exit code %v", meta.Attempt, meta.ExitCode)
+	}
+	if status, body := do(t, http.MethodGet, srv.URL+"/jobs/"+id+"/log", "", ""); status != http.StatusOK || body != meta.Error+"\n" {
+		t.Errorf("log of a job that didn't start: %d %q", status, body)
+	}
+
+	// A command that runs and fails isn't a start failure.
+	meta = waitFinished(t, srv.URL, submit(t, srv.URL, `{"args": ["false"]}`))
+	if meta.Status != "FAILED" || meta.StatusDetail != "" || meta.ExitCode == nil || *meta.ExitCode != 1 {
+		t.Errorf("failing command: %s (%s), exit code %v", meta.Status, meta.StatusDetail, meta.ExitCode)
+	}
+}
+
+func TestArgsValidation(t *testing.T) {
+	t.Setenv("MAX_ARGS", "3")
+	t.Setenv("MAX_ARGS_BYTES", "20")
+	srv := newTestServer(t)
+	for _, job := range []string{
+		`{}`,
+		`{"args": []}`,
+		`{"args": [""]}`,
+		`{"args": ["echo", "a\u0000b"]}`,
+		`{"args": ["echo", "a", "b", "c"]}`,
+		`{"args": ["echo", "twenty-one characters"]}`,
+	} {
+		if status, body := do(t, http.MethodPost, srv.URL+"/jobs", "application/json", job); status != http.StatusBadRequest {
+			t.Errorf("submit %s: %d %s", job, status, body)
+		}
+	}
+	if out := catOutput(t, srv.URL, submit(t, srv.URL, `{"args": ["echo", "a", "b"]}`)); out != "a b\n" {
+		t.Errorf("job within the limits: %q", out)
+	}
+
+	// The fixed command counts towards the limits, and makes empty args fine.
+	srv = newTestServer(t, "echo", "fixed")
+	if out := catOutput(t, srv.URL, submit(t, srv.URL, `{"args": []}`)); out != "fixed\n" {
+		t.Errorf("fixed command without args: %q", out)
+	}
+	if status, body := do(t, http.MethodPost, srv.URL+"/jobs", "application/json", `{"args": ["a", "b"]}`); status != http.StatusBadRequest {
+		t.Errorf("too many args with the fixed command: %d %s", status, body)
+	}
+}
+
+func TestRecoveredJobWithoutArgs(t *testing.T) {
+	srv := newTestServer(t)
+	// A damaged meta file left in the queue by an earlier run.
+	meta := &JobMeta{ID: uuid.NewString(), Status: "IN_QUEUE", EnqueuedAt: time.Now()}
+	os.MkdirAll(getJobDir("", meta.ID), 0755)
+	if err := store.Create(meta); err != nil {
+		t.Fatal(err)
+	}
+	recoverJobs()
+	got := waitFinished(t, srv.URL, meta.ID)
+	if got.Status != "FAILED" || got.StatusDetail != "start_failed" || !strings.Contains(got.Error, "job has no command") {
+		t.Errorf("job without args: %s (%s) %q", got.Status, got.StatusDetail, got.Error)
+	}
+	if out := catOutput(t, srv.URL, submit(t, srv.URL, `{"args": ["echo", "ok"]}`)); out != "ok\n" {
+		t.Errorf("job after one without args: %q", out)
+	}
+}
+
+func TestRunJobRecoversFromPanic(t *testing.T) {
+	srv := newTestServer(t)
+	meta := &JobMeta{ID: uuid.NewString(), Args: []string{"true"}, Status: "IN_QUEUE", EnqueuedAt: time.Now()}
+	os.MkdirAll(getJobDir("", meta.ID), 0755)
+	if err := store.Create(meta); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := claimJob(meta); !ok {
+		t.Fatal("claimJob failed")
+	}
+	// runJob derives its own contexts from the one passed in, so a nil
+	// context makes it panic.
+	runJob(nil, meta, "")
+
+	got := getStatus(t, srv.URL, meta.ID)
+	if got.Status != "FAILED" || !strings.Contains(got.Error, "internal error while running job") {
+		t.Errorf("job that panicked: %s %q", got.Status, got.Error)
+	}
+	if _, body := do(t, http.MethodGet, srv.URL+"/jobs/"+meta.ID+"/log", "", ""); body != got.Error+"\n" {
+		t.Errorf("log of job that panicked: %q", body)
+	}
+	mu.Lock()
+	_, running := runningJobs[meta.ID]
+	mu.Unlock()
+	if running {
+		t.Error("job that panicked is still registered as running")
+	}
+	if out := catOutput(t, srv.URL, submit(t, srv.URL, `{"args": ["echo", "ok"]}`)); out != "ok\n" {
+		t.Errorf("job after a panic: %q", out)
+	}
+}
+
+func TestSlowHeadersTimeOut(t *testing.T) {
+	addr := serverProcess(t, "HTTP_READ_HEADER_TIMEOUT=200ms")
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	// Start the headers but never finish them.
+	fmt.Fprint(conn, "GET /healthz HTTP/1.1\r\nHost: test\r\n")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("connection still open after %v: %v", time.Since(start), err)
+	}
+	if len(resp) > 0 && !strings.HasPrefix(string(resp), "HTTP/1.1 408") {
+		t.Errorf("response to incomplete headers: %q", resp)
+	}
+
+	// Clients that send their headers in time are served as usual.
+	if status, _ := do(t, http.MethodGet, "http://"+addr+"/healthz", "", ""); status != http.StatusOK {
+		t.Errorf("healthz: %d", status)
+	}
+}
+
+func TestLastLinesOffset(t *testing.T) {
+	// Long enough that the lines wanted span several reads.
+	long := strings.Repeat("x", 40<<10)
+	for _, tc := range []struct {
+		content string
+		n       int
+		want    string
+	}{
+		{"a\nb\nc\n", 2, "b\nc\n"},
+		{"a\nb\nc", 2, "b\nc"},
+		{"a\nb\nc\n", 10, "a\nb\nc\n"},
+		{"a\nb\nc\n", 0, ""},
+		{"", 3, ""},
+		{"\n\n\n", 2, "\n\n"},
+		{"first\n" + long + "\nlast\n", 2, long + "\nlast\n"},
+	} {
+		r := strings.NewReader(tc.content)
+		off, err := lastLinesOffset(r, r.Size(), tc.n)
+		if err != nil || tc.content[off:] != tc.want {
+			t.Errorf("last %d lines of %.20q: %.20q, %v", tc.n, tc.content, tc.content[off:], err)
+		}
+	}
+}
+
+func TestLogLines(t *testing.T) {
+	srv := newTestServer(t)
+	id := submit(t, srv.URL, `{"args": ["sh", "-c", "seq 100 >&2"]}`)
+	waitFinished(t, srv.URL, id)
+	if status, body := do(t, http.MethodGet, srv.URL+"/jobs/"+id+"/log?lines=3", "", ""); status != http.StatusOK || body != "98\n99\n100\n" {
+		t.Errorf("last 3 lines: %d %q", status, body)
+	}
+	if _, body := do(t, http.MethodGet, srv.URL+"/jobs/"+id+"/log?lines=1000", "", ""); body != seq(100) {
+		t.Errorf("more lines than the log has: %q", body)
+	}
+	if _, body := do(t, http.MethodGet, srv.URL+"/jobs/"+id+"/log", "", ""); body != seq(100) {
+		t.Errorf("log without lines: %q", body)
+	}
+	if status, _ := do(t, http.MethodGet, srv.URL+"/jobs/"+id+"/log?lines=-1", "", ""); status != http.StatusBadRequest {
+		t.Errorf("negative lines: %d", status)
+	}
+}
@@ -0,0 +1,7 @@
+package main
+
+import "errors"
+
+// errMemoryLimit is the error of a job whose memory_limit_mb couldn't be
+// applied.
+var errMemoryLimit = errors.New("failed to apply memory_limit_mb")
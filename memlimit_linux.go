@@ -0,0 +1,57 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// memoryLimitSupported reports whether memory_limit_mb can be enforced here.
+const memoryLimitSupported = true
+
+// memoryLimitLauncher is the argv[0] under which the server's own binary runs
+// as the launcher of a job with memory_limit_mb.
+const memoryLimitLauncher = "jobqueue-memory-limit"
+
+// limitMemory makes cmd run with its address space capped at limit bytes.
+// The limit must be in place before the command is executed, so that it
+// covers the command's first allocations and any process it starts right
+// away. cmd is changed to start the server's own binary as a launcher that
+// sets the limit on itself and then executes the command in its place (see
+// init below), keeping its PID, process group and credentials.
+func limitMemory(cmd *exec.Cmd, limit uint64) error {
+	if _, err := exec.LookPath(cmd.Path); cmd.Err != nil || err != nil {
+		// The command can't be started anyway; let Start report why.
+		return nil
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd.Args = append([]string{memoryLimitLauncher, strconv.FormatUint(limit, 10), cmd.Path}, cmd.Args...)
+	cmd.Path = self
+	return nil
+}
+
+// init runs the launcher when the binary was started as one by limitMemory:
+// its arguments are the limit, the command's path and the command's
+// arguments. It never returns then.
+func init() {
+	if len(os.Args) < 4 || os.Args[0] != memoryLimitLauncher {
+		return
+	}
+	limit, err := strconv.ParseUint(os.Args[1], 10, 64)
+	if err == nil {
+		err = unix.Setrlimit(unix.RLIMIT_AS, &unix.Rlimit{Cur: limit, Max: limit})
+	}
+	if err == nil {
+		err = unix.Exec(os.Args[2], os.Args[3:], os.Environ())
+	}
+	fmt.Fprintf(os.Stderr, "%v: %v\n", errMemoryLimit, err)
+	os.Exit(126)
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMemoryLimitIsSetBeforeExec(t *testing.T) {
+	srv := newTestServer(t)
+	id := submit(t, srv.URL, `{"args": ["sh", "-c", "ulimit -v"], "memory_limit_mb": 64}`)
+	if meta := waitFinished(t, srv.URL, id); meta.Status != "COMPLETED" {
+		t.Fatalf("job %s: %+v", meta.Status, meta)
+	}
+	status, body := do(t, http.MethodGet, srv.URL+"/jobs/"+id+"/result", "", "")
+	if status != http.StatusOK || strings.TrimSpace(body) != "65536" {
+		t.Errorf("address-space limit seen by the command: %d %q, want 65536 KB", status, body)
+	}
+}
+
+func TestMemoryLimitKeepsStartFailure(t *testing.T) {
+	srv := newTestServer(t)
+	id := submit(t, srv.URL, `{"args": ["/nonexistent/command"], "memory_limit_mb": 64}`)
+	if meta := waitFinished(t, srv.URL, id); meta.Status != "FAILED" || meta.StatusDetail != "start_failed" {
+		t.Errorf("job %s: %+v", id, meta)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import "os/exec"
+
+// memoryLimitSupported reports whether memory_limit_mb can be enforced here.
+const memoryLimitSupported = false
+
+// limitMemory is a no-op where per-process limits can't be set; submissions
+// with memory_limit_mb are rejected instead.
+func limitMemory(cmd *exec.Cmd, limit uint64) error { return nil }
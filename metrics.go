@@ -0,0 +1,51 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	jobsSubmitted = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "jobqueue_jobs_submitted_total",
+		Help: "Total number of jobs submitted.",
+	})
+	rateLimitedRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "jobqueue_rate_limited_requests_total",
+		Help: "Total number of job submissions rejected by the rate limiter.",
+	})
+	jobsFinished = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "jobqueue_jobs_finished_total",
+		Help: "Total number of jobs that reached a terminal state, by status.",
+	}, []string{"status"})
+	jobDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "jobqueue_job_duration_seconds",
+		Help:    "Wall-clock run time of finished jobs.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 4, 10),
+	})
+	runningJobsGauge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "jobqueue_running_jobs",
+		Help: "Number of jobs currently running.",
+	}, func() float64 {
+		mu.Lock()
+		defer mu.Unlock()
+		return float64(len(runningJobs))
+	})
+	queueDepthGauge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "jobqueue_queue_depth",
+		Help: "Number of jobs waiting for a worker slot.",
+	}, func() float64 {
+		return float64(queue.Len())
+	})
+)
+
+func registerMetrics() {
+	prometheus.MustRegister(jobsSubmitted, rateLimitedRequests, jobsFinished, jobDuration, runningJobsGauge, queueDepthGauge)
+}
+
+// recordJobFinished updates the metrics for a job that reached a terminal state.
+func recordJobFinished(meta *JobMeta) {
+	jobsFinished.WithLabelValues(meta.Status).Inc()
+	if !meta.StartedAt.IsZero() {
+		jobDuration.Observe(meta.CompletedAt.Sub(meta.StartedAt).Seconds())
+	}
+}
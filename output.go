@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// combinedLog merges a job's stdout and stderr into a single file, in the
+// order the lines were produced. Each line is prefixed with the time elapsed
+// since the job started (from the monotonic clock) and the stream it came
+// from, e.g. "[+1.250000s] stderr: warning".
+type combinedLog struct {
+	mu    sync.Mutex
+	out   io.WriteCloser
+	start time.Time
+	parts map[string]*combinedStream
+}
+
+func newCombinedLog(out io.WriteCloser) *combinedLog {
+	return &combinedLog{out: out, start: time.Now(), parts: make(map[string]*combinedStream)}
+}
+
+// Stream returns a writer whose lines are added to the log tagged as name.
+func (c *combinedLog) Stream(name string) io.Writer {
+	s := &combinedStream{log: c, name: name}
+	c.parts[name] = s
+	return s
+}
+
+// Close writes out any unterminated final lines and closes the file. It is
+// safe to call on a nil log.
+func (c *combinedLog) Close() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, s := range c.parts {
+		if len(s.partial) > 0 {
+			c.writeLine(s.name, s.partial)
+			s.partial = nil
+		}
+	}
+	return c.out.Close()
+}
+
+// writeLine must be called with c.mu held.
+func (c *combinedLog) writeLine(stream string, line []byte) {
+	fmt.Fprintf(c.out, "[+%.6fs] %s: %s\n", time.Since(c.start).Seconds(), stream, line)
+}
+
+// combinedStream is the writer for one stream of a combinedLog. Incomplete
+// lines are held until their newline arrives so lines from the two streams
+// never get spliced together.
+type combinedStream struct {
+	log     *combinedLog
+	name    string
+	partial []byte
+}
+
+func (s *combinedStream) Write(p []byte) (int, error) {
+	s.log.mu.Lock()
+	defer s.log.mu.Unlock()
+	data := append(s.partial, p...)
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		s.log.writeLine(s.name, data[:i])
+		data = data[i+1:]
+	}
+	s.partial = append([]byte(nil), data...)
+	return len(p), nil
+}
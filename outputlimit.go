@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+)
+
+// errOutputLimit is the cancellation cause of a job that wrote more than its
+// output limit.
+var errOutputLimit = errors.New("output limit exceeded")
+
+// outputLimiter caps the combined number of bytes a job writes to stdout and
+// stderr, canceling the job once the cap is reached.
+type outputLimiter struct {
+	limit   int64
+	written atomic.Int64
+	cancel  context.CancelCauseFunc
+}
+
+// Wrap returns a writer that counts writes to w against the limit. Output past
+// the limit is dropped.
+func (l *outputLimiter) Wrap(w io.Writer) io.Writer {
+	return limitedWriter{w: w, l: l}
+}
+
+type limitedWriter struct {
+	w io.Writer
+	l *outputLimiter
+}
+
+func (lw limitedWriter) Write(p []byte) (int, error) {
+	total := lw.l.written.Add(int64(len(p)))
+	if total <= lw.l.limit {
+		return lw.w.Write(p)
+	}
+	// Keep whatever still fit under the limit, then stop the job.
+	if room := lw.l.limit - (total - int64(len(p))); room > 0 {
+		lw.w.Write(p[:room])
+	}
+	lw.l.cancel(errOutputLimit)
+	return 0, errOutputLimit
+}
+
+// outputLimit returns the output cap for a job in bytes, or 0 for none: its
+// own max_output_bytes, which may lower but not raise MAX_OUTPUT_BYTES.
+func outputLimit(meta *JobMeta) int64 {
+	limit := int64(envInt("MAX_OUTPUT_BYTES", 0))
+	if meta.MaxOutputBytes > 0 && (limit == 0 || meta.MaxOutputBytes < limit) {
+		limit = meta.MaxOutputBytes
+	}
+	return limit
+}
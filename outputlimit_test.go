@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestOutputLimit(t *testing.T) {
+	t.Setenv("MAX_OUTPUT_BYTES", "10000")
+	srv := newTestServer(t)
+	for _, tc := range []struct {
+		perJob int
+		want   int
+	}{
+		{0, 10000},
+		{100, 100},
+		// A job can't raise the server's limit.
+		{1 << 30, 10000},
+	} {
+		id := submit(t, srv.URL, fmt.Sprintf(`{"args": ["yes"], "max_output_bytes": %d}`, tc.perJob))
+		meta := waitFinished(t, srv.URL, id)
+		if meta.Status != "OUTPUT_LIMIT_EXCEEDED" || meta.Error != fmt.Sprintf("output exceeded %d bytes", tc.want) {
+			t.Errorf("max_output_bytes %d: %s %q", tc.perJob, meta.Status, meta.Error)
+		}
+		_, out := do(t, http.MethodGet, srv.URL+"/jobs/"+id+"/result?partial=true", "", "")
+		if len(out) != tc.want {
+			t.Errorf("max_output_bytes %d: kept %d bytes of output, want %d", tc.perJob, len(out), tc.want)
+		}
+	}
+
+	id := submit(t, srv.URL, `{"args": ["sh", "-c", "head -c 9000 /dev/zero"]}`)
+	if meta := waitFinished(t, srv.URL, id); meta.Status != "COMPLETED" {
+		t.Errorf("job under the limit: %s %q", meta.Status, meta.Error)
+	}
+}
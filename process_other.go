@@ -0,0 +1,25 @@
+//go:build !unix
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup is a no-op where process groups aren't supported.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// signalProcessGroup kills the process itself; signals other than SIGKILL and
+// child processes can't be reached on this platform.
+func signalProcessGroup(pid int, sig syscall.Signal) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return p.Kill()
+}
+
+// setNiceness is a no-op where niceness isn't supported.
+func setNiceness(pid, nice int) error { return nil }
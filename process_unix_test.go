@@ -0,0 +1,38 @@
+//go:build unix
+
+package main
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestNice(t *testing.T) {
+	srv := newTestServer(t)
+	// The niceness is set right after the process starts, so give it a
+	// moment before reading it back.
+	id := submit(t, srv.URL, `{"args": ["sh", "-c", "sleep 0.3; nice"], "nice": 7}`)
+	if out := catOutput(t, srv.URL, id); strings.TrimSpace(out) != "7" {
+		t.Errorf("niceness of job with nice 7: %q", out)
+	}
+	for job, want := range map[string]int{
+		`{"args": ["nice"], "nice": 20}`:  http.StatusBadRequest,
+		`{"args": ["nice"], "nice": -21}`: http.StatusBadRequest,
+		`{"args": ["nice"], "nice": -5}`:  http.StatusForbidden,
+	} {
+		if status, body := do(t, http.MethodPost, srv.URL+"/jobs", "application/json", job); status != want {
+			t.Errorf("submit %s: %d %s", job, status, body)
+		}
+	}
+
+	if os.Geteuid() != 0 {
+		t.Skip("raising priority needs root")
+	}
+	t.Setenv("ALLOW_NEGATIVE_NICE", "1")
+	id = submit(t, srv.URL, `{"args": ["sh", "-c", "sleep 0.3; nice"], "nice": -5}`)
+	if out := catOutput(t, srv.URL, id); strings.TrimSpace(out) != "-5" {
+		t.Errorf("niceness of job with nice -5: %q", out)
+	}
+}
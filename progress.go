@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// maxProgressLine caps how much of a progress report is read.
+const maxProgressLine = 1024
+
+// jobProgress is what a job last reported through its JOB_PROGRESS_FILE.
+type jobProgress struct {
+	Percent *float64 `json:"percent,omitempty"`
+	Message string   `json:"message,omitempty"`
+}
+
+// progressPath is the file a job running in jobDir may write its progress to.
+// Its path is passed to the command in JOB_PROGRESS_FILE.
+func progressPath(jobDir string) string {
+	return filepath.Join(jobDir, "progress")
+}
+
+// readProgress returns the progress last reported by job id, or nil if it
+// hasn't reported any. The command may rewrite the file or append to it; only
+// its last line counts. A line starting with a number from 0 to 100,
+// optionally followed by "%", reports that percentage and an optional message
+// after it, e.g. "42% processing chunk 3 of 7"; any other line is just a
+// message. Only a regular file is read: the job could otherwise replace it
+// with a symlink to any file the server can read.
+func readProgress(ns, id string) *jobProgress {
+	path := progressPath(getJobDir(ns, id))
+	linfo, err := os.Lstat(path)
+	if err != nil || !linfo.Mode().IsRegular() {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	// The file may have been swapped between the Lstat and the Open.
+	info, err := f.Stat()
+	if err != nil || !os.SameFile(info, linfo) {
+		return nil
+	}
+	start, err := lastLinesOffset(f, info.Size(), 1)
+	if err != nil {
+		return nil
+	}
+	line, err := io.ReadAll(io.NewSectionReader(f, start, min(info.Size()-start, maxProgressLine)))
+	if err != nil {
+		return nil
+	}
+	return parseProgress(string(line))
+}
+
+func parseProgress(line string) *jobProgress {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return nil
+	}
+	first, rest, _ := strings.Cut(line, " ")
+	percent, err := strconv.ParseFloat(strings.TrimSuffix(first, "%"), 64)
+	if err != nil || !(percent >= 0 && percent <= 100) {
+		return &jobProgress{Message: line}
+	}
+	return &jobProgress{Percent: &percent, Message: strings.TrimSpace(rest)}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseProgress(t *testing.T) {
+	for _, tc := range []struct {
+		line    string
+		percent float64 // -1 for none
+		message string
+	}{
+		{"42", 42, ""},
+		{"42.5% processing chunk 3 of 7\n", 42.5, "processing chunk 3 of 7"},
+		{"100%", 100, ""},
+		{"0 starting", 0, "starting"},
+		{"150% too much", -1, "150% too much"},
+		{"-5", -1, "-5"},
+		{"NaN", -1, "NaN"},
+		{"downloading", -1, "downloading"},
+	} {
+		p := parseProgress(tc.line)
+		if p == nil {
+			t.Errorf("%q: no progress", tc.line)
+			continue
+		}
+		if (p.Percent == nil) != (tc.percent < 0) || p.Percent != nil && *p.Percent != tc.percent || p.Message != tc.message {
+			t.Errorf("%q: %v %q, want %v %q", tc.line, p.Percent, p.Message, tc.percent, tc.message)
+		}
+	}
+	if p := parseProgress(" \n"); p != nil {
+		t.Errorf("blank line: %+v", p)
+	}
+}
+
+func TestJobProgress(t *testing.T) {
+	srv := newTestServer(t)
+	done := filepath.Join(t.TempDir(), "done")
+	// The job reports twice, then waits for the test to let it finish.
+	script := fmt.Sprintf(`echo "10%% starting" > "$JOB_PROGRESS_FILE"; echo "42%% chunk 3 of 7" >> "$JOB_PROGRESS_FILE"; while [ ! -e %s ]; do sleep 0.01; done`, done)
+	id := submit(t, srv.URL, fmt.Sprintf(`{"args": ["sh", "-c", %q]}`, script))
+	var meta *JobMeta
+	eventually(t, "no progress reported", func() bool {
+		meta = getStatus(t, srv.URL, id)
+		return meta.Progress != nil && meta.Progress.Percent != nil && *meta.Progress.Percent == 42
+	})
+	if meta.Status != "IN_PROGRESS" || meta.Progress.Message != "chunk 3 of 7" {
+		t.Errorf("status %s, progress message %q", meta.Status, meta.Progress.Message)
+	}
+	os.WriteFile(done, nil, 0644)
+	waitFinished(t, srv.URL, id)
+
+	if meta := getStatus(t, srv.URL, submit(t, srv.URL, `{"args": ["true"]}`)); meta.Progress != nil {
+		t.Errorf("progress of a job that reported none: %+v", meta.Progress)
+	}
+}
+
+func TestProgressFileSymlinkIgnored(t *testing.T) {
+	srv := newTestServer(t)
+	secret := filepath.Join(t.TempDir(), "secret")
+	os.WriteFile(secret, []byte("50% the server's secret\n"), 0600)
+	id := submit(t, srv.URL, fmt.Sprintf(`{"args": ["sh", "-c", "ln -sf %s \"$JOB_PROGRESS_FILE\""]}`, secret))
+	if meta := waitFinished(t, srv.URL, id); meta.Status != "COMPLETED" || meta.Progress != nil {
+		t.Errorf("job that linked its progress file elsewhere: %s, progress %+v", meta.Status, meta.Progress)
+	}
+}
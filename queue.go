@@ -0,0 +1,185 @@
+package main
+
+import (
+	"container/heap"
+	"os"
+	"sync"
+)
+
+// jobQueue holds jobs waiting for a worker slot. Jobs are handed out highest
+// priority first, then oldest enqueue time first.
+//
+// With FAIR_SHARE_LABEL set, jobs are grouped by the value of that label and
+// the groups take turns instead: the next job comes from the group served
+// least recently, so one tenant flooding the queue can't starve the others.
+// Within a group the usual order applies.
+type jobQueue struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	items jobHeap
+	seq   uint64
+	// served records when each group with queued jobs last had a job
+	// handed out, as a value of turn.
+	served map[string]uint64
+	turn   uint64
+}
+
+func newJobQueue() *jobQueue {
+	q := &jobQueue{served: make(map[string]uint64)}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// Push adds a job to the queue and wakes the worker.
+func (q *jobQueue) Push(qj *queuedJob) {
+	q.mu.Lock()
+	q.seq++
+	qj.seq = q.seq
+	heap.Push(&q.items, qj)
+	q.mu.Unlock()
+	q.cond.Signal()
+}
+
+// Pop blocks until a job is available and removes the next one to run.
+func (q *jobQueue) Pop() *queuedJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.items) == 0 {
+		q.cond.Wait()
+	}
+	label := os.Getenv("FAIR_SHARE_LABEL")
+	if label == "" {
+		return heap.Pop(&q.items).(*queuedJob)
+	}
+	qj := heap.Remove(&q.items, fairNext(q.items, label, q.served)).(*queuedJob)
+	group := qj.meta.Labels[label]
+	q.turn++
+	q.served[group] = q.turn
+	// Forget groups that have nothing left queued, so the map doesn't grow
+	// with every label value ever seen.
+	for g := range q.served {
+		if !q.items.hasGroup(label, g) {
+			delete(q.served, g)
+		}
+	}
+	return qj
+}
+
+// fairNext returns the index in items of the next job to run under fair
+// scheduling: the best job of the group served least recently.
+func fairNext(items jobHeap, label string, served map[string]uint64) int {
+	next := 0
+	for i := 1; i < len(items); i++ {
+		a, b := items[i], items[next]
+		sa, sb := served[a.meta.Labels[label]], served[b.meta.Labels[label]]
+		if sa < sb || (sa == sb && items.less(a, b)) {
+			next = i
+		}
+	}
+	return next
+}
+
+// hasGroup reports whether any job in h has value g for label.
+func (h jobHeap) hasGroup(label, g string) bool {
+	for _, qj := range h {
+		if qj.meta.Labels[label] == g {
+			return true
+		}
+	}
+	return false
+}
+
+// Position returns the 1-based place of job id in the queue, i.e. 1 for the
+// job that runs next, or 0 if it isn't queued.
+func (q *jobQueue) Position(id string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if label := os.Getenv("FAIR_SHARE_LABEL"); label != "" {
+		return q.fairPosition(id, label)
+	}
+	for _, qj := range q.items {
+		if qj.meta.ID != id {
+			continue
+		}
+		pos := 1
+		for i := range q.items {
+			if q.items[i] != qj && q.items.less(q.items[i], qj) {
+				pos++
+			}
+		}
+		return pos
+	}
+	return 0
+}
+
+// fairPosition works out the place of job id under fair scheduling by
+// replaying the order in which the queued jobs would be handed out.
+func (q *jobQueue) fairPosition(id, label string) int {
+	items := append(jobHeap(nil), q.items...)
+	served := make(map[string]uint64, len(q.served))
+	for g, t := range q.served {
+		served[g] = t
+	}
+	turn := q.turn
+	for pos := 1; len(items) > 0; pos++ {
+		i := fairNext(items, label, served)
+		if items[i].meta.ID == id {
+			return pos
+		}
+		turn++
+		served[items[i].meta.Labels[label]] = turn
+		items = append(items[:i], items[i+1:]...)
+	}
+	return 0
+}
+
+// Remove takes job id out of the queue and reports whether it was there.
+func (q *jobQueue) Remove(id string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, qj := range q.items {
+		if qj.meta.ID == id {
+			heap.Remove(&q.items, i)
+			return true
+		}
+	}
+	return false
+}
+
+// Len returns the number of jobs waiting in the queue.
+func (q *jobQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+// jobHeap implements heap.Interface over queued jobs.
+type jobHeap []*queuedJob
+
+func (h jobHeap) Len() int { return len(h) }
+
+func (h jobHeap) Less(i, j int) bool { return h.less(h[i], h[j]) }
+
+// less reports whether a runs before b.
+func (jobHeap) less(a, b *queuedJob) bool {
+	if a.meta.Priority != b.meta.Priority {
+		return a.meta.Priority > b.meta.Priority
+	}
+	if !a.meta.EnqueuedAt.Equal(b.meta.EnqueuedAt) {
+		return a.meta.EnqueuedAt.Before(b.meta.EnqueuedAt)
+	}
+	return a.seq < b.seq
+}
+
+func (h jobHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *jobHeap) Push(x any) { *h = append(*h, x.(*queuedJob)) }
+
+func (h *jobHeap) Pop() any {
+	old := *h
+	n := len(old)
+	qj := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return qj
+}
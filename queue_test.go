@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// queueOf returns a new queue holding jobs named by ids, pushed in that
+// order, each set up by configure.
+func queueOf(ids []string, configure func(i int, meta *JobMeta)) *jobQueue {
+	q := newJobQueue()
+	start := time.Now()
+	for i, id := range ids {
+		meta := &JobMeta{ID: id, EnqueuedAt: start.Add(time.Duration(i) * time.Millisecond)}
+		configure(i, meta)
+		q.Push(&queuedJob{meta: meta})
+	}
+	return q
+}
+
+// drain pops every job off q and returns their IDs in the order they came.
+func drain(q *jobQueue) string {
+	var ids []string
+	for q.Len() > 0 {
+		ids = append(ids, q.Pop().meta.ID)
+	}
+	return strings.Join(ids, " ")
+}
+
+func TestQueuePriority(t *testing.T) {
+	priorities := map[string]int{"a": 0, "b": 5, "c": 0, "d": 10, "e": -1, "f": 5}
+	q := queueOf([]string{"a", "b", "c", "d", "e", "f"}, func(i int, meta *JobMeta) {
+		meta.Priority = priorities[meta.ID]
+	})
+	if pos := q.Position("f"); pos != 3 {
+		t.Errorf("Position(f) = %d, want 3", pos)
+	}
+	if got, want := drain(q), "d b f a c e"; got != want {
+		t.Errorf("jobs ran in order %q, want %q", got, want)
+	}
+}
+
+func TestQueueKeepsSubmissionOrderForEqualTimes(t *testing.T) {
+	q := queueOf([]string{"a", "b", "c"}, func(i int, meta *JobMeta) {
+		meta.EnqueuedAt = time.Unix(0, 0)
+	})
+	if !q.Remove("b") {
+		t.Fatal("Remove(b) = false")
+	}
+	if got := drain(q); got != "a c" {
+		t.Errorf("jobs ran in order %q", got)
+	}
+}
+
+func TestQueueFairShare(t *testing.T) {
+	ids := []string{"a1", "a2", "a3", "a4", "b1", "b2", "c"}
+	configure := func(i int, meta *JobMeta) {
+		if tenant := meta.ID[:1]; tenant != "c" {
+			meta.Labels = map[string]string{"tenant": tenant}
+		}
+	}
+	if got := drain(queueOf(ids, configure)); got != "a1 a2 a3 a4 b1 b2 c" {
+		t.Errorf("without FAIR_SHARE_LABEL jobs ran in order %q", got)
+	}
+
+	t.Setenv("FAIR_SHARE_LABEL", "tenant")
+	q := queueOf(ids, configure)
+	// Jobs without the label share a group of their own.
+	want := "a1 b1 c a2 b2 a3 a4"
+	for pos, id := range strings.Fields(want) {
+		if got := q.Position(id); got != pos+1 {
+			t.Errorf("Position(%s) = %d, want %d", id, got, pos+1)
+		}
+	}
+	if got := drain(q); got != want {
+		t.Errorf("jobs ran in order %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// submitLimiters holds a token bucket per client for rate limiting job
+// submissions. Buckets unused for limiterIdleTTL are dropped.
+var submitLimiters = struct {
+	sync.Mutex
+	byClient  map[string]*clientLimiter
+	lastSweep time.Time
+}{byClient: make(map[string]*clientLimiter)}
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+const limiterIdleTTL = 10 * time.Minute
+
+// allowSubmission applies RATE_LIMIT_RPS and RATE_LIMIT_BURST to a job
+// submission. Over the limit it answers 429 with a Retry-After header and
+// returns false. Rate limiting is off while RATE_LIMIT_RPS is unset or 0.
+func allowSubmission(w http.ResponseWriter, r *http.Request) bool {
+	rps := envFloat("RATE_LIMIT_RPS", 0)
+	if rps <= 0 {
+		return true
+	}
+	burst := max(envInt("RATE_LIMIT_BURST", int(math.Ceil(rps))), 1)
+	now := time.Now()
+
+	submitLimiters.Lock()
+	if now.Sub(submitLimiters.lastSweep) > limiterIdleTTL {
+		for client, cl := range submitLimiters.byClient {
+			if now.Sub(cl.lastSeen) > limiterIdleTTL {
+				delete(submitLimiters.byClient, client)
+			}
+		}
+		submitLimiters.lastSweep = now
+	}
+	client := rateLimitKey(r)
+	cl, ok := submitLimiters.byClient[client]
+	if !ok {
+		cl = &clientLimiter{limiter: rate.NewLimiter(rate.Limit(rps), burst)}
+		submitLimiters.byClient[client] = cl
+	}
+	cl.lastSeen = now
+	res := cl.limiter.ReserveN(now, 1)
+	delay := res.DelayFrom(now)
+	if delay > 0 {
+		res.CancelAt(now)
+	}
+	submitLimiters.Unlock()
+
+	if delay == 0 {
+		return true
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+	httpError(w, "Too many requests", http.StatusTooManyRequests)
+	rateLimitedRequests.Inc()
+	return false
+}
+
+// rateLimitKey identifies the client a request is counted against: its API
+// key when API_KEY authentication is on, or its IP address otherwise.
+func rateLimitKey(r *http.Request) string {
+	if os.Getenv("API_KEY") != "" {
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			return "key:" + token
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
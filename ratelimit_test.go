@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSubmissionRateLimit(t *testing.T) {
+	t.Setenv("RATE_LIMIT_RPS", "0.1")
+	t.Setenv("RATE_LIMIT_BURST", "2")
+	srv := newTestServer(t)
+	submitLimiters.Lock()
+	clear(submitLimiters.byClient)
+	submitLimiters.Unlock()
+
+	submit(t, srv.URL, `{"args": ["true"]}`)
+	submit(t, srv.URL, `{"args": ["true"]}`)
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/jobs", strings.NewReader(`{"args": ["true"]}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("submission over the limit: %d", resp.StatusCode)
+	}
+	if after, err := strconv.Atoi(resp.Header.Get("Retry-After")); err != nil || after < 1 || after > 10 {
+		t.Errorf("Retry-After = %q", resp.Header.Get("Retry-After"))
+	}
+	if status, body := do(t, http.MethodPost, srv.URL+"/jobs/batch", "application/json", `[{"args": ["true"]}]`); status != http.StatusTooManyRequests {
+		t.Errorf("batch over the limit: %d %s", status, body)
+	}
+
+	for i := 0; i < 5; i++ {
+		if status, _ := do(t, http.MethodGet, srv.URL+"/healthz", "", ""); status != http.StatusOK {
+			t.Fatalf("healthz while rate limited: %d", status)
+		}
+		if status, _ := do(t, http.MethodGet, srv.URL+"/metrics", "", ""); status != http.StatusOK {
+			t.Fatalf("metrics while rate limited: %d", status)
+		}
+	}
+}
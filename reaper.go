@@ -0,0 +1,80 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// orphanInputGrace is how old a staged input must be before the reaper may
+// remove it, so an input being written for a job whose metadata hasn't been
+// saved yet is left alone.
+const orphanInputGrace = 10 * time.Minute
+
+// reapLoop removes orphaned staged inputs at startup and then every
+// INPUT_REAP_INTERVAL.
+func reapLoop() {
+	ticker := time.NewTicker(envDuration("INPUT_REAP_INTERVAL", time.Hour))
+	defer ticker.Stop()
+	for {
+		reapInputs()
+		<-ticker.C
+	}
+}
+
+// reapInputs removes staged input files that no unfinished job will read:
+// leftovers from a server that crashed before cleaning up after a job, or
+// from jobs deleted behind its back. Partial copies of a stdin_from_job
+// source's output, left by a crash while the copy was made, go the same way.
+func reapInputs() {
+	entries, err := os.ReadDir(getInputDir())
+	if err != nil {
+		slog.Warn("Failed to read input directory", "event", "reap_error", "error", err)
+		return
+	}
+	pending := make(map[string]bool)
+	for _, meta := range loadAllMetas() {
+		if !isTerminal(meta.Status) {
+			pending[meta.ID] = true
+		}
+	}
+	removed := 0
+	for _, entry := range entries {
+		id := stagedFileJobID(entry.Name())
+		if !validJobID(id) || pending[id] {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < orphanInputGrace {
+			continue
+		}
+		if err := os.Remove(filepath.Join(getInputDir(), entry.Name())); err == nil {
+			removed++
+		}
+	}
+	if removed > 0 {
+		slog.Info("Removed orphaned inputs", "event", "inputs_reaped", "count", removed)
+	}
+}
+
+// stagedFileJobID returns the ID of the job a file in the input directory was
+// written for: a staged input named by inputPath, or a copy being made by
+// copySourceOutput, named pipe-<id>-<random>.tmp. It returns "" for any other
+// file.
+func stagedFileJobID(name string) string {
+	rest, ok := strings.CutSuffix(name, ".tmp")
+	if !ok {
+		return ""
+	}
+	if id, ok := strings.CutPrefix(rest, "input-"); ok {
+		return id
+	}
+	if rest, ok := strings.CutPrefix(rest, "pipe-"); ok {
+		if i := strings.LastIndexByte(rest, '-'); i >= 0 {
+			return rest[:i]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestReapInputs(t *testing.T) {
+	srv := newTestServer(t)
+	held := submit(t, srv.URL, `{"args": ["true"], "hold": true}`)
+	orphan := uuid.NewString()
+	files := []struct {
+		name   string
+		old    bool
+		reaped bool
+	}{
+		{"input-" + orphan + ".tmp", true, true},
+		{"pipe-" + orphan + "-123456.tmp", true, true},
+		// Within the grace period: the job may not have been saved yet.
+		{"pipe-" + uuid.NewString() + "-123456.tmp", false, false},
+		// For a job that hasn't run yet.
+		{"input-" + held + ".tmp", true, false},
+		{"pipe-" + held + "-123456.tmp", true, false},
+		{"notes.txt", true, false},
+	}
+	old := time.Now().Add(-2 * orphanInputGrace)
+	for _, f := range files {
+		path := filepath.Join(getInputDir(), f.name)
+		if err := os.WriteFile(path, []byte("x"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if f.old {
+			os.Chtimes(path, old, old)
+		}
+	}
+	reapInputs()
+	for _, f := range files {
+		_, err := os.Stat(filepath.Join(getInputDir(), f.name))
+		if gone := os.IsNotExist(err); gone != f.reaped {
+			t.Errorf("%s: removed %v, want %v", f.name, gone, f.reaped)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// lockedBuffer is a bytes.Buffer safe for the concurrent writes of a logger.
+type lockedBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (l *lockedBuffer) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.b.Write(p)
+}
+
+func (l *lockedBuffer) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.b.String()
+}
+
+// requestIDOf sends a GET for /healthz with the given X-Request-ID, if any,
+// and returns the one echoed back.
+func requestIDOf(t *testing.T, base, sent string) string {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, base+"/healthz", nil)
+	if sent != "" {
+		req.Header.Set("X-Request-ID", sent)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.Header.Get("X-Request-ID")
+}
+
+func TestRequestID(t *testing.T) {
+	srv := newTestServer(t)
+	if got := requestIDOf(t, srv.URL, "trace-123"); got != "trace-123" {
+		t.Errorf("X-Request-ID echoed as %q", got)
+	}
+	generated := requestIDOf(t, srv.URL, "")
+	if uuid.Validate(generated) != nil {
+		t.Errorf("generated X-Request-ID %q", generated)
+	}
+	if other := requestIDOf(t, srv.URL, ""); other == generated {
+		t.Error("two requests got the same generated ID")
+	}
+	for _, bad := range []string{"has space", strings.Repeat("x", maxRequestIDLength+1)} {
+		if got := requestIDOf(t, srv.URL, bad); got == bad || uuid.Validate(got) != nil {
+			t.Errorf("X-Request-ID %q replaced by %q", bad, got)
+		}
+	}
+}
+
+func TestRequestIDIsLogged(t *testing.T) {
+	var logs lockedBuffer
+	orig := slog.Default()
+	slog.SetDefault(slog.New(contextHandler{slog.NewJSONHandler(&logs, nil)}))
+	defer slog.SetDefault(orig)
+	srv := newTestServer(t)
+
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/jobs", strings.NewReader(`{"args": ["true"]}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Request-ID", "submit-42")
+	if status, body := send(t, req); status != http.StatusOK {
+		t.Fatalf("submit: %d %s", status, body)
+	}
+	var events []string
+	scanner := bufio.NewScanner(strings.NewReader(logs.String()))
+	for scanner.Scan() {
+		var line struct {
+			Event     string `json:"event"`
+			RequestID string `json:"request_id"`
+		}
+		if json.Unmarshal(scanner.Bytes(), &line) == nil && line.RequestID == "submit-42" {
+			events = append(events, line.Event)
+		}
+	}
+	if !slices.Contains(events, "request") {
+		t.Errorf("log events with the request ID: %q", events)
+	}
+}
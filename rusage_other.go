@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// recordUsage is a no-op where rusage isn't available.
+func recordUsage(meta *JobMeta, state *os.ProcessState) {}
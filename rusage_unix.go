@@ -0,0 +1,28 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// recordUsage copies the CPU time and peak memory of a finished process into
+// meta.
+func recordUsage(meta *JobMeta, state *os.ProcessState) {
+	if state == nil {
+		return
+	}
+	ru, ok := state.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return
+	}
+	meta.CPUUserMs = ru.Utime.Nano() / 1e6
+	meta.CPUSystemMs = ru.Stime.Nano() / 1e6
+	// ru_maxrss is in kilobytes, except on macOS where it is in bytes.
+	meta.MaxRSSKB = int64(ru.Maxrss)
+	if runtime.GOOS == "darwin" || runtime.GOOS == "ios" {
+		meta.MaxRSSKB /= 1024
+	}
+}
@@ -0,0 +1,29 @@
+//go:build unix
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestResourceUsage(t *testing.T) {
+	srv := newTestServer(t)
+	// Busy-loop for a while so the job uses measurable CPU time.
+	id := submit(t, srv.URL, `{"args": ["sh", "-c", "i=0; while [ $i -lt 200000 ]; do i=$((i+1)); done"]}`)
+	meta := waitFinished(t, srv.URL, id)
+	if meta.Status != "COMPLETED" {
+		t.Fatalf("job %s: %s", meta.Status, meta.Error)
+	}
+	if meta.CPUUserMs <= 0 || meta.MaxRSSKB <= 0 {
+		t.Errorf("usage not recorded: cpu_user_ms %d, cpu_system_ms %d, max_rss_kb %d", meta.CPUUserMs, meta.CPUSystemMs, meta.MaxRSSKB)
+	}
+	_, body := do(t, http.MethodGet, srv.URL+"/jobs/"+id+"/status", "", "")
+	// cpu_system_ms is left out when the job spent no time in the kernel.
+	for _, field := range []string{"cpu_user_ms", "max_rss_kb"} {
+		if !strings.Contains(body, `"`+field+`"`) {
+			t.Errorf("status response has no %s: %s", field, body)
+		}
+	}
+}
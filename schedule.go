@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/robfig/cron/v3"
+)
+
+// scheduledJobs tracks SCHEDULED jobs by ID with their namespace and the time
+// they become due.
+var scheduledJobs = struct {
+	sync.Mutex
+	due map[string]scheduledJob
+}{due: make(map[string]scheduledJob)}
+
+type scheduledJob struct {
+	namespace string
+	runAt     time.Time
+}
+
+// scheduleJob arranges for a SCHEDULED job to be queued once runAt arrives.
+func scheduleJob(ns, id string, runAt time.Time) {
+	scheduledJobs.Lock()
+	scheduledJobs.due[id] = scheduledJob{namespace: ns, runAt: runAt}
+	scheduledJobs.Unlock()
+}
+
+// scheduleLoop moves SCHEDULED jobs into the queue as they fall due.
+func scheduleLoop() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		enqueueDueJobs(time.Now())
+	}
+}
+
+func enqueueDueJobs(now time.Time) {
+	ready := make(map[string]string)
+	scheduledJobs.Lock()
+	for id, sj := range scheduledJobs.due {
+		if !sj.runAt.After(now) {
+			ready[id] = sj.namespace
+			delete(scheduledJobs.due, id)
+		}
+	}
+	scheduledJobs.Unlock()
+
+	for id, ns := range ready {
+		mu.Lock()
+		meta, err := loadMeta(ns, id)
+		// The job may have been deleted or released while it waited.
+		if err != nil || meta.Status != "SCHEDULED" {
+			mu.Unlock()
+			continue
+		}
+		meta.Status = "IN_QUEUE"
+		saveMeta(meta)
+		mu.Unlock()
+		notifyTransition(meta)
+		queue.Push(&queuedJob{meta: meta, inputFilePath: stagedInput(id)})
+		slog.Debug("Scheduled job due", "event", "job_due", "job_id", id)
+	}
+}
+
+// Schedule is a recurring job registered with a cron expression. Each time the
+// expression fires, a new job is created from Job and linked back to the
+// schedule through its parent_schedule_id. A schedule belongs to the
+// namespace of its job. As for jobs, the values of its environment variables
+// and webhook headers are kept in separate files and only their names are
+// shown.
+type Schedule struct {
+	ID                string     `json:"id"`
+	Spec              string     `json:"schedule"`
+	Job               jobRequest `json:"job"`
+	EnvKeys           []string   `json:"env_keys,omitempty"`
+	WebhookHeaderKeys []string   `json:"webhook_header_keys,omitempty"`
+	CreatedAt         time.Time  `json:"created_at"`
+	NextRun           *time.Time `json:"next_run,omitempty"`
+}
+
+// cronScheduler runs the registered schedules. Schedules are persisted as
+// JSON files under JOBS_DIR/schedules so they survive restarts.
+type cronScheduler struct {
+	mu        sync.Mutex
+	cron      *cron.Cron
+	entries   map[string]cron.EntryID
+	schedules map[string]*Schedule
+	fixedArgs []string
+}
+
+var schedules *cronScheduler
+
+func schedulesDir() string {
+	return filepath.Join(getJobsDir(), "schedules")
+}
+
+// startSchedules loads the persisted schedules and starts running them.
+func startSchedules(fixedArgs []string) {
+	schedules = &cronScheduler{
+		cron:      cron.New(),
+		entries:   make(map[string]cron.EntryID),
+		schedules: make(map[string]*Schedule),
+		fixedArgs: fixedArgs,
+	}
+	entries, _ := os.ReadDir(schedulesDir())
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(schedulesDir(), entry.Name()))
+		if err != nil {
+			continue
+		}
+		var sched Schedule
+		if err := json.Unmarshal(data, &sched); err != nil {
+			continue
+		}
+		if err := loadScheduleSecrets(&sched); err != nil {
+			slog.Warn("Failed to load schedule", "event", "schedule_error", "schedule_id", sched.ID, "error", err)
+			continue
+		}
+		if err := schedules.add(&sched); err != nil {
+			slog.Warn("Failed to load schedule", "event", "schedule_error", "schedule_id", sched.ID, "error", err)
+		}
+	}
+	schedules.cron.Start()
+}
+
+// Create validates and registers a new schedule running req on spec.
+func (s *cronScheduler) Create(spec string, req *jobRequest) (*Schedule, error) {
+	if err := checkSchedule(spec, req); err != nil {
+		return nil, err
+	}
+	check := *req
+	if _, err := prepareJob(&check, s.fixedArgs); err != nil {
+		return nil, err
+	}
+	sched := &Schedule{ID: uuid.NewString(), Spec: spec, Job: *req, CreatedAt: time.Now()}
+	if err := saveSchedule(sched); err != nil {
+		return nil, err
+	}
+	if err := s.add(sched); err != nil {
+		return nil, err
+	}
+	out, _ := s.Get(sched.Job.Namespace, sched.ID)
+	return out, nil
+}
+
+// saveSchedule writes a schedule to JOBS_DIR/schedules/<id>.json, with its
+// environment variables in <id>.env and its webhook headers in
+// <id>.webhook_headers, readable only by the server, as saveJobEnv and
+// saveWebhookHeaders do for jobs.
+func saveSchedule(sched *Schedule) error {
+	if err := os.MkdirAll(schedulesDir(), 0755); err != nil {
+		return err
+	}
+	stored := *sched
+	stored.Job.Env = nil
+	stored.Job.WebhookHeaders = nil
+	stored.EnvKeys = sortedKeys(sched.Job.Env)
+	stored.WebhookHeaderKeys = sortedKeys(sched.Job.WebhookHeaders)
+	for ext, values := range map[string]map[string]string{".env": sched.Job.Env, ".webhook_headers": sched.Job.WebhookHeaders} {
+		if len(values) == 0 {
+			continue
+		}
+		data, _ := json.Marshal(values)
+		if err := os.WriteFile(filepath.Join(schedulesDir(), sched.ID+ext), data, 0600); err != nil {
+			return err
+		}
+	}
+	data, _ := json.MarshalIndent(stored, "", "  ")
+	return os.WriteFile(filepath.Join(schedulesDir(), sched.ID+".json"), data, 0644)
+}
+
+// loadScheduleSecrets reads back the environment variables and webhook
+// headers saveSchedule stored apart. Schedules saved before that was done
+// have them inline; those are rewritten in the current form.
+func loadScheduleSecrets(sched *Schedule) error {
+	if len(sched.Job.Env) > 0 || len(sched.Job.WebhookHeaders) > 0 {
+		return saveSchedule(sched)
+	}
+	if len(sched.EnvKeys) > 0 {
+		if err := readScheduleFile(sched.ID+".env", &sched.Job.Env); err != nil {
+			return err
+		}
+	}
+	if len(sched.WebhookHeaderKeys) > 0 {
+		if err := readScheduleFile(sched.ID+".webhook_headers", &sched.Job.WebhookHeaders); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readScheduleFile(name string, v any) error {
+	data, err := os.ReadFile(filepath.Join(schedulesDir(), name))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// checkSchedule validates a cron expression and the parts of a job request
+// that can't be combined with a schedule.
+func checkSchedule(spec string, req *jobRequest) error {
+	if _, err := cron.ParseStandard(spec); err != nil {
+		return badRequest("Invalid schedule: %v", err)
+	}
+	if req.RunAt != nil || req.Delay > 0 {
+		return badRequest("run_at and delay_seconds can't be combined with schedule")
+	}
+	if len(req.files) > 0 {
+		return badRequest("Uploaded files can't be combined with schedule")
+	}
+	return nil
+}
+
+func (s *cronScheduler) add(sched *Schedule) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entryID, err := s.cron.AddFunc(sched.Spec, func() { s.spawn(sched) })
+	if err != nil {
+		return err
+	}
+	s.entries[sched.ID] = entryID
+	s.schedules[sched.ID] = sched
+	return nil
+}
+
+// spawn creates a fresh job instance from a schedule.
+func (s *cronScheduler) spawn(sched *Schedule) {
+	if shuttingDown.Load() {
+		return
+	}
+	req := sched.Job
+	req.parentScheduleID = sched.ID
+	meta, err := createJob(context.Background(), &req, nil, s.fixedArgs)
+	if err != nil {
+		slog.Warn("Failed to create scheduled job", "event", "schedule_error", "schedule_id", sched.ID, "error", err)
+		return
+	}
+	slog.Info("Created scheduled job", "event", "schedule_run", "schedule_id", sched.ID, "job_id", meta.ID)
+}
+
+// Get returns a schedule in namespace ns with its next run time filled in,
+// and only the names of its environment variables and webhook headers.
+func (s *cronScheduler) Get(ns, id string) (*Schedule, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sched, ok := s.schedules[id]
+	if !ok || sched.Job.Namespace != ns {
+		return nil, false
+	}
+	out := *sched
+	out.Job.Env = nil
+	out.Job.WebhookHeaders = nil
+	out.EnvKeys = sortedKeys(sched.Job.Env)
+	out.WebhookHeaderKeys = sortedKeys(sched.Job.WebhookHeaders)
+	if next := s.cron.Entry(s.entries[id]).Next; !next.IsZero() {
+		out.NextRun = &next
+	}
+	return &out, true
+}
+
+// List returns the schedules in namespace ns, oldest first.
+func (s *cronScheduler) List(ns string) []*Schedule {
+	s.mu.Lock()
+	ids := make([]string, 0, len(s.schedules))
+	for id := range s.schedules {
+		ids = append(ids, id)
+	}
+	s.mu.Unlock()
+	list := []*Schedule{}
+	for _, id := range ids {
+		if sched, ok := s.Get(ns, id); ok {
+			list = append(list, sched)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+	return list
+}
+
+// Delete stops a schedule in namespace ns and removes it from disk. Jobs it
+// already created are left alone.
+func (s *cronScheduler) Delete(ns, id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entryID, ok := s.entries[id]
+	if !ok || s.schedules[id].Job.Namespace != ns {
+		return false
+	}
+	s.cron.Remove(entryID)
+	delete(s.entries, id)
+	delete(s.schedules, id)
+	os.Remove(filepath.Join(schedulesDir(), id+".json"))
+	os.Remove(filepath.Join(schedulesDir(), id+".env"))
+	os.Remove(filepath.Join(schedulesDir(), id+".webhook_headers"))
+	return true
+}
+
+// schedulesHandler serves GET /schedules, GET /schedules/{id} and
+// DELETE /schedules/{id}. Schedules are created through POST /jobs with a
+// "schedule" field. Like jobs, schedules are only visible in their own
+// namespace.
+func schedulesHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/schedules"), "/")
+	if id == "" && !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+		return
+	}
+	if id != "" && !allowMethods(w, r, http.MethodGet, http.MethodHead, http.MethodDelete) {
+		return
+	}
+	ns, err := requestNamespace(r)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch {
+	case id == "":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(schedules.List(ns))
+	case r.Method != http.MethodDelete:
+		sched, ok := schedules.Get(ns, id)
+		if !ok {
+			httpError(w, "Schedule not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sched)
+	default:
+		if !schedules.Delete(ns, id) {
+			httpError(w, "Schedule not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// createTestSchedule submits a recurring job and returns the schedule as
+// created.
+func createTestSchedule(t *testing.T, base, ns, body string) *Schedule {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, base+"/jobs", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if ns != "" {
+		req.Header.Set("X-Namespace", ns)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("creating schedule: status %d", resp.StatusCode)
+	}
+	var sched Schedule
+	if err := json.NewDecoder(resp.Body).Decode(&sched); err != nil {
+		t.Fatal(err)
+	}
+	return &sched
+}
+
+// scheduleRequest sends method to a /schedules URL in namespace ns.
+func scheduleRequest(t *testing.T, method, url, ns string) (int, string) {
+	t.Helper()
+	req, _ := http.NewRequest(method, url, nil)
+	if ns != "" {
+		req.Header.Set("X-Namespace", ns)
+	}
+	return send(t, req)
+}
+
+// restartSchedules reloads the schedules from disk as a server restart would.
+func restartSchedules() {
+	schedules.cron.Stop()
+	startSchedules(nil)
+}
+
+func TestScheduleEnvValuesStayPrivate(t *testing.T) {
+	t.Setenv("ALLOW_JOB_ENV", "1")
+	srv := newTestServer(t)
+	sched := createTestSchedule(t, srv.URL, "", `{"args": ["true"], "schedule": "@every 1h", "env": {"SECRET": "hunter2"}}`)
+	if len(sched.Job.Env) != 0 || strings.Join(sched.EnvKeys, ",") != "SECRET" {
+		t.Errorf("created schedule shows env %v, env_keys %v", sched.Job.Env, sched.EnvKeys)
+	}
+	for _, url := range []string{srv.URL + "/schedules", srv.URL + "/schedules/" + sched.ID} {
+		status, body := scheduleRequest(t, http.MethodGet, url, "")
+		if status != http.StatusOK || strings.Contains(body, "hunter2") || !strings.Contains(body, `"env_keys":["SECRET"]`) {
+			t.Errorf("GET %s: %d %s", url, status, body)
+		}
+	}
+
+	data, err := os.ReadFile(filepath.Join(schedulesDir(), sched.ID+".json"))
+	if err != nil || strings.Contains(string(data), "hunter2") {
+		t.Errorf("schedule file holds the env value (err %v): %s", err, data)
+	}
+	info, err := os.Stat(filepath.Join(schedulesDir(), sched.ID+".env"))
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("env file: %v, %v", info, err)
+	}
+
+	// After a restart the values are read back for the jobs it creates.
+	restartSchedules()
+	schedules.mu.Lock()
+	env := schedules.schedules[sched.ID].Job.Env
+	schedules.mu.Unlock()
+	if env["SECRET"] != "hunter2" {
+		t.Errorf("reloaded schedule env = %v", env)
+	}
+}
+
+func TestScheduleLegacyInlineEnvIsMigrated(t *testing.T) {
+	newTestServer(t)
+	os.MkdirAll(schedulesDir(), 0755)
+	legacy := `{"id": "legacy", "schedule": "@every 1h", "job": {"args": ["true"], "env": {"TOKEN": "abc"}}}`
+	if err := os.WriteFile(filepath.Join(schedulesDir(), "legacy.json"), []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	restartSchedules()
+	data, _ := os.ReadFile(filepath.Join(schedulesDir(), "legacy.json"))
+	if strings.Contains(string(data), "abc") {
+		t.Errorf("legacy schedule still holds the env value: %s", data)
+	}
+	schedules.mu.Lock()
+	env := schedules.schedules["legacy"].Job.Env
+	schedules.mu.Unlock()
+	if env["TOKEN"] != "abc" {
+		t.Errorf("legacy schedule env = %v", env)
+	}
+}
+
+func TestSchedulesAreScopedToNamespace(t *testing.T) {
+	srv := newTestServer(t)
+	sched := createTestSchedule(t, srv.URL, "team-a", `{"args": ["true"], "schedule": "@every 1h"}`)
+
+	status, body := scheduleRequest(t, http.MethodGet, srv.URL+"/schedules", "team-b")
+	if status != http.StatusOK || strings.TrimSpace(body) != "[]" {
+		t.Errorf("other namespace lists %d %s", status, body)
+	}
+	status, body = scheduleRequest(t, http.MethodGet, srv.URL+"/schedules", "")
+	if strings.TrimSpace(body) != "[]" {
+		t.Errorf("default namespace lists %d %s", status, body)
+	}
+	if status, _ := scheduleRequest(t, http.MethodGet, srv.URL+"/schedules/"+sched.ID, "team-b"); status != http.StatusNotFound {
+		t.Errorf("GET from other namespace: %d", status)
+	}
+	if status, _ := scheduleRequest(t, http.MethodDelete, srv.URL+"/schedules/"+sched.ID, "team-b"); status != http.StatusNotFound {
+		t.Errorf("DELETE from other namespace: %d", status)
+	}
+	status, body = scheduleRequest(t, http.MethodGet, srv.URL+"/schedules", "team-a")
+	if !strings.Contains(body, sched.ID) {
+		t.Errorf("own namespace lists %d %s", status, body)
+	}
+	if status, _ := scheduleRequest(t, http.MethodDelete, srv.URL+"/schedules/"+sched.ID, "team-a"); status != http.StatusNoContent {
+		t.Errorf("DELETE from own namespace: %d", status)
+	}
+}
+
+func TestScheduleWebhookHeaderValuesStayPrivate(t *testing.T) {
+	srv := newTestServer(t)
+	sched := createTestSchedule(t, srv.URL, "", `{"args": ["true"], "schedule": "@every 1h", "webhook": "http://127.0.0.1:9/hook", "webhook_headers": {"Authorization": "Bearer s3cret"}}`)
+	if len(sched.Job.WebhookHeaders) != 0 || strings.Join(sched.WebhookHeaderKeys, ",") != "Authorization" {
+		t.Errorf("created schedule shows headers %v, keys %v", sched.Job.WebhookHeaders, sched.WebhookHeaderKeys)
+	}
+	for _, url := range []string{srv.URL + "/schedules", srv.URL + "/schedules/" + sched.ID} {
+		status, body := scheduleRequest(t, http.MethodGet, url, "")
+		if status != http.StatusOK || strings.Contains(body, "s3cret") || !strings.Contains(body, `"webhook_header_keys":["Authorization"]`) {
+			t.Errorf("GET %s: %d %s", url, status, body)
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(schedulesDir(), sched.ID+".json"))
+	if err != nil || strings.Contains(string(data), "s3cret") {
+		t.Errorf("schedule file holds the header value (err %v): %s", err, data)
+	}
+	info, err := os.Stat(filepath.Join(schedulesDir(), sched.ID+".webhook_headers"))
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("webhook headers file: %v, %v", info, err)
+	}
+
+	restartSchedules()
+	schedules.mu.Lock()
+	headers := schedules.schedules[sched.ID].Job.WebhookHeaders
+	schedules.mu.Unlock()
+	if headers["Authorization"] != "Bearer s3cret" {
+		t.Errorf("reloaded schedule headers = %v", headers)
+	}
+
+	if status, _ := scheduleRequest(t, http.MethodDelete, srv.URL+"/schedules/"+sched.ID, ""); status != http.StatusNoContent {
+		t.Fatalf("DELETE: %d", status)
+	}
+	if _, err := os.Stat(filepath.Join(schedulesDir(), sched.ID+".webhook_headers")); !os.IsNotExist(err) {
+		t.Errorf("webhook headers file left after delete: %v", err)
+	}
+}
+
+func TestScheduleNextRun(t *testing.T) {
+	srv := newTestServer(t)
+	before := time.Now()
+	sched := createTestSchedule(t, srv.URL, "", `{"args": ["true"], "schedule": "*/5 * * * *"}`)
+	next := sched.NextRun
+	if next == nil || !next.After(before) || next.After(before.Add(5*time.Minute)) || next.Minute()%5 != 0 || next.Second() != 0 {
+		t.Errorf("next_run of */5 * * * * created at %v: %v", before, next)
+	}
+	for _, body := range []string{
+		`{"args": ["true"], "schedule": "not a cron spec"}`,
+		`{"args": ["true"], "schedule": "* * * * *", "idempotency_key": "k"}`,
+		`{"args": ["true"], "schedule": "* * * * *"}` + "\nstdin",
+	} {
+		if status, resp := do(t, http.MethodPost, srv.URL+"/jobs", "application/json", body); status != http.StatusBadRequest {
+			t.Errorf("%s: %d %s", body, status, resp)
+		}
+	}
+}
+
+func TestScheduleCreatesJobs(t *testing.T) {
+	srv := newTestServer(t)
+	sched := createTestSchedule(t, srv.URL, "", `{"args": ["true"], "schedule": "@every 1s"}`)
+	var jobs []*JobMeta
+	eventually(t, "schedule created no job", func() bool {
+		jobs, _, _ = store.List(jobFilter{Status: "COMPLETED"})
+		return len(jobs) > 0
+	})
+	if jobs[0].ParentScheduleID != sched.ID {
+		t.Errorf("job's parent_schedule_id = %q, want %q", jobs[0].ParentScheduleID, sched.ID)
+	}
+	if status, _ := scheduleRequest(t, http.MethodDelete, srv.URL+"/schedules/"+sched.ID, ""); status != http.StatusNoContent {
+		t.Fatalf("DELETE: %d", status)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import "sync"
+
+// slotPool is the worker's concurrency limit: a fixed number of slots, of
+// which each running job holds as many as its weight.
+type slotPool struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	size int
+	used int
+}
+
+func newSlotPool(size int) *slotPool {
+	p := &slotPool{size: size}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// weight returns the number of slots a job takes: its weight, 1 if it has
+// none, and at most the size of the pool, which may have shrunk since the
+// job was submitted.
+func (p *slotPool) weight(meta *JobMeta) int {
+	return min(max(meta.Weight, 1), p.size)
+}
+
+// acquire blocks until n slots are free and takes them.
+func (p *slotPool) acquire(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.used+n > p.size {
+		p.cond.Wait()
+	}
+	p.used += n
+}
+
+// release returns n slots to the pool.
+func (p *slotPool) release(n int) {
+	p.mu.Lock()
+	p.used -= n
+	p.mu.Unlock()
+	p.cond.Broadcast()
+}
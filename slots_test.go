@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSlotPoolNeverOversubscribes(t *testing.T) {
+	p := newSlotPool(4)
+	var mu sync.Mutex
+	inFlight, peak := 0, 0
+	var wg sync.WaitGroup
+	for i := 0; i < 40; i++ {
+		n := p.weight(&JobMeta{Weight: i % 6})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.acquire(n)
+			mu.Lock()
+			inFlight += n
+			peak = max(peak, inFlight)
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			inFlight -= n
+			mu.Unlock()
+			p.release(n)
+		}()
+	}
+	wg.Wait()
+	if peak > 4 {
+		t.Errorf("%d slots in use at once, pool has 4", peak)
+	}
+	if peak < 2 {
+		t.Errorf("at most %d slots were ever in use", peak)
+	}
+}
+
+func TestWeightedJobs(t *testing.T) {
+	srv := newTestServer(t)
+	// The heavy job takes every slot, so it runs only when nothing else does.
+	light1 := submit(t, srv.URL, `{"args": ["sleep", "0.3"]}`)
+	heavy := submit(t, srv.URL, fmt.Sprintf(`{"args": ["sleep", "0.3"], "weight": %d}`, testMaxConcurrentJobs))
+	light2 := submit(t, srv.URL, `{"args": ["sleep", "0.3"]}`)
+	metas := map[string]*JobMeta{}
+	for _, id := range []string{light1, heavy, light2} {
+		metas[id] = waitFinished(t, srv.URL, id)
+	}
+	h := metas[heavy]
+	for _, id := range []string{light1, light2} {
+		m := metas[id]
+		if m.StartedAt.Before(h.CompletedAt) && h.StartedAt.Before(m.CompletedAt) {
+			t.Errorf("light job ran %v-%v, alongside the heavy job at %v-%v", m.StartedAt, m.CompletedAt, h.StartedAt, h.CompletedAt)
+		}
+	}
+	if !metas[light2].StartedAt.After(h.StartedAt) {
+		t.Error("light job submitted after the heavy one overtook it")
+	}
+
+	if status, body := do(t, http.MethodPost, srv.URL+"/jobs", "application/json", fmt.Sprintf(`{"args": ["true"], "weight": %d}`, testMaxConcurrentJobs+1)); status != http.StatusBadRequest {
+		t.Errorf("weight above MAX_CONCURRENT_JOBS: %d %s", status, body)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// jobCounts tracks how many jobs on disk are in each status. It is loaded
+// once at startup and kept current by countingStore, so /stats doesn't have
+// to read every job's metadata.
+var jobCounts = &statusCounts{status: make(map[string]string), counts: make(map[string]int)}
+
+type statusCounts struct {
+	mu sync.Mutex
+	// status holds the last known status of each job, by namespace/ID.
+	status map[string]string
+	counts map[string]int
+}
+
+func statusKey(ns, id string) string {
+	return ns + "/" + id
+}
+
+func (c *statusCounts) set(ns, id, status string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := statusKey(ns, id)
+	if old, ok := c.status[key]; ok {
+		c.counts[old]--
+	}
+	c.status[key] = status
+	c.counts[status]++
+}
+
+func (c *statusCounts) remove(ns, id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := statusKey(ns, id)
+	if old, ok := c.status[key]; ok {
+		c.counts[old]--
+		delete(c.status, key)
+	}
+}
+
+// snapshot returns the number of jobs in every status, including those with
+// none, and the total.
+func (c *statusCounts) snapshot() (map[string]int, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := make(map[string]int, len(jobStatuses))
+	for _, s := range jobStatuses {
+		counts[s] = c.counts[s]
+	}
+	return counts, len(c.status)
+}
+
+// loadJobCounts counts the jobs already on disk, dead-lettered ones
+// included.
+func loadJobCounts() {
+	metas, _, err := store.List(jobFilter{AllNamespaces: true, DeadLetter: "include"})
+	if err != nil {
+		slog.Warn("Failed to count jobs", "event", "store_error", "error", err)
+	}
+	for _, meta := range metas {
+		jobCounts.set(meta.Namespace, meta.ID, meta.Status)
+	}
+}
+
+// countingStore wraps a jobStore to keep jobCounts up to date: every status
+// change is saved through it, and every job removed is deleted through it.
+type countingStore struct {
+	jobStore
+}
+
+func (s countingStore) Create(meta *JobMeta) error {
+	if err := s.jobStore.Create(meta); err != nil {
+		return err
+	}
+	jobCounts.set(meta.Namespace, meta.ID, meta.Status)
+	return nil
+}
+
+func (s countingStore) Save(meta *JobMeta) error {
+	if err := s.jobStore.Save(meta); err != nil {
+		return err
+	}
+	jobCounts.set(meta.Namespace, meta.ID, meta.Status)
+	return nil
+}
+
+func (s countingStore) Delete(ns, id string) error {
+	if err := s.jobStore.Delete(ns, id); err != nil {
+		return err
+	}
+	jobCounts.remove(ns, id)
+	return nil
+}
+
+// statsHandler returns an operational snapshot of the server as JSON.
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+		return
+	}
+	mu.Lock()
+	running := len(runningJobs)
+	mu.Unlock()
+	counts, total := jobCounts.snapshot()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"uptime_seconds":      int(time.Since(startTime).Seconds()),
+		"running_jobs":        running,
+		"queue_depth":         queue.Len(),
+		"max_concurrent_jobs": getMaxConcurrentJobs(),
+		"jobs_total":          total,
+		"jobs_by_status":      counts,
+	})
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"testing"
+)
+
+type statsResponse struct {
+	UptimeSeconds     *int           `json:"uptime_seconds"`
+	RunningJobs       int            `json:"running_jobs"`
+	QueueDepth        int            `json:"queue_depth"`
+	MaxConcurrentJobs int            `json:"max_concurrent_jobs"`
+	JobsTotal         int            `json:"jobs_total"`
+	JobsByStatus      map[string]int `json:"jobs_by_status"`
+}
+
+func getStats(t *testing.T, base string) statsResponse {
+	t.Helper()
+	status, body := do(t, http.MethodGet, base+"/stats", "", "")
+	if status != http.StatusOK {
+		t.Fatalf("stats: %d %s", status, body)
+	}
+	var stats statsResponse
+	if err := json.Unmarshal([]byte(body), &stats); err != nil {
+		t.Fatal(err)
+	}
+	// Every status is listed; only the ones with jobs are kept for
+	// comparison.
+	for _, s := range jobStatuses {
+		if _, ok := stats.JobsByStatus[s]; !ok {
+			t.Errorf("jobs_by_status has no %s: %s", s, body)
+		}
+	}
+	maps.DeleteFunc(stats.JobsByStatus, func(_ string, n int) bool { return n == 0 })
+	return stats
+}
+
+func TestStats(t *testing.T) {
+	srv := newTestServer(t)
+	completed := submit(t, srv.URL, `{"args": ["true"]}`)
+	waitFinished(t, srv.URL, completed)
+	waitFinished(t, srv.URL, submit(t, srv.URL, `{"args": ["false"]}`))
+	fillSlots(t, srv.URL)
+	submit(t, srv.URL, `{"args": ["true"]}`)
+
+	stats := getStats(t, srv.URL)
+	want := map[string]int{"COMPLETED": 1, "FAILED": 1, "IN_PROGRESS": testMaxConcurrentJobs, "IN_QUEUE": 1}
+	if stats.UptimeSeconds == nil || stats.RunningJobs != testMaxConcurrentJobs || stats.QueueDepth != 1 ||
+		stats.MaxConcurrentJobs != testMaxConcurrentJobs || stats.JobsTotal != 3+testMaxConcurrentJobs || !maps.Equal(stats.JobsByStatus, want) {
+		t.Errorf("stats: %+v", stats)
+	}
+
+	do(t, http.MethodDelete, srv.URL+"/jobs/"+completed, "", "")
+	delete(want, "COMPLETED")
+	if stats := getStats(t, srv.URL); stats.JobsTotal != 2+testMaxConcurrentJobs || !maps.Equal(stats.JobsByStatus, want) {
+		t.Errorf("stats after a delete: %+v", stats)
+	}
+	// The counts are rebuilt from the store when the server starts.
+	loadJobCounts()
+	if stats := getStats(t, srv.URL); !maps.Equal(stats.JobsByStatus, want) {
+		t.Errorf("stats after reloading the counts: %+v", stats)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// jobStore persists job metadata. Job output (stdout, stderr, uploaded files)
+// always stays in the job directory; only where meta.json lives changes.
+type jobStore interface {
+	// Create stores the meta of a new job.
+	Create(meta *JobMeta) error
+	// Save updates the meta of an existing job. It fails with an error
+	// wrapping os.ErrNotExist if the job is gone, so an update finishing after
+	// the job was deleted, purged or evicted can't bring it back.
+	Save(meta *JobMeta) error
+	// Load returns the meta of job id in namespace ns, or an error wrapping
+	// os.ErrNotExist if there is no such job.
+	Load(ns, id string) (*JobMeta, error)
+	// LoadRaw returns the meta of a job as stored, including any fields this
+	// version doesn't know about.
+	LoadRaw(ns, id string) ([]byte, error)
+	Delete(ns, id string) error
+	// List returns the jobs matching f, newest first, along with the number
+	// of matching jobs before Limit and Offset were applied.
+	List(f jobFilter) ([]*JobMeta, int, error)
+}
+
+// jobFilter selects jobs for jobStore.List.
+type jobFilter struct {
+	Namespace string
+	// AllNamespaces matches jobs in every namespace, ignoring Namespace.
+	AllNamespaces bool
+	Status        string
+	// DeadLetter is "exclude" (the default when empty), "include" or "only".
+	DeadLetter string
+	// Labels matches jobs carrying all of these labels.
+	Labels map[string]string
+	// Limit caps the number of jobs returned; 0 means no limit.
+	Limit  int
+	Offset int
+}
+
+// store is where job metadata is kept: meta.json files in the job directories
+// by default, or an SQLite database with STORE=sqlite.
+var store jobStore = fileStore{}
+
+// openStore sets up the store selected by STORE.
+func openStore() error {
+	switch os.Getenv("STORE") {
+	case "", "file":
+		store = fileStore{}
+	case "sqlite":
+		s, err := openSQLiteStore(filepath.Join(getJobsDir(), "jobs.db"))
+		if err != nil {
+			return err
+		}
+		store = s
+	default:
+		return fmt.Errorf("unknown STORE %q (want file or sqlite)", os.Getenv("STORE"))
+	}
+	store = countingStore{store}
+	loadJobCounts()
+	return nil
+}
+
+// fileStore keeps each job's meta in meta.json inside its directory.
+type fileStore struct{}
+
+func (s fileStore) Create(meta *JobMeta) error {
+	return s.write(meta)
+}
+
+func (s fileStore) Save(meta *JobMeta) error {
+	if _, err := os.Stat(filepath.Join(getJobDir(meta.Namespace, meta.ID), "meta.json")); err != nil {
+		return err
+	}
+	return s.write(meta)
+}
+
+func (fileStore) write(meta *JobMeta) error {
+	path := filepath.Join(getJobDir(meta.Namespace, meta.ID), "meta.json")
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, 0644)
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it
+// into place, so readers see either the old or the new contents and never a
+// partially written file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, perm)
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+func (fileStore) Load(ns, id string) (*JobMeta, error) {
+	return readMetaFile(filepath.Join(getJobDir(ns, id), "meta.json"))
+}
+
+func (fileStore) LoadRaw(ns, id string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(getJobDir(ns, id), "meta.json"))
+}
+
+func (fileStore) Delete(ns, id string) error {
+	err := os.Remove(filepath.Join(getJobDir(ns, id), "meta.json"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (fileStore) List(f jobFilter) ([]*JobMeta, int, error) {
+	nss := []string{f.Namespace}
+	if f.AllNamespaces {
+		nss = namespaces()
+	}
+	var dirs []string
+	for _, ns := range nss {
+		switch f.DeadLetter {
+		case "", "exclude":
+			dirs = append(dirs, getNamespaceDir(ns))
+		case "include":
+			dirs = append(dirs, getNamespaceDir(ns), getDeadLetterDir(ns))
+		case "only":
+			dirs = append(dirs, getDeadLetterDir(ns))
+		}
+	}
+
+	var metas []*JobMeta
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			// Namespace and dead-letter directories only exist once a job
+			// has been put there.
+			if dir == getJobsDir() || !os.IsNotExist(err) {
+				return nil, 0, err
+			}
+			continue
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
+			}
+			meta, err := readMetaFile(filepath.Join(dir, entry.Name(), "meta.json"))
+			if err != nil || (f.Status != "" && meta.Status != f.Status) || !hasLabels(meta, f.Labels) {
+				continue
+			}
+			metas = append(metas, meta)
+		}
+	}
+	// Compare the times themselves, not formatted strings, which don't order
+	// correctly across time zones.
+	sort.Slice(metas, func(i, j int) bool {
+		return metas[i].EnqueuedAt.After(metas[j].EnqueuedAt)
+	})
+	total := len(metas)
+	metas = metas[min(f.Offset, total):]
+	if f.Limit > 0 && f.Limit < len(metas) {
+		metas = metas[:f.Limit]
+	}
+	return metas, total, nil
+}
+
+func readMetaFile(path string) (*JobMeta, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var meta JobMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteMigrations are applied in order to bring the database schema up to
+// date; PRAGMA user_version records how many have run. Append new steps, never
+// edit old ones.
+var sqliteMigrations = []string{
+	`CREATE TABLE jobs (
+		id          TEXT PRIMARY KEY,
+		namespace   TEXT NOT NULL,
+		status      TEXT NOT NULL,
+		dead_letter INTEGER NOT NULL DEFAULT 0,
+		enqueued_at INTEGER NOT NULL,
+		meta        TEXT NOT NULL
+	);
+	CREATE INDEX jobs_by_namespace ON jobs (namespace, dead_letter, enqueued_at);
+	CREATE INDEX jobs_by_status ON jobs (status);`,
+}
+
+// sqliteStore keeps job metadata in an SQLite database. The full JobMeta is
+// stored as JSON, with the fields used for filtering and ordering copied into
+// their own columns so list queries run in SQL.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+// openSQLiteStore opens (creating if needed) the database at path and
+// migrates it. A new database is seeded with the meta.json files already in
+// JOBS_DIR, so switching an existing server to STORE=sqlite keeps its jobs.
+func openSQLiteStore(path string) (*sqliteStore, error) {
+	if err := os.MkdirAll(getJobsDir(), 0755); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows one writer at a time, and a write on one pooled
+	// connection can fail with SQLITE_BUSY despite busy_timeout while another
+	// connection holds the lock. A single connection serializes all access
+	// instead, so updates are never lost that way.
+	db.SetMaxOpenConns(1)
+	s := &sqliteStore{db: db}
+	created, err := s.migrate()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrating %s: %w", path, err)
+	}
+	if created {
+		if err := s.importFiles(); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("importing job metadata into %s: %w", path, err)
+		}
+	}
+	return s, nil
+}
+
+// migrate applies pending migrations and reports whether the database was
+// created from scratch.
+func (s *sqliteStore) migrate() (bool, error) {
+	var version int
+	if err := s.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return false, err
+	}
+	for i := version; i < len(sqliteMigrations); i++ {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return false, err
+		}
+		if _, err := tx.Exec(sqliteMigrations[i]); err != nil {
+			tx.Rollback()
+			return false, err
+		}
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return false, err
+		}
+		if err := tx.Commit(); err != nil {
+			return false, err
+		}
+	}
+	return version == 0, nil
+}
+
+func (s *sqliteStore) importFiles() error {
+	metas, _, err := fileStore{}.List(jobFilter{AllNamespaces: true, DeadLetter: "include"})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, meta := range metas {
+		if err := s.Create(meta); err != nil {
+			return err
+		}
+	}
+	if len(metas) > 0 {
+		slog.Info("Imported job metadata into SQLite", "event", "store_import", "count", len(metas))
+	}
+	return nil
+}
+
+func (s *sqliteStore) Create(meta *JobMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO jobs (id, namespace, status, dead_letter, enqueued_at, meta)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		meta.ID, meta.Namespace, meta.Status, meta.DeadLetter, meta.EnqueuedAt.UnixNano(), string(data))
+	return err
+}
+
+func (s *sqliteStore) Save(meta *JobMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.Exec(`UPDATE jobs SET status = ?, dead_letter = ?, enqueued_at = ?, meta = ?
+		WHERE id = ? AND namespace = ?`,
+		meta.Status, meta.DeadLetter, meta.EnqueuedAt.UnixNano(), string(data), meta.ID, meta.Namespace)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("job %s: %w", meta.ID, os.ErrNotExist)
+	}
+	return nil
+}
+
+func (s *sqliteStore) Load(ns, id string) (*JobMeta, error) {
+	data, err := s.LoadRaw(ns, id)
+	if err != nil {
+		return nil, err
+	}
+	var meta JobMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+func (s *sqliteStore) LoadRaw(ns, id string) ([]byte, error) {
+	var data string
+	err := s.db.QueryRow("SELECT meta FROM jobs WHERE id = ? AND namespace = ?", id, ns).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("job %s: %w", id, os.ErrNotExist)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []byte(data), nil
+}
+
+func (s *sqliteStore) Delete(ns, id string) error {
+	_, err := s.db.Exec("DELETE FROM jobs WHERE id = ? AND namespace = ?", id, ns)
+	return err
+}
+
+func (s *sqliteStore) List(f jobFilter) ([]*JobMeta, int, error) {
+	var where []string
+	var args []any
+	if !f.AllNamespaces {
+		where = append(where, "namespace = ?")
+		args = append(args, f.Namespace)
+	}
+	if f.Status != "" {
+		where = append(where, "status = ?")
+		args = append(args, f.Status)
+	}
+	// Label keys are restricted to labelKeyPattern, so they can be quoted
+	// in a JSON path as they are.
+	for _, k := range sortedKeys(f.Labels) {
+		where = append(where, "json_extract(meta, ?) = ?")
+		args = append(args, `$.labels."`+k+`"`, f.Labels[k])
+	}
+	switch f.DeadLetter {
+	case "", "exclude":
+		where = append(where, "dead_letter = 0")
+	case "only":
+		where = append(where, "dead_letter = 1")
+	}
+	cond := ""
+	if len(where) > 0 {
+		cond = " WHERE " + strings.Join(where, " AND ")
+	}
+
+	var total int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM jobs"+cond, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	limit := -1
+	if f.Limit > 0 {
+		limit = f.Limit
+	}
+	rows, err := s.db.Query("SELECT meta FROM jobs"+cond+" ORDER BY enqueued_at DESC, id LIMIT ? OFFSET ?",
+		append(args, limit, f.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	var metas []*JobMeta
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, 0, err
+		}
+		var meta JobMeta
+		if err := json.Unmarshal([]byte(data), &meta); err != nil {
+			continue
+		}
+		metas = append(metas, &meta)
+	}
+	return metas, total, rows.Err()
+}
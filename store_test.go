@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// forEachStore runs test against a fresh server with each job store.
+func forEachStore(t *testing.T, test func(t *testing.T, base string)) {
+	for _, kind := range []string{"file", "sqlite"} {
+		t.Run(kind, func(t *testing.T) {
+			t.Setenv("STORE", kind)
+			srv := newTestServer(t)
+			test(t, srv.URL)
+		})
+	}
+}
+
+func TestStoreSaveDoesNotRecreateDeletedJob(t *testing.T) {
+	forEachStore(t, func(t *testing.T, base string) {
+		id := submit(t, base, `{"args": ["true"]}`)
+		meta := waitFinished(t, base, id)
+		if status, body := do(t, http.MethodDelete, base+"/jobs/"+id, "", ""); status != http.StatusNoContent {
+			t.Fatalf("DELETE: %d %s", status, body)
+		}
+		err := store.Save(meta)
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Save after delete = %v, want os.ErrNotExist", err)
+		}
+		if _, err := store.Load(meta.Namespace, id); err == nil {
+			t.Error("deleted job is back in the store")
+		}
+		if _, total := jobCounts.snapshot(); total != 0 {
+			t.Errorf("jobCounts total = %d after delete", total)
+		}
+	})
+}
+
+func TestLateWebhookSaveDoesNotResurrectJob(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer receiver.Close()
+	forEachStore(t, func(t *testing.T, base string) {
+		id := submit(t, base, `{"args": ["true"]}`)
+		meta := waitFinished(t, base, id)
+		if status, body := do(t, http.MethodDelete, base+"/jobs/"+id, "", ""); status != http.StatusNoContent {
+			t.Fatalf("DELETE: %d %s", status, body)
+		}
+		// The webhook for the job is still being delivered when it is deleted.
+		meta.Webhook = receiver.URL
+		sendWebhook(meta)
+		if status, _ := do(t, http.MethodGet, base+"/jobs/"+id+"/status", "", ""); status != http.StatusNotFound {
+			t.Errorf("status after delete: %d", status)
+		}
+		if _, body := do(t, http.MethodGet, base+"/jobs", "", ""); strings.Contains(body, id) {
+			t.Errorf("deleted job listed again: %s", body)
+		}
+	})
+}
+
+func TestListSortsByEnqueueTime(t *testing.T) {
+	forEachStore(t, func(t *testing.T, base string) {
+		// As strings, these times sort in a different order than as times.
+		enqueued := map[string]string{
+			"a": "2026-01-02T10:00:00+05:00",
+			"b": "2026-01-02T06:00:00Z",
+			"c": "2026-01-02T09:00:00-02:00",
+		}
+		ids := map[string]string{}
+		for name, ts := range enqueued {
+			at, err := time.Parse(time.RFC3339, ts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			meta := &JobMeta{ID: uuid.NewString(), Args: []string{"true"}, Status: "COMPLETED", EnqueuedAt: at}
+			ids[meta.ID] = name
+			os.MkdirAll(getJobDir("", meta.ID), 0755)
+			if err := store.Create(meta); err != nil {
+				t.Fatal(err)
+			}
+		}
+		order := func(query string) (string, int) {
+			status, body := do(t, http.MethodGet, base+"/jobs"+query, "", "")
+			if status != http.StatusOK {
+				t.Fatalf("GET /jobs%s: %d %s", query, status, body)
+			}
+			var list struct {
+				Total int
+				Jobs  []jobSummary
+			}
+			if err := json.Unmarshal([]byte(body), &list); err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, job := range list.Jobs {
+				names = append(names, ids[job.ID])
+			}
+			return strings.Join(names, " "), list.Total
+		}
+		if got, total := order(""); got != "c b a" || total != 3 {
+			t.Errorf("jobs listed as %q (total %d), want newest first: c b a", got, total)
+		}
+		if got, total := order("?limit=1&offset=1"); got != "b" || total != 3 {
+			t.Errorf("second page: %q (total %d)", got, total)
+		}
+	})
+}
+
+func TestConcurrentSaveAndLoad(t *testing.T) {
+	forEachStore(t, func(t *testing.T, base string) {
+		id := submit(t, base, `{"args": ["true"]}`)
+		meta := waitFinished(t, base, id)
+		done := make(chan struct{})
+		var wg sync.WaitGroup
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				m := *meta
+				for i := 0; ; i++ {
+					select {
+					case <-done:
+						return
+					default:
+					}
+					// Vary the size so a torn write would show up as bad JSON.
+					m.Args = []string{"echo", strings.Repeat("x", (i*(w+1))%4096)}
+					if err := store.Save(&m); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}(w)
+		}
+		for i := 0; i < 500; i++ {
+			if _, err := store.Load(meta.Namespace, id); err != nil {
+				t.Errorf("Load during saves: %v", err)
+				break
+			}
+			if jobs, _, err := store.List(jobFilter{}); err != nil || len(jobs) != 1 {
+				t.Errorf("List during saves: %d jobs, %v", len(jobs), err)
+				break
+			}
+		}
+		close(done)
+		wg.Wait()
+		entries, _ := os.ReadDir(getJobDir(meta.Namespace, id))
+		for _, e := range entries {
+			if strings.HasPrefix(e.Name(), ".") {
+				t.Errorf("temporary file %s left behind", e.Name())
+			}
+		}
+	})
+}
+
+func TestRawMeta(t *testing.T) {
+	forEachStore(t, func(t *testing.T, base string) {
+		id := submit(t, base, `{"args": ["true"]}`)
+		waitFinished(t, base, id)
+		// Metadata written by a newer version, with a field this one
+		// doesn't know about.
+		stored, _ := store.LoadRaw("", id)
+		stored = append([]byte(`{"field_from_the_future":[1,2],`), stored[1:]...)
+		switch s := store.(countingStore).jobStore.(type) {
+		case fileStore:
+			if err := os.WriteFile(filepath.Join(getJobDir("", id), "meta.json"), stored, 0644); err != nil {
+				t.Fatal(err)
+			}
+		case *sqliteStore:
+			if _, err := s.db.Exec("UPDATE jobs SET meta = ? WHERE id = ?", string(stored), id); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		req, _ := http.NewRequest(http.MethodGet, base+"/jobs/"+id+"/meta", nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		served, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || !bytes.Equal(served, stored) {
+			t.Errorf("meta: %d %s, want %s", resp.StatusCode, served, stored)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type %q", ct)
+		}
+		if status, body := do(t, http.MethodGet, base+"/jobs/"+id+"/status", "", ""); status != http.StatusOK || strings.Contains(body, "field_from_the_future") {
+			t.Errorf("status: %d %s", status, body)
+		}
+		if status, _ := do(t, http.MethodGet, base+"/jobs/"+uuid.NewString()+"/meta", "", ""); status != http.StatusNotFound {
+			t.Errorf("meta of unknown job: %d", status)
+		}
+	})
+}
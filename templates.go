@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// templates holds the job templates loaded from TEMPLATES_DIR, by name. It is
+// filled once at startup and only read afterwards.
+var templates = map[string]*jobRequest{}
+
+// loadTemplates reads every <name>.json file in TEMPLATES_DIR as a job
+// template. It does nothing when TEMPLATES_DIR is unset.
+func loadTemplates() error {
+	dir := os.Getenv("TEMPLATES_DIR")
+	if dir == "" {
+		return nil
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), ".json")
+		t, err := readTemplate(path)
+		if err != nil {
+			return fmt.Errorf("template %s: %w", path, err)
+		}
+		templates[name] = t
+	}
+	return nil
+}
+
+func readTemplate(path string) (*jobRequest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var t jobRequest
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&t); err != nil {
+		return nil, err
+	}
+	// These describe one particular submission rather than a kind of job.
+	switch {
+	case t.Template != "":
+		return nil, fmt.Errorf("templates can't reference other templates")
+	case t.Namespace != "", t.IdempotencyKey != "", t.Schedule != "", t.RunAt != nil, t.Delay != 0, t.Hold, len(t.DependsOn) > 0, t.StdinFromJob != "", t.InputBase64 != "":
+		return nil, fmt.Errorf("namespace, idempotency_key, schedule, run_at, delay_seconds, hold, depends_on, stdin_from_job and input_base64 can't be set in a template")
+	}
+	return &t, nil
+}
+
+// applyTemplate fills in the fields of req left unset from the template it
+// names. env, labels and webhook_headers are merged, with the request's values
+// taking precedence.
+func applyTemplate(req *jobRequest) error {
+	if req.Template == "" {
+		return nil
+	}
+	t, ok := templates[req.Template]
+	if !ok {
+		return badRequest("Unknown template %q", req.Template)
+	}
+	if len(req.Args) == 0 {
+		req.Args = t.Args
+	}
+	req.Env = mergeMaps(t.Env, req.Env)
+	req.Labels = mergeMaps(t.Labels, req.Labels)
+	req.WebhookHeaders = mergeMaps(t.WebhookHeaders, req.WebhookHeaders)
+	setDefault(&req.MimeType, t.MimeType)
+	setDefault(&req.Webhook, t.Webhook)
+	setDefault(&req.WebhookMethod, t.WebhookMethod)
+	setDefault(&req.Cwd, t.Cwd)
+	setDefault(&req.RunAsUser, t.RunAsUser)
+	setDefault(&req.Timeout, t.Timeout)
+	setDefault(&req.IdleTimeout, t.IdleTimeout)
+	setDefault(&req.MaxOutputBytes, t.MaxOutputBytes)
+	setDefault(&req.MaxRetries, t.MaxRetries)
+	setDefault(&req.Priority, t.Priority)
+	setDefault(&req.ExpiresAfter, t.ExpiresAfter)
+	setDefault(&req.Nice, t.Nice)
+	setDefault(&req.MemoryLimitMB, t.MemoryLimitMB)
+	setDefault(&req.Weight, t.Weight)
+	setDefault(&req.KeepInput, t.KeepInput)
+	if len(req.WebhookEvents) == 0 {
+		req.WebhookEvents = t.WebhookEvents
+	}
+	if len(req.OutputFiles) == 0 {
+		req.OutputFiles = t.OutputFiles
+	}
+	return nil
+}
+
+// setDefault sets *field to def if it holds the zero value.
+func setDefault[T comparable](field *T, def T) {
+	var zero T
+	if *field == zero {
+		*field = def
+	}
+}
+
+// mergeMaps returns base overlaid with override, without modifying either.
+func mergeMaps(base, override map[string]string) map[string]string {
+	if len(base) == 0 {
+		return override
+	}
+	merged := maps.Clone(base)
+	maps.Copy(merged, override)
+	return merged
+}
+
+// templateInfo describes a template in the GET /templates listing. Only the
+// names of its environment variables and webhook headers are shown, as for
+// jobs.
+type templateInfo struct {
+	Name              string   `json:"name"`
+	EnvKeys           []string `json:"env_keys,omitempty"`
+	WebhookHeaderKeys []string `json:"webhook_header_keys,omitempty"`
+	*jobRequest
+}
+
+func templatesHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+		return
+	}
+	out := []templateInfo{}
+	for name, t := range templates {
+		spec := *t
+		spec.Env = nil
+		spec.WebhookHeaders = nil
+		out = append(out, templateInfo{Name: name, EnvKeys: sortedKeys(t.Env), WebhookHeaderKeys: sortedKeys(t.WebhookHeaders), jobRequest: &spec})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTemplates(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "greet.json"), []byte(`{
+		"args": ["sh", "-c", "echo $GREETING $NAME"],
+		"env": {"GREETING": "hello", "NAME": "template"},
+		"labels": {"kind": "greeting"},
+		"timeout_seconds": 30
+	}`), 0644)
+	t.Setenv("TEMPLATES_DIR", dir)
+	t.Setenv("ALLOW_JOB_ENV", "1")
+	srv := newTestServer(t)
+
+	id := submit(t, srv.URL, `{"template": "greet", "env": {"NAME": "world"}}`)
+	if out := catOutput(t, srv.URL, id); out != "hello world\n" {
+		t.Errorf("job from template: %q", out)
+	}
+	meta := getStatus(t, srv.URL, id)
+	if meta.Template != "greet" || meta.Timeout != 30 || meta.Labels["kind"] != "greeting" {
+		t.Errorf("job from template: template %q, timeout %d, labels %v", meta.Template, meta.Timeout, meta.Labels)
+	}
+	id = submit(t, srv.URL, `{"template": "greet", "args": ["echo", "own args"], "timeout_seconds": 5}`)
+	if out := catOutput(t, srv.URL, id); out != "own args\n" {
+		t.Errorf("job overriding the template's args: %q", out)
+	}
+	if meta := getStatus(t, srv.URL, id); meta.Timeout != 5 {
+		t.Errorf("timeout overriding the template's: %d", meta.Timeout)
+	}
+	if status, body := do(t, http.MethodPost, srv.URL+"/jobs", "application/json", `{"template": "nope"}`); status != http.StatusBadRequest {
+		t.Errorf("unknown template: %d %s", status, body)
+	}
+
+	status, body := do(t, http.MethodGet, srv.URL+"/templates", "", "")
+	if status != http.StatusOK || !strings.Contains(body, `"name":"greet"`) || !strings.Contains(body, `"env_keys":["GREETING","NAME"]`) {
+		t.Errorf("template listing: %d %s", status, body)
+	}
+	if strings.Contains(body, "hello") {
+		t.Errorf("template listing shows environment values: %s", body)
+	}
+}
+
+func TestInvalidTemplates(t *testing.T) {
+	for name, spec := range map[string]string{
+		"nested":  `{"template": "other"}`,
+		"hold":    `{"args": ["true"], "hold": true}`,
+		"unknown": `{"args": ["true"], "no_such_field": 1}`,
+		"syntax":  `{"args": [`,
+	} {
+		dir := t.TempDir()
+		os.WriteFile(filepath.Join(dir, name+".json"), []byte(spec), 0644)
+		t.Setenv("TEMPLATES_DIR", dir)
+		if err := loadTemplates(); err == nil {
+			t.Errorf("template %s loaded", name)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// finishedJobs hands out channels that are closed when a job reaches a
+// terminal state, so /wait requests are woken as soon as it happens. A job's
+// entry lives only as long as someone is waiting for it.
+var finishedJobs = struct {
+	sync.Mutex
+	chans map[string]*finishWaiters
+}{chans: make(map[string]*finishWaiters)}
+
+// finishWaiters is the channel closed when a job finishes and the number of
+// requests waiting on it.
+type finishWaiters struct {
+	ch chan struct{}
+	n  int
+}
+
+// finishedChan returns a channel that is closed once job id finishes, and a
+// function the caller must call when it stops waiting, whether or not the job
+// finished, to release the channel.
+func finishedChan(id string) (<-chan struct{}, func()) {
+	finishedJobs.Lock()
+	defer finishedJobs.Unlock()
+	waiters, ok := finishedJobs.chans[id]
+	if !ok {
+		waiters = &finishWaiters{ch: make(chan struct{})}
+		finishedJobs.chans[id] = waiters
+	}
+	waiters.n++
+	return waiters.ch, func() {
+		finishedJobs.Lock()
+		defer finishedJobs.Unlock()
+		if waiters.n--; waiters.n == 0 && finishedJobs.chans[id] == waiters {
+			delete(finishedJobs.chans, id)
+		}
+	}
+}
+
+// notifyFinished wakes everything waiting for job id to finish.
+func notifyFinished(id string) {
+	finishedJobs.Lock()
+	defer finishedJobs.Unlock()
+	if waiters, ok := finishedJobs.chans[id]; ok {
+		close(waiters.ch)
+		delete(finishedJobs.chans, id)
+	}
+}
+
+// waitJob serves GET /jobs/{id}/wait: it blocks until the job reaches a
+// terminal state, the ?timeout= (seconds, default 30, at most 300) elapses or
+// the client goes away, and then responds with the job's meta as it stands.
+func waitJob(w http.ResponseWriter, r *http.Request, ns, id string) {
+	timeout := 30
+	if v := r.URL.Query().Get("timeout"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 300 {
+			httpError(w, "timeout must be between 0 and 300 seconds", http.StatusBadRequest)
+			return
+		}
+		timeout = n
+	}
+
+	noWriteTimeout(w)
+	// Subscribe before checking the status so a job finishing in between
+	// isn't missed.
+	done, unsubscribe := finishedChan(id)
+	defer unsubscribe()
+	meta, err := loadMeta(ns, id)
+	if err != nil {
+		httpError(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	if !isTerminal(meta.Status) {
+		timer := time.NewTimer(time.Duration(timeout) * time.Second)
+		defer timer.Stop()
+		select {
+		case <-done:
+		case <-timer.C:
+		case <-r.Context().Done():
+			return
+		}
+		if meta, err = loadMeta(ns, id); err != nil {
+			httpError(w, "Job not found", http.StatusNotFound)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(meta)
+}
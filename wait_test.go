@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// waitingFor returns how many jobs have /wait requests subscribed.
+func waitingFor() int {
+	finishedJobs.Lock()
+	defer finishedJobs.Unlock()
+	return len(finishedJobs.chans)
+}
+
+func TestWaitReturnsWhenJobFinishes(t *testing.T) {
+	srv := newTestServer(t)
+	id := submit(t, srv.URL, `{"args": ["sleep", "0.2"]}`)
+	status, body := do(t, http.MethodGet, srv.URL+"/jobs/"+id+"/wait?timeout=10", "", "")
+	if status != http.StatusOK || !strings.Contains(body, `"status":"COMPLETED"`) {
+		t.Errorf("wait: %d %s", status, body)
+	}
+	if n := waitingFor(); n != 0 {
+		t.Errorf("%d wait subscriptions left", n)
+	}
+}
+
+func TestWaitReleasesSubscriptions(t *testing.T) {
+	srv := newTestServer(t)
+	if status, _ := do(t, http.MethodGet, srv.URL+"/jobs/"+uuid.NewString()+"/wait", "", ""); status != http.StatusNotFound {
+		t.Errorf("wait for a missing job: %d", status)
+	}
+	id := submit(t, srv.URL, `{"args": ["true"]}`)
+	waitFinished(t, srv.URL, id)
+	if status, _ := do(t, http.MethodGet, srv.URL+"/jobs/"+id+"/wait", "", ""); status != http.StatusOK {
+		t.Errorf("wait for a finished job: %d", status)
+	}
+
+	id = submit(t, srv.URL, `{"args": ["sleep", "30"]}`)
+	if status, body := do(t, http.MethodGet, srv.URL+"/jobs/"+id+"/wait?timeout=0", "", ""); status != http.StatusOK || !strings.Contains(body, id) {
+		t.Errorf("wait timing out: %d %s", status, body)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/jobs/"+id+"/wait", nil)
+	if resp, err := http.DefaultClient.Do(req); err == nil {
+		resp.Body.Close()
+		t.Error("wait returned before the job finished")
+	}
+	eventually(t, "wait subscriptions left behind", func() bool { return waitingFor() == 0 })
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/url"
+	"sync"
+	"time"
+)
+
+// webhookBreaker is a circuit breaker per webhook host. After
+// WEBHOOK_BREAKER_THRESHOLD consecutive failed deliveries to a host, further
+// deliveries to it are skipped for WEBHOOK_BREAKER_COOLDOWN, so a receiver
+// that is down doesn't keep goroutines busy retrying. Once the cooldown has
+// passed deliveries are attempted again; the first one to fail reopens the
+// breaker and the first to succeed closes it.
+var webhookBreaker = struct {
+	sync.Mutex
+	hosts map[string]*breakerState
+}{hosts: make(map[string]*breakerState)}
+
+type breakerState struct {
+	failures  int
+	openUntil time.Time
+}
+
+// webhookHost returns the host deliveries to rawURL are counted against.
+func webhookHost(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return u.Host
+}
+
+// breakerAllows reports whether a delivery to host may be attempted now.
+// It always does when WEBHOOK_BREAKER_THRESHOLD is 0.
+func breakerAllows(host string) bool {
+	if envInt("WEBHOOK_BREAKER_THRESHOLD", 10) <= 0 {
+		return true
+	}
+	webhookBreaker.Lock()
+	defer webhookBreaker.Unlock()
+	state, ok := webhookBreaker.hosts[host]
+	return !ok || time.Now().After(state.openUntil)
+}
+
+// recordDelivery updates the breaker for host with the outcome of a delivery
+// and reports whether that opened it.
+func recordDelivery(host string, err error) bool {
+	threshold := envInt("WEBHOOK_BREAKER_THRESHOLD", 10)
+	if threshold <= 0 {
+		return false
+	}
+	webhookBreaker.Lock()
+	defer webhookBreaker.Unlock()
+	if err == nil {
+		delete(webhookBreaker.hosts, host)
+		return false
+	}
+	state, ok := webhookBreaker.hosts[host]
+	if !ok {
+		state = &breakerState{}
+		webhookBreaker.hosts[host] = state
+	}
+	state.failures++
+	if state.failures < threshold {
+		return false
+	}
+	state.openUntil = time.Now().Add(envDuration("WEBHOOK_BREAKER_COOLDOWN", time.Minute))
+	return true
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestWebhookBreakerStates(t *testing.T) {
+	t.Setenv("WEBHOOK_BREAKER_THRESHOLD", "3")
+	t.Setenv("WEBHOOK_BREAKER_COOLDOWN", "50ms")
+	resetState()
+	failed := errors.New("503 Service Unavailable")
+	for i := 1; i < 3; i++ {
+		if recordDelivery("down.example", failed) || !breakerAllows("down.example") {
+			t.Fatalf("breaker open after %d failures", i)
+		}
+	}
+	if !recordDelivery("down.example", failed) || breakerAllows("down.example") {
+		t.Fatal("breaker not open after 3 failures")
+	}
+	if !breakerAllows("up.example") {
+		t.Error("breaker of one host blocks another")
+	}
+
+	// After the cooldown it is half-open: one failure reopens it, one
+	// success closes it.
+	time.Sleep(60 * time.Millisecond)
+	if !breakerAllows("down.example") {
+		t.Fatal("breaker still open after the cooldown")
+	}
+	if !recordDelivery("down.example", failed) || breakerAllows("down.example") {
+		t.Fatal("failure after the cooldown didn't reopen the breaker")
+	}
+	time.Sleep(60 * time.Millisecond)
+	recordDelivery("down.example", nil)
+	if recordDelivery("down.example", failed) || !breakerAllows("down.example") {
+		t.Error("success didn't reset the failure count")
+	}
+
+	t.Setenv("WEBHOOK_BREAKER_THRESHOLD", "0")
+	for i := 0; i < 5; i++ {
+		recordDelivery("off.example", failed)
+	}
+	if !breakerAllows("off.example") {
+		t.Error("breaker opened with WEBHOOK_BREAKER_THRESHOLD=0")
+	}
+}
+
+func TestWebhookBreakerSkipsDelivery(t *testing.T) {
+	t.Setenv("WEBHOOK_BREAKER_THRESHOLD", "2")
+	t.Setenv("WEBHOOK_MAX_ATTEMPTS", "2")
+	t.Setenv("WEBHOOK_BACKOFF", "1ms")
+	srv := newTestServer(t)
+	url, deliveries := webhookReceiver(t, http.StatusInternalServerError)
+	body := fmt.Sprintf(`{"args": ["true"], "webhook": %q}`, url)
+
+	first := submit(t, srv.URL, body)
+	if meta := webhookRecorded(t, srv.URL, first); meta.WebhookAttempts != 2 || meta.WebhookDelivered || meta.WebhookSkipped {
+		t.Fatalf("first job: %d attempts, delivered %v, skipped %v", meta.WebhookAttempts, meta.WebhookDelivered, meta.WebhookSkipped)
+	}
+	second := submit(t, srv.URL, body)
+	eventually(t, "webhook of second job not skipped", func() bool {
+		return getStatus(t, srv.URL, second).WebhookSkipped
+	})
+	if meta := getStatus(t, srv.URL, second); meta.WebhookAttempts != 0 {
+		t.Errorf("second job: %d attempts with the breaker open", meta.WebhookAttempts)
+	}
+	if n := len(deliveries); n != 2 {
+		t.Errorf("receiver got %d deliveries, want 2", n)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// webhookMethods are the methods a job's webhook_method may choose; the
+// payload is sent as the request body, so only methods with one qualify.
+var webhookMethods = []string{http.MethodPost, http.MethodPut, http.MethodPatch}
+
+// reservedWebhookHeaders are managed by the HTTP client and can't be set
+// through webhook_headers.
+var reservedWebhookHeaders = []string{"Host", "Content-Length", "Transfer-Encoding", "Connection"}
+
+// checkWebhookOptions validates webhook_method and webhook_headers, and
+// normalizes the method to upper case.
+func checkWebhookOptions(req *jobRequest) error {
+	if req.Webhook == "" && (req.WebhookMethod != "" || len(req.WebhookHeaders) > 0) {
+		return badRequest("webhook_method and webhook_headers need a webhook")
+	}
+	if req.WebhookMethod != "" {
+		req.WebhookMethod = strings.ToUpper(req.WebhookMethod)
+		if !slices.Contains(webhookMethods, req.WebhookMethod) {
+			return badRequest("webhook_method must be one of POST, PUT or PATCH")
+		}
+	}
+	for name, value := range req.WebhookHeaders {
+		if !validHeaderName(name) {
+			return badRequest("Invalid webhook header name %q", name)
+		}
+		if slices.Contains(reservedWebhookHeaders, http.CanonicalHeaderKey(name)) {
+			return badRequest("Webhook header %s can't be set", name)
+		}
+		if strings.ContainsAny(value, "\r\n\x00") {
+			return badRequest("Invalid value for webhook header %s", name)
+		}
+	}
+	return nil
+}
+
+// validHeaderName reports whether name is a non-empty HTTP token.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c <= ' ' || c >= 0x7f || strings.IndexByte(`"(),/:;<=>?@[\]{}`, c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// saveWebhookHeaders stores a job's webhook headers in webhook_headers.json in
+// its directory. Like environment variables, only the names go into
+// meta.json, since the values are often credentials.
+func saveWebhookHeaders(ns, id string, headers map[string]string) error {
+	data, err := json.Marshal(headers)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(getJobDir(ns, id), "webhook_headers.json"), data, 0600)
+}
+
+func loadWebhookHeaders(ns, id string) (map[string]string, error) {
+	data, err := os.ReadFile(filepath.Join(getJobDir(ns, id), "webhook_headers.json"))
+	if err != nil {
+		return nil, err
+	}
+	var headers map[string]string
+	err = json.Unmarshal(data, &headers)
+	return headers, err
+}
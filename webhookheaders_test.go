@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestWebhookMethodAndHeaders(t *testing.T) {
+	srv := newTestServer(t)
+	url, deliveries := webhookReceiver(t, http.StatusOK)
+
+	id := submit(t, srv.URL, fmt.Sprintf(`{"args": ["true"], "webhook": %q, "webhook_method": "put",
+		"webhook_headers": {"Authorization": "Bearer s3cret", "X-Tenant": "acme"}}`, url))
+	d := nextDelivery(t, deliveries)
+	if d.method != http.MethodPut || d.header.Get("Authorization") != "Bearer s3cret" || d.header.Get("X-Tenant") != "acme" ||
+		d.header.Get("Content-Type") != "application/json" {
+		t.Errorf("delivery: %s %v", d.method, d.header)
+	}
+	// Only the header names are kept in the metadata.
+	if status, body := do(t, http.MethodGet, srv.URL+"/jobs/"+id+"/status", "", ""); strings.Contains(body, "s3cret") {
+		t.Errorf("status shows a webhook header value: %d %s", status, body)
+	}
+	webhookRecorded(t, srv.URL, id)
+
+	// The defaults are POST and application/json; a header can override
+	// the content type.
+	id = submit(t, srv.URL, fmt.Sprintf(`{"args": ["true"], "webhook": %q, "webhook_headers": {"Content-Type": "application/vnd.hook+json"}}`, url))
+	if d := nextDelivery(t, deliveries); d.method != http.MethodPost || d.header.Get("Content-Type") != "application/vnd.hook+json" {
+		t.Errorf("delivery: %s %v", d.method, d.header)
+	}
+	webhookRecorded(t, srv.URL, id)
+
+	for _, body := range []string{
+		fmt.Sprintf(`{"args": ["true"], "webhook": %q, "webhook_method": "GET"}`, url),
+		fmt.Sprintf(`{"args": ["true"], "webhook": %q, "webhook_headers": {"Host": "elsewhere"}}`, url),
+		fmt.Sprintf(`{"args": ["true"], "webhook": %q, "webhook_headers": {"Bad Name": "x"}}`, url),
+		fmt.Sprintf(`{"args": ["true"], "webhook": %q, "webhook_headers": {"X-Split": "a\r\nInjected: b"}}`, url),
+		`{"args": ["true"], "webhook_method": "PUT"}`,
+	} {
+		if status, resp := do(t, http.MethodPost, srv.URL+"/jobs", "application/json", body); status != http.StatusBadRequest {
+			t.Errorf("submit %s: %d %s", body, status, resp)
+		}
+	}
+}